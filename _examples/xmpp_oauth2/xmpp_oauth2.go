@@ -5,9 +5,11 @@ xmpp_oauth2 is a demo client that connect on an XMPP server using OAuth2 and pri
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"gosrc.io/xmpp"
 	"gosrc.io/xmpp/stanza"
@@ -19,9 +21,10 @@ func main() {
 			Address: "localhost:5222",
 			// TLSConfig: tls.Config{InsecureSkipVerify: true},
 		},
-		Jid:          "test@localhost",
-		Credential:   xmpp.OAuthToken("OdAIsBlY83SLBaqQoClAn7vrZSHxixT8"),
-		StreamLogger: os.Stdout,
+		Jid: "test@localhost",
+		// The token is fetched before each connection, so that reconnections use a valid token.
+		CredentialProvider: fetchToken,
+		StreamLogger:       os.Stdout,
 		// Insecure:     true,
 	}
 
@@ -39,6 +42,15 @@ func main() {
 	log.Fatal(cm.Run())
 }
 
+// fetchToken returns the OAuth2 token to authenticate with. A real client would get it from
+// its OAuth2 token source, and request a new one from the authorization server when refresh
+// is true, as the server rejected the previous one.
+func fetchToken(ctx context.Context, refresh bool) (xmpp.Credential, error) {
+	token := "OdAIsBlY83SLBaqQoClAn7vrZSHxixT8"
+	expiry := time.Now().Add(time.Hour)
+	return xmpp.OAuthToken(token).WithExpiry(expiry), nil
+}
+
 func errorHandler(err error) {
 	fmt.Println(err.Error())
 }
@@ -0,0 +1,206 @@
+package xmpp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+// ============================================================================
+// Stream management acks
+
+var (
+	// ErrAckTimeout is reported when the server does not answer a stream management ack request in
+	// time. The connection is then closed, to be resumed.
+	ErrAckTimeout = errors.New("stream management ack request timed out")
+	// ErrStanzaNotAcked is passed to the ack handlers of the stanzas which cannot be acknowledged
+	// anymore, for example when the stream management session was not resumed.
+	ErrStanzaNotAcked = errors.New("stanza not acknowledged by the server")
+	// ErrStreamManagementDisabled is passed to the ack handlers of the stanzas sent without
+	// stream management.
+	ErrStreamManagementDisabled = errors.New("stream management is not enabled")
+)
+
+// AckHandler is called when the server acknowledges a stanza with stream management (XEP-0198), or
+// with an error when the stanza cannot be acknowledged.
+type AckHandler func(err error)
+
+// ackTracker keeps the stanzas sent on a stream management session until the server acknowledges
+// them, and requests the acks. It is kept when the session is resumed.
+// See https://xmpp.org/extensions/xep-0198.html#acking
+type ackTracker struct {
+	queue *stanza.UnAckQueue
+	// threshold is the number of stanzas sent before requesting an ack. Disabled when 0.
+	threshold int
+
+	mu       sync.Mutex
+	handlers map[int]AckHandler
+	// buffered maps the sequence numbers of the stanzas sent from the offline buffer to their
+	// sequence numbers in the offline buffer
+	buffered map[int]uint64
+	// unrequested is the number of stanzas sent since the last ack request
+	unrequested int
+	// requested is the time of the oldest unanswered ack request, zero when there is none
+	requested time.Time
+	// lastRequest is the time of the last ack request
+	lastRequest time.Time
+}
+
+func newAckTracker(queue *stanza.UnAckQueue, threshold int) *ackTracker {
+	return &ackTracker{queue: queue, threshold: threshold, handlers: make(map[int]AckHandler),
+		buffered: make(map[int]uint64)}
+}
+
+// track adds a written stanza to the unacknowledged queue. buffered is the sequence number of the
+// stanza in the offline buffer, 0 when it was not buffered. It tells if an ack should be requested,
+// as the threshold is reached.
+func (a *ackTracker) track(data []byte, handler AckHandler, buffered uint64) bool {
+	a.queue.Lock()
+	_ = a.queue.Push(&stanza.UnAckedStz{Stz: string(data)})
+	id := a.queue.Uslice[len(a.queue.Uslice)-1].Id
+	a.queue.Unlock()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.addHandler(id, handler)
+	if buffered != 0 {
+		a.buffered[id] = buffered
+	}
+	a.unrequested++
+	return a.threshold > 0 && a.unrequested >= a.threshold
+}
+
+// addHandler registers a handler for the stanza with the given sequence number.
+func (a *ackTracker) addHandler(id int, handler AckHandler) {
+	if handler == nil {
+		return
+	}
+	if previous := a.handlers[id]; previous != nil {
+		a.handlers[id] = func(err error) {
+			previous(err)
+			handler(err)
+		}
+		return
+	}
+	a.handlers[id] = handler
+}
+
+// requesting records an ack request, to detect when it is not answered.
+func (a *ackTracker) requesting() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.unrequested = 0
+	a.lastRequest = time.Now()
+	if a.requested.IsZero() {
+		a.requested = a.lastRequest
+	}
+}
+
+// acknowledge removes the stanzas handled by the server from the queue, and calls their handlers.
+func (a *ackTracker) acknowledge(h uint) error {
+	a.queue.Lock()
+	acked, err := a.queue.Acknowledge(h)
+	a.queue.Unlock()
+
+	a.mu.Lock()
+	a.requested = time.Time{}
+	var handlers []AckHandler
+	for _, stz := range acked {
+		delete(a.buffered, stz.Id)
+		if handler := a.handlers[stz.Id]; handler != nil {
+			handlers = append(handlers, handler)
+			delete(a.handlers, stz.Id)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(nil)
+	}
+	return err
+}
+
+// unacked returns the stanzas not acknowledged by the server, to send them again after resuming
+// the session.
+func (a *ackTracker) unacked() []string {
+	a.queue.RLock()
+	defer a.queue.RUnlock()
+	stanzas := make([]string, len(a.queue.Uslice))
+	for i, stz := range a.queue.Uslice {
+		stanzas[i] = stz.Stz
+	}
+	return stanzas
+}
+
+// pendingBuffered returns the sequence numbers in the offline buffer of the unacknowledged stanzas
+// sent from it.
+func (a *ackTracker) pendingBuffered() map[uint64]bool {
+	if a == nil {
+		return nil
+	}
+	a.queue.RLock()
+	defer a.queue.RUnlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pending := make(map[uint64]bool)
+	for _, stz := range a.queue.Uslice {
+		if seq, ok := a.buffered[stz.Id]; ok {
+			pending[seq] = true
+		}
+	}
+	return pending
+}
+
+// fail calls the handlers of the unacknowledged stanzas with the error.
+func (a *ackTracker) fail(err error) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	handlers := a.handlers
+	a.handlers = make(map[int]AckHandler)
+	a.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(err)
+	}
+}
+
+// run requests acks periodically while stanzas are not acknowledged, and calls expired when a
+// request is not answered in time, until quit is closed. A zero interval or timeout disables the
+// corresponding check.
+func (a *ackTracker) run(interval, timeout time.Duration, request func(), expired func(), quit <-chan struct{}) {
+	period := interval
+	if timeout > 0 && (period == 0 || timeout/4 < period) {
+		period = timeout / 4
+	}
+	if period <= 0 {
+		return
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+
+		a.mu.Lock()
+		requested, lastRequest := a.requested, a.lastRequest
+		a.mu.Unlock()
+		if timeout > 0 && !requested.IsZero() && time.Since(requested) > timeout {
+			expired()
+			return
+		}
+
+		a.queue.RLock()
+		empty := len(a.queue.Uslice) == 0
+		a.queue.RUnlock()
+		if interval > 0 && !empty && requested.IsZero() && time.Since(lastRequest) >= interval {
+			request()
+		}
+	}
+}
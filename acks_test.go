@@ -0,0 +1,85 @@
+package xmpp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+func TestAckTracker_Acknowledge(t *testing.T) {
+	acks := newAckTracker(stanza.NewUnAckQueue(), 2)
+	var results []error
+	handler := func(err error) {
+		results = append(results, err)
+	}
+
+	if acks.track([]byte("<message id='1'/>"), handler, 0) {
+		t.Error("ack should not be requested before the threshold")
+	}
+	if !acks.track([]byte("<message id='2'/>"), handler, 0) {
+		t.Error("ack should be requested after the threshold")
+	}
+	acks.requesting()
+	acks.track([]byte("<message id='3'/>"), handler, 0)
+
+	if err := acks.acknowledge(1); err != nil {
+		t.Fatalf("cannot acknowledge stanzas: %s", err)
+	}
+	if len(results) != 1 || results[0] != nil {
+		t.Errorf("first stanza should be acknowledged: %v", results)
+	}
+	if unacked := acks.unacked(); len(unacked) != 2 || unacked[0] != "<message id='2'/>" {
+		t.Errorf("unexpected unacknowledged stanzas: %v", unacked)
+	}
+
+	if err := acks.acknowledge(4); !errors.Is(err, stanza.ErrInvalidHandledCount) {
+		t.Errorf("expected an invalid count error, got %v", err)
+	}
+
+	acks.fail(ErrStanzaNotAcked)
+	if len(results) != 3 || !errors.Is(results[1], ErrStanzaNotAcked) || !errors.Is(results[2], ErrStanzaNotAcked) {
+		t.Errorf("remaining stanzas should fail: %v", results)
+	}
+}
+
+func TestAckTracker_Run(t *testing.T) {
+	acks := newAckTracker(stanza.NewUnAckQueue(), 0)
+	requests := make(chan struct{}, 10)
+	expired := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+
+	go acks.run(10*time.Millisecond, 100*time.Millisecond, func() {
+		acks.requesting()
+		requests <- struct{}{}
+	}, func() {
+		close(expired)
+	}, quit)
+
+	// Acks are only requested while stanzas are not acknowledged
+	select {
+	case <-requests:
+		t.Fatal("ack should not be requested without stanzas")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	acks.track([]byte("<message/>"), nil, 0)
+	select {
+	case <-requests:
+	case <-time.After(time.Second):
+		t.Fatal("ack was not requested")
+	}
+	if err := acks.acknowledge(1); err != nil {
+		t.Fatalf("cannot acknowledge stanzas: %s", err)
+	}
+
+	// An unanswered request expires
+	acks.track([]byte("<message/>"), nil, 0)
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatal("unanswered ack request should expire")
+	}
+}
@@ -1,71 +1,330 @@
 package xmpp
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
+	"time"
 
 	"gosrc.io/xmpp/stanza"
 )
 
 // Credential is used to pass the type of secret that will be used to connect to XMPP server.
-// It can be either a password or an OAuth 2 bearer token.
+// It can be either a password, an OAuth 2 bearer token, a TLS client certificate, or any
+// list of SASL mechanisms provided by the application.
 type Credential struct {
-	secret     string
-	mechanisms []string
+	secret string
+	// secretless is true for credentials that do not rely on a secret, like client certificates
+	// or custom mechanisms.
+	secretless bool
+	// SASL mechanisms, by order of preference
+	mechanisms []credentialMechanism
+	// Authorization identity, if any
+	authzid string
+	// Expiry date of the secret, if known
+	expiry time.Time
 }
 
+// credentialMechanism is a SASL mechanism of a credential. The mechanism is created with the secret
+// of the credential for each authentication attempt, as the copies of a credential may be used
+// concurrently.
+type credentialMechanism struct {
+	name    string
+	factory SASLMechanismFactory
+}
+
+// CredentialProvider returns the credential to use for the next authentication attempt. It is
+// called before each authentication, so that short-lived secrets like OAuth tokens can be
+// refreshed between reconnections. refresh is true when the server rejected the previous
+// credential because it expired: the provider must not return a cached credential then.
+type CredentialProvider func(ctx context.Context, refresh bool) (Credential, error)
+
+// Password returns a credential authenticating with a password. Mechanisms are tried
+// in order of preference: SCRAM variants with channel binding first, then SCRAM variants
+// with the strongest hash first, then PLAIN.
 func Password(pwd string) Credential {
-	credential := Credential{
-		secret:     pwd,
-		mechanisms: []string{"PLAIN"},
+	return credentialFromRegistry(pwd,
+		"SCRAM-SHA-512-PLUS", "SCRAM-SHA-256-PLUS", "SCRAM-SHA-1-PLUS",
+		"SCRAM-SHA-512", "SCRAM-SHA-256", "SCRAM-SHA-1",
+		"PLAIN")
+}
+
+func OAuthToken(token string) Credential {
+	return credentialFromRegistry(token, "X-OAUTH2")
+}
+
+// ClientCertificate returns a credential authenticating with the TLS client certificate
+// set in TransportConfiguration.TLSConfig, using SASL EXTERNAL.
+// The server derives the identity from the certificate.
+func ClientCertificate() Credential {
+	return ClientCertificateAs("")
+}
+
+// ClientCertificateAs returns a credential authenticating with the TLS client certificate
+// set in TransportConfiguration.TLSConfig, using SASL EXTERNAL, and requesting to act as
+// the authorization identity authzid.
+func ClientCertificateAs(authzid string) Credential {
+	credential := credentialFromRegistry("", "EXTERNAL")
+	credential.secretless = true
+	credential.authzid = authzid
+	return credential
+}
+
+// NewCredential returns a credential using the provided SASL mechanisms, by order of
+// preference. It can be used to plug mechanisms implemented by the application:
+//
+//	credential := xmpp.NewCredential(myTokenMechanism, xmpp.NewSASLMechanism("PLAIN", password))
+//
+// Mechanisms are responsible for holding their own secret. They are reused for each authentication
+// attempt: a credential using them must not be shared by clients connecting concurrently.
+func NewCredential(mechanisms ...SASLMechanism) Credential {
+	credential := Credential{secretless: true}
+	for _, mech := range mechanisms {
+		credential.mechanisms = append(credential.mechanisms, credentialMechanism{
+			name:    mech.Name(),
+			factory: func(string) SASLMechanism { return mech },
+		})
 	}
 	return credential
 }
 
-func OAuthToken(token string) Credential {
-	credential := Credential{
-		secret:     token,
-		mechanisms: []string{"X-OAUTH2"},
+// WithAuthzid returns a copy of the credential requesting to act as the authorization
+// identity authzid, for mechanisms supporting it.
+func (c Credential) WithAuthzid(authzid string) Credential {
+	c.authzid = authzid
+	return c
+}
+
+// WithExpiry returns a copy of the credential, with the expiry date of its secret. When the server
+// rejects an expired credential as not authorized, the client refreshes it from the
+// CredentialProvider and authenticates again.
+func (c Credential) WithExpiry(expiry time.Time) Credential {
+	c.expiry = expiry
+	return c
+}
+
+// withSecret returns a copy of the credential with another secret, keeping its mechanisms,
+// authorization identity and expiry.
+func (c Credential) withSecret(secret string) Credential {
+	c.secret = secret
+	return c
+}
+
+// credentialFromRegistry builds a credential from registered mechanism names.
+func credentialFromRegistry(secret string, names ...string) Credential {
+	credential := Credential{secret: secret}
+	for _, name := range names {
+		if factory := saslMechanismFactory(name); factory != nil {
+			credential.mechanisms = append(credential.mechanisms, credentialMechanism{name: name, factory: factory})
+		}
 	}
 	return credential
 }
 
+// validate checks that the credential can be used to authenticate.
+func (c Credential) validate(tlsConfig *tls.Config) error {
+	if len(c.mechanisms) == 0 || (c.secret == "" && !c.secretless) {
+		return errors.New("missing credential")
+	}
+	if c.isExternal() {
+		if tlsConfig == nil || (len(tlsConfig.Certificates) == 0 && tlsConfig.GetClientCertificate == nil) {
+			return errors.New("missing client certificate in TLS configuration")
+		}
+	}
+	return nil
+}
+
+// isPassword returns true if the credential was created with Password.
+func (c Credential) isPassword() bool {
+	return c.secret != "" && isSupportedMech("PLAIN", c.mechanismNames())
+}
+
+// isExternal returns true if the credential relies on authentication outside of SASL,
+// and thus does not need a secret.
+func (c Credential) isExternal() bool {
+	return len(c.mechanisms) == 1 && c.mechanisms[0].name == "EXTERNAL"
+}
+
+// rejectedAsExpired returns true if the server rejected the credential because it expired.
+func (c Credential) rejectedAsExpired(err error) bool {
+	var failure saslFailure
+	if !errors.As(err, &failure) {
+		return false
+	}
+	switch failure.condition {
+	case "credentials-expired":
+		return true
+	case "not-authorized":
+		return !c.expiry.IsZero() && time.Now().After(c.expiry)
+	}
+	return false
+}
+
+// mechanismNames returns the names of the credential mechanisms.
+func (c Credential) mechanismNames() []string {
+	var names []string
+	for _, mech := range c.mechanisms {
+		names = append(names, mech.name)
+	}
+	return names
+}
+
+// ============================================================================
+// SASL mechanisms
+
+// SASLMechanism is implemented by SASL mechanisms. The session negotiation drives the
+// exchange: it sends the initial response returned by Start, passes each server challenge
+// to Next, and finally calls Verify with the additional data sent with success.
+// The registered mechanisms are created for each authentication attempt, while the mechanisms
+// passed to NewCredential are reused.
+type SASLMechanism interface {
+	// Name returns the mechanism name, as advertised by the server, i.e "SCRAM-SHA-256".
+	Name() string
+	// Start is called at the beginning of each authentication attempt and returns the
+	// initial response. It must reset any state from a previous attempt. A nil initial
+	// response means that no initial response is sent.
+	Start(session *SASLSession) ([]byte, error)
+	// Next returns the response to a server challenge.
+	Next(challenge []byte) ([]byte, error)
+	// Verify checks the additional data sent by the server with success. It is empty if
+	// the server did not send any.
+	Verify(successData []byte) error
+}
+
+// SASLSession holds information about the stream, passed to a SASL mechanism when
+// starting an authentication exchange.
+type SASLSession struct {
+	// Username is the authentication identity, usually the local part of the JID
+	Username string
+	// Authzid is the authorization identity, if any
+	Authzid string
+	// Mechanisms are the mechanisms advertised by the server
+	Mechanisms []string
+	// ChannelBindingTypes are the channel binding types advertised by the server (XEP-0440)
+	ChannelBindingTypes []string
+	// ChannelBindingType is the channel binding type supported by both the transport and
+	// the server. It is empty if channel binding is not available.
+	ChannelBindingType string
+	// ChannelBinding is the channel binding data for ChannelBindingType. It is only set
+	// for mechanisms using channel binding (-PLUS suffix).
+	ChannelBinding []byte
+}
+
+// SASLMechanismFactory creates a mechanism for the given secret.
+type SASLMechanismFactory func(secret string) SASLMechanism
+
+var saslRegistry = struct {
+	sync.RWMutex
+	factories map[string]SASLMechanismFactory
+}{factories: make(map[string]SASLMechanismFactory)}
+
+// RegisterSASLMechanism registers a SASL mechanism factory, so that the mechanism can be
+// created by name with NewSASLMechanism. Registering an existing name replaces the
+// previous factory, including the built-in ones.
+func RegisterSASLMechanism(name string, factory SASLMechanismFactory) {
+	saslRegistry.Lock()
+	saslRegistry.factories[name] = factory
+	saslRegistry.Unlock()
+}
+
+// NewSASLMechanism creates a registered SASL mechanism for the given secret.
+// It returns nil if no mechanism is registered under that name.
+func NewSASLMechanism(name string, secret string) SASLMechanism {
+	factory := saslMechanismFactory(name)
+	if factory == nil {
+		return nil
+	}
+	return factory(secret)
+}
+
+// saslMechanismFactory returns the factory registered under name, nil if there is none.
+func saslMechanismFactory(name string) SASLMechanismFactory {
+	saslRegistry.RLock()
+	defer saslRegistry.RUnlock()
+	return saslRegistry.factories[name]
+}
+
+func init() {
+	RegisterSASLMechanism("PLAIN", func(secret string) SASLMechanism { return &plainMechanism{name: "PLAIN", secret: secret} })
+	RegisterSASLMechanism("X-OAUTH2", func(secret string) SASLMechanism { return &plainMechanism{name: "X-OAUTH2", secret: secret} })
+	RegisterSASLMechanism("EXTERNAL", func(string) SASLMechanism { return externalMechanism{} })
+	RegisterSASLMechanism("ANONYMOUS", func(string) SASLMechanism { return anonymousMechanism{} })
+	RegisterSASLMechanism("OAUTHBEARER", func(secret string) SASLMechanism { return &oauthBearerMechanism{token: secret} })
+	for name := range scramHashes {
+		for _, mechName := range []string{name, name + "-PLUS"} {
+			RegisterSASLMechanism(mechName, func(secret string) SASLMechanism { return newScramMechanism(mechName, secret) })
+		}
+	}
+}
+
 // ============================================================================
 // Authentication flow for SASL mechanisms
 
 func authSASL(socket io.ReadWriter, decoder *xml.Decoder, f stanza.StreamFeatures, user string, credential Credential) (err error) {
-	var matchingMech string
+	mech, session, err := selectSASLMechanism(socket, f, f.Mechanisms.Mechanism, user, credential)
+	if err != nil {
+		return err
+	}
+	return saslExchange(socket, decoder, mech, session)
+}
+
+// selectSASLMechanism picks the preferred credential mechanism among the mechanisms offered
+// by the server, and prepares the SASL session for it.
+func selectSASLMechanism(socket io.ReadWriter, f stanza.StreamFeatures, mechanisms []string, user string, credential Credential) (SASLMechanism, *SASLSession, error) {
+	// Channel binding type to use for -PLUS mechanisms, if the transport supports it.
+	binder, _ := socket.(ChannelBinder)
+	cbType := selectChannelBinding(binder, f)
+
+	var matchingMech SASLMechanism
 	for _, mech := range credential.mechanisms {
-		if isSupportedMech(mech, f.Mechanisms.Mechanism) {
-			matchingMech = mech
+		if isPlusMech(mech.name) && cbType == "" {
+			continue
+		}
+		if isSupportedMech(mech.name, mechanisms) {
+			matchingMech = mech.factory(credential.secret)
 			break
 		}
 	}
 
-	switch matchingMech {
-	case "PLAIN", "X-OAUTH2":
-		// TODO: Implement other type of SASL mechanisms
-		return authPlain(socket, decoder, matchingMech, user, credential.secret)
-	default:
-		err := fmt.Errorf("no matching authentication (%v) supported by server: %v", credential.mechanisms, f.Mechanisms.Mechanism)
-		return NewConnError(err, true)
+	if matchingMech == nil {
+		err := fmt.Errorf("no matching authentication (%v) supported by server: %v", credential.mechanismNames(), mechanisms)
+		return nil, nil, NewConnError(err, true)
 	}
-}
 
-// Plain authentication: send base64-encoded \x00 user \x00 password
-func authPlain(socket io.ReadWriter, decoder *xml.Decoder, mech string, user string, secret string) error {
-	raw := "\x00" + user + "\x00" + secret
-	enc := make([]byte, base64.StdEncoding.EncodedLen(len(raw)))
-	base64.StdEncoding.Encode(enc, []byte(raw))
+	// If the server advertises channel binding support (XEP-0440) but no -PLUS mechanism,
+	// the mechanism list has likely been tampered with: fail closed.
+	if cbType != "" && len(f.ChannelBindingTypes()) > 0 && !isPlusMech(matchingMech.Name()) &&
+		hasPlusMech(credential.mechanismNames()) && !hasPlusMech(mechanisms) {
+		err := errors.New("server supports channel binding but does not offer -PLUS mechanisms: possible downgrade attack")
+		return nil, nil, NewConnError(err, true)
+	}
 
-	a := stanza.SASLAuth{
-		Mechanism: mech,
-		Value:     string(enc),
+	session := &SASLSession{
+		Username:            user,
+		Authzid:             credential.authzid,
+		Mechanisms:          mechanisms,
+		ChannelBindingTypes: f.ChannelBindingTypes(),
+		ChannelBindingType:  cbType,
+	}
+	if isPlusMech(matchingMech.Name()) {
+		data, err := binder.ChannelBinding(cbType)
+		if err != nil {
+			return nil, nil, NewConnError(err, true)
+		}
+		session.ChannelBinding = data
 	}
-	data, err := xml.Marshal(a)
+	return matchingMech, session, nil
+}
+
+// sendSASLNonza marshals and writes a SASL nonza to the socket.
+func sendSASLNonza(socket io.Writer, nonza interface{}) error {
+	data, err := xml.Marshal(nonza)
 	if err != nil {
 		return err
 	}
@@ -75,23 +334,82 @@ func authPlain(socket io.ReadWriter, decoder *xml.Decoder, mech string, user str
 	} else if n == 0 {
 		return errors.New("failed to write authSASL nonza to socket : wrote 0 bytes")
 	}
+	return nil
+}
 
-	// Next message should be either success or failure.
-	val, err := stanza.NextPacket(decoder)
-	if err != nil {
-		return err
+// saslFailure is the error returned when the server rejects the authentication.
+type saslFailure struct {
+	condition string
+	text      string
+}
+
+func (f saslFailure) Error() string {
+	if f.text != "" {
+		return "auth failure: " + f.condition + " (" + f.text + ")"
+	}
+	return "auth failure: " + f.condition
+}
+
+// saslFailureError converts a SASL failure to a permanent connection error.
+func saslFailureError(f stanza.SASLFailure) error {
+	// f.Any is type of sub-element in failure, which gives a description of what failed.
+	return NewConnError(saslFailure{condition: f.Any.Local, text: f.Text}, true)
+}
+
+// saslEncode encodes SASL data for transport in XMPP. Empty data is sent as "=".
+// Reference: RFC 6120 section 6.4.2
+func saslEncode(data []byte) string {
+	if len(data) == 0 {
+		return "="
 	}
+	return base64.StdEncoding.EncodeToString(data)
+}
 
-	switch v := val.(type) {
-	case stanza.SASLSuccess:
-	case stanza.SASLFailure:
-		// v.Any is type of sub-element in failure, which gives a description of what failed.
-		err := errors.New("auth failure: " + v.Any.Local)
-		return NewConnError(err, true)
-	default:
-		return errors.New("expected SASL success or failure, got " + v.Name())
+// saslDecode decodes SASL data received from the server.
+func saslDecode(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if value == "=" {
+		return []byte{}, nil
 	}
-	return err
+	return base64.StdEncoding.DecodeString(value)
+}
+
+// selectChannelBinding returns the preferred channel binding type supported by both the
+// transport and the server. When the server does not advertise its channel binding types,
+// the transport preferred type is used.
+func selectChannelBinding(binder ChannelBinder, f stanza.StreamFeatures) string {
+	if binder == nil {
+		return ""
+	}
+	types := binder.ChannelBindingTypes()
+	if len(types) == 0 {
+		return ""
+	}
+	serverTypes := f.ChannelBindingTypes()
+	if len(serverTypes) == 0 {
+		return types[0]
+	}
+	for _, cbType := range types {
+		if isSupportedMech(cbType, serverTypes) {
+			return cbType
+		}
+	}
+	return ""
+}
+
+// isPlusMech returns true if the mechanism uses channel binding.
+func isPlusMech(mech string) bool {
+	return strings.HasSuffix(mech, "-PLUS")
+}
+
+// hasPlusMech returns true if the list contains at least one mechanism using channel binding.
+func hasPlusMech(mechanisms []string) bool {
+	for _, m := range mechanisms {
+		if isPlusMech(m) {
+			return true
+		}
+	}
+	return false
 }
 
 // isSupportedMech returns true if the mechanism is supported in the provided list.
@@ -103,3 +421,99 @@ func isSupportedMech(mech string, mechanisms []string) bool {
 	}
 	return false
 }
+
+// ============================================================================
+// Built-in simple mechanisms
+
+// plainMechanism implements PLAIN authentication: \x00 user \x00 password.
+// It is also used for X-OAUTH2, which uses the same format with a token as password.
+// Reference: RFC 4616
+type plainMechanism struct {
+	name   string
+	secret string
+}
+
+func (m *plainMechanism) Name() string {
+	return m.name
+}
+
+func (m *plainMechanism) Start(s *SASLSession) ([]byte, error) {
+	return []byte(s.Authzid + "\x00" + s.Username + "\x00" + m.secret), nil
+}
+
+func (m *plainMechanism) Next([]byte) ([]byte, error) {
+	return nil, errors.New(m.name + ": unexpected challenge")
+}
+
+func (m *plainMechanism) Verify([]byte) error {
+	return nil
+}
+
+// externalMechanism implements EXTERNAL authentication: credentials are provided by the TLS
+// layer. The initial response is the optional authorization identity.
+// Reference: RFC 4422 Appendix A
+type externalMechanism struct{}
+
+func (externalMechanism) Name() string {
+	return "EXTERNAL"
+}
+
+func (externalMechanism) Start(s *SASLSession) ([]byte, error) {
+	return []byte(s.Authzid), nil
+}
+
+func (externalMechanism) Next([]byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (externalMechanism) Verify([]byte) error {
+	return nil
+}
+
+// anonymousMechanism implements ANONYMOUS authentication.
+// Reference: RFC 4505
+type anonymousMechanism struct{}
+
+func (anonymousMechanism) Name() string {
+	return "ANONYMOUS"
+}
+
+func (anonymousMechanism) Start(*SASLSession) ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (anonymousMechanism) Next([]byte) ([]byte, error) {
+	return nil, errors.New("ANONYMOUS: unexpected challenge")
+}
+
+func (anonymousMechanism) Verify([]byte) error {
+	return nil
+}
+
+// oauthBearerMechanism implements OAUTHBEARER authentication.
+// Reference: RFC 7628
+type oauthBearerMechanism struct {
+	token string
+}
+
+func (m *oauthBearerMechanism) Name() string {
+	return "OAUTHBEARER"
+}
+
+func (m *oauthBearerMechanism) Start(s *SASLSession) ([]byte, error) {
+	gs2Header := "n,,"
+	if s.Authzid != "" {
+		gs2Header = "n,a=" + scramEscape(s.Authzid) + ","
+	}
+	return []byte(gs2Header + "\x01auth=Bearer " + m.token + "\x01\x01"), nil
+}
+
+// Next answers the error challenge sent by the server when the token is rejected. The
+// exchange must be completed with a dummy response, before the server sends the failure.
+func (m *oauthBearerMechanism) Next([]byte) ([]byte, error) {
+	return []byte("\x01"), nil
+}
+
+func (m *oauthBearerMechanism) Verify([]byte) error {
+	return nil
+}
@@ -0,0 +1,179 @@
+package xmpp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"hash"
+	"strings"
+	"time"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+// ============================================================================
+// Fast Authentication Streamlining Tokens (FAST)
+// Reference: XEP-0484 - https://xmpp.org/extensions/xep-0484.html
+// Token mechanisms: draft-schmaus-kitten-sasl-ht
+
+// FastToken is a token issued by the server, that can be used to authenticate instead of
+// the password on the next connections.
+type FastToken struct {
+	// Mechanism is the HT-* SASL mechanism the token must be used with
+	Mechanism string
+	Token     string
+	Expiry    time.Time
+	// Count is the number of times the token has been used. It is incremented before each use.
+	Count uint
+}
+
+// Expired returns true if the token expiry date has passed.
+func (t FastToken) Expired() bool {
+	return !t.Expiry.IsZero() && time.Now().After(t.Expiry)
+}
+
+// TokenStore persists FAST tokens between connections. It is provided by the application,
+// to store tokens in a safe place. Tokens are stored per bare JID.
+type TokenStore interface {
+	// LoadToken returns the token for the JID, or nil if there is none.
+	LoadToken(jid string) (*FastToken, error)
+	// StoreToken saves a new or rotated token for the JID, replacing the previous one.
+	StoreToken(jid string, token FastToken) error
+	// DeleteToken removes the token for the JID, when it has been rejected by the server.
+	DeleteToken(jid string) error
+}
+
+// TokenEventType is the kind of change that happened to a FAST token.
+type TokenEventType uint8
+
+const (
+	// TokenStored is sent when the server issued a new token, or rotated the current one.
+	TokenStored TokenEventType = iota
+	// TokenInvalidated is sent when the server rejected the stored token.
+	TokenInvalidated
+)
+
+// TokenEvent describes a change of the FAST token, reported in the Token field of Event.
+type TokenEvent struct {
+	Type  TokenEventType
+	Token FastToken
+	// Err is set when the token could not be updated in the store.
+	Err error
+}
+
+// fastMechanisms lists the supported token mechanisms, by order of preference, with the
+// channel binding type they require.
+var fastMechanisms = []struct {
+	name   string
+	cbType string
+}{
+	{"HT-SHA-256-EXPR", "tls-exporter"},
+	{"HT-SHA-256-ENDP", "tls-server-end-point"},
+	{"HT-SHA-256-NONE", ""},
+}
+
+// htMechanism implements the HT-* SASL mechanisms, authenticating with a FAST token.
+type htMechanism struct {
+	name   string
+	hash   func() hash.Hash
+	cbType string
+	token  string
+
+	// Per attempt state, reset by Start
+	responder []byte
+}
+
+// newHTMechanism returns a token mechanism for a name like HT-SHA-256-NONE. It returns nil
+// for unsupported names.
+func newHTMechanism(name, token string) *htMechanism {
+	m := &htMechanism{name: name, token: token}
+	parts := strings.SplitN(strings.TrimPrefix(name, "HT-"), "-", 3)
+	if !strings.HasPrefix(name, "HT-") || len(parts) != 3 || parts[0] != "SHA" {
+		return nil
+	}
+	switch parts[1] {
+	case "256":
+		m.hash = sha256.New
+	case "512":
+		m.hash = sha512.New
+	default:
+		return nil
+	}
+	switch parts[2] {
+	case "NONE":
+	case "ENDP":
+		m.cbType = "tls-server-end-point"
+	case "EXPR":
+		m.cbType = "tls-exporter"
+	default:
+		return nil
+	}
+	return m
+}
+
+func (m *htMechanism) Name() string {
+	return m.name
+}
+
+// Start returns the authentication identity and the initiator hashed token.
+func (m *htMechanism) Start(s *SASLSession) ([]byte, error) {
+	var cbData []byte
+	if m.cbType != "" {
+		if s.ChannelBindingType != m.cbType || s.ChannelBinding == nil {
+			return nil, errors.New(m.name + ": channel binding data is not available")
+		}
+		cbData = s.ChannelBinding
+	}
+	m.responder = m.hmac("Responder", cbData)
+	initiator := m.hmac("Initiator", cbData)
+	return append([]byte(s.Username+"\x00"), initiator...), nil
+}
+
+func (m *htMechanism) Next([]byte) ([]byte, error) {
+	return nil, errors.New(m.name + ": unexpected challenge")
+}
+
+// Verify checks the responder hashed token sent by the server with success.
+func (m *htMechanism) Verify(successData []byte) error {
+	if subtle.ConstantTimeCompare(successData, m.responder) != 1 {
+		return errors.New(m.name + ": server hashed token mismatch")
+	}
+	return nil
+}
+
+func (m *htMechanism) hmac(label string, cbData []byte) []byte {
+	mac := hmac.New(m.hash, []byte(m.token))
+	mac.Write([]byte(label))
+	mac.Write(cbData)
+	return mac.Sum(nil)
+}
+
+// selectFastMechanism returns the preferred token mechanism supported by the server and by
+// the transport channel binding, with the channel binding type it requires.
+func selectFastMechanism(binder ChannelBinder, serverMechanisms []string) (string, string) {
+	var cbTypes []string
+	if binder != nil {
+		cbTypes = binder.ChannelBindingTypes()
+	}
+	for _, m := range fastMechanisms {
+		if !isSupportedMech(m.name, serverMechanisms) {
+			continue
+		}
+		if m.cbType != "" && !isSupportedMech(m.cbType, cbTypes) {
+			continue
+		}
+		return m.name, m.cbType
+	}
+	return "", ""
+}
+
+// fastToken converts a token issued by the server, to be stored for the next connections.
+func fastToken(mechanism string, t stanza.FastToken) FastToken {
+	token := FastToken{Mechanism: mechanism, Token: t.Token}
+	if expiry, err := time.Parse(time.RFC3339, t.Expiry); err == nil {
+		token.Expiry = expiry
+	}
+	return token
+}
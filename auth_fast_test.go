@@ -0,0 +1,286 @@
+package xmpp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+const testFastToken = "WXZzciBwYmFmZXJ1IHl1IGZ0cmFnIGdlbmMgYmFmZiBjeWJqIHBvbmNlIG5yIGNiYmJ3"
+
+func htHash(token, label string, cbData []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(label))
+	mac.Write(cbData)
+	return mac.Sum(nil)
+}
+
+func TestHTMechanism(t *testing.T) {
+	for _, name := range []string{"HT-SHA-256-NONE", "HT-SHA-256-ENDP", "HT-SHA-256-EXPR", "HT-SHA-512-NONE"} {
+		if newHTMechanism(name, testFastToken) == nil {
+			t.Errorf("%s should be supported", name)
+		}
+	}
+	for _, name := range []string{"HT-SHA-1-NONE", "HT-SHA-256-UNIQ", "SCRAM-SHA-256", "HT-SHA-256"} {
+		if newHTMechanism(name, testFastToken) != nil {
+			t.Errorf("%s should not be supported", name)
+		}
+	}
+
+	cbData := []byte("channel binding data")
+	mech := newHTMechanism("HT-SHA-256-EXPR", testFastToken)
+	if _, err := mech.Start(&SASLSession{Username: "user"}); err == nil {
+		t.Error("HT-SHA-256-EXPR should require channel binding data")
+	}
+	initial, err := mech.Start(&SASLSession{Username: "user", ChannelBindingType: "tls-exporter", ChannelBinding: cbData})
+	if err != nil {
+		t.Fatalf("cannot start HT mechanism: %s", err)
+	}
+	if expected := append([]byte("user\x00"), htHash(testFastToken, "Initiator", cbData)...); string(initial) != string(expected) {
+		t.Errorf("unexpected initial response: %x", initial)
+	}
+	if err = mech.Verify(htHash(testFastToken, "Initiator", cbData)); err == nil {
+		t.Error("initiator hashed token should not be accepted as server response")
+	}
+	if err = mech.Verify(htHash(testFastToken, "Responder", cbData)); err != nil {
+		t.Errorf("cannot verify server response: %s", err)
+	}
+}
+
+func TestSelectFastMechanism(t *testing.T) {
+	server := []string{"HT-SHA-256-NONE", "HT-SHA-256-ENDP", "HT-SHA-256-EXPR"}
+	if mech, _ := selectFastMechanism(nil, server); mech != "HT-SHA-256-NONE" {
+		t.Errorf("without channel binding, expected HT-SHA-256-NONE, got %q", mech)
+	}
+	binder := bindingConn{types: []string{"tls-server-end-point"}}
+	if mech, cbType := selectFastMechanism(binder, server); mech != "HT-SHA-256-ENDP" || cbType != "tls-server-end-point" {
+		t.Errorf("expected HT-SHA-256-ENDP, got %q (%q)", mech, cbType)
+	}
+	if mech, _ := selectFastMechanism(binder, []string{"HT-SHA-512-UNIQ"}); mech != "" {
+		t.Errorf("expected no mechanism, got %q", mech)
+	}
+}
+
+// testTokenStore keeps FAST tokens in memory.
+type testTokenStore struct {
+	sync.Mutex
+	tokens map[string]FastToken
+}
+
+func (s *testTokenStore) LoadToken(jid string) (*FastToken, error) {
+	s.Lock()
+	defer s.Unlock()
+	if token, ok := s.tokens[jid]; ok {
+		return &token, nil
+	}
+	return nil, nil
+}
+
+func (s *testTokenStore) StoreToken(jid string, token FastToken) error {
+	s.Lock()
+	defer s.Unlock()
+	s.tokens[jid] = token
+	return nil
+}
+
+func (s *testTokenStore) DeleteToken(jid string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.tokens, jid)
+	return nil
+}
+
+// fastAuthenticate decodes the FAST elements sent inline in SASL2 authenticate.
+type fastAuthenticate struct {
+	XMLName         xml.Name                 `xml:"urn:xmpp:sasl:2 authenticate"`
+	Mechanism       string                   `xml:"mechanism,attr"`
+	InitialResponse string                   `xml:"initial-response"`
+	RequestToken    *stanza.FastRequestToken `xml:"urn:xmpp:fast:0 request-token"`
+	Fast            *stanza.FastAuth         `xml:"urn:xmpp:fast:0 fast"`
+}
+
+func readFastAuthenticate(t *testing.T, sc *ServerConn) fastAuthenticate {
+	var auth fastAuthenticate
+	se, err := stanza.NextStart(sc.decoder)
+	if err != nil {
+		t.Errorf("cannot read SASL2 authenticate: %s", err)
+		return auth
+	}
+	if err = sc.decoder.DecodeElement(&auth, &se); err != nil {
+		t.Errorf("cannot decode SASL2 authenticate: %s", err)
+	}
+	return auth
+}
+
+func sendFastFeatures(t *testing.T, sc *ServerConn) {
+	features := `<stream:features>
+  <authentication xmlns='urn:xmpp:sasl:2'>
+    <mechanism>PLAIN</mechanism>
+    <inline>
+      <bind xmlns='urn:xmpp:bind:0'/>
+      <fast xmlns='urn:xmpp:fast:0'><mechanism>HT-SHA-256-NONE</mechanism></fast>
+    </inline>
+  </authentication>
+</stream:features>`
+	if _, err := fmt.Fprintln(sc.connection, features); err != nil {
+		t.Errorf("cannot send stream feature: %s", err)
+	}
+}
+
+func sendFastSuccess(t *testing.T, sc *ServerConn, additionalData []byte, token string) {
+	success := "<success xmlns='urn:xmpp:sasl:2'>"
+	if additionalData != nil {
+		success += "<additional-data>" + base64.StdEncoding.EncodeToString(additionalData) + "</additional-data>"
+	}
+	success += "<authorization-identifier>test@localhost/tag.1</authorization-identifier>"
+	if token != "" {
+		success += "<token xmlns='urn:xmpp:fast:0' expiry='2100-01-01T00:00:00Z' token='" + token + "'/>"
+	}
+	success += "<bound xmlns='urn:xmpp:bind:0'/></success><stream:features/>"
+	if _, err := fmt.Fprint(sc.connection, success); err != nil {
+		t.Errorf("cannot send success: %s", err)
+	}
+}
+
+// openFastSession opens a session with the mock server, using the token store. It returns the
+// token events of the client.
+func openFastSession(t *testing.T, handler func(*testing.T, *ServerConn), store TokenStore) (*Client, []*TokenEvent) {
+	serverDone := make(chan struct{})
+	clientDone := make(chan struct{})
+	client, mock := initSrvCliForResumeTests(t, func(t *testing.T, sc *ServerConn) {
+		handler(t, sc)
+		serverDone <- struct{}{}
+	}, testClientFast, false, false)
+	client.config.TokenStore = store
+	client.config.UserAgent = &stanza.SASL2UserAgent{Id: "d4565fa7-4d72-4749-b3d3-740edbf87770"}
+	events := client.Subscribe(16)
+	defer events.Close()
+
+	go func() {
+		var err error
+		if client.Session, err = NewSession(client, SMState{}); err != nil {
+			t.Errorf("failed to open XMPP session: %s", err)
+		}
+		clientDone <- struct{}{}
+	}()
+	waitForEntity(t, clientDone)
+	waitForEntity(t, serverDone)
+	mock.Stop()
+	var tokens []*TokenEvent
+	for len(events.C) > 0 {
+		if e := <-events.C; e.Token != nil {
+			if e.State.getState() != e.Previous {
+				t.Errorf("token event should not change the connection state: %+v", e)
+			}
+			tokens = append(tokens, e.Token)
+		}
+	}
+	return client, tokens
+}
+
+// Client authenticates with its password and requests a token, which is stored.
+func TestFastRequestToken(t *testing.T) {
+	store := &testTokenStore{tokens: make(map[string]FastToken)}
+	_, tokens := openFastSession(t, func(t *testing.T, sc *ServerConn) {
+		checkClientOpenStream(t, sc)
+		sendFastFeatures(t, sc)
+		auth := readFastAuthenticate(t, sc)
+		if auth.Mechanism != "PLAIN" {
+			t.Errorf("expected PLAIN authentication, got %s", auth.Mechanism)
+		}
+		if auth.RequestToken == nil || auth.RequestToken.Mechanism != "HT-SHA-256-NONE" {
+			t.Errorf("client should request a token: %+v", auth.RequestToken)
+		}
+		sendFastSuccess(t, sc, nil, testFastToken)
+	}, store)
+
+	token, _ := store.LoadToken("test@localhost")
+	if token == nil || token.Token != testFastToken || token.Mechanism != "HT-SHA-256-NONE" {
+		t.Fatalf("token should be stored: %+v", token)
+	}
+	if token.Expiry.Year() != 2100 {
+		t.Errorf("unexpected token expiry: %s", token.Expiry)
+	}
+	if len(tokens) != 1 || tokens[0].Type != TokenStored {
+		t.Errorf("client should be notified of the stored token: %+v", tokens)
+	}
+}
+
+// Client authenticates with its stored token, which is rotated by the server.
+func TestFastTokenAuthentication(t *testing.T) {
+	store := &testTokenStore{tokens: map[string]FastToken{
+		"test@localhost": {Mechanism: "HT-SHA-256-NONE", Token: testFastToken, Count: 4},
+	}}
+	client, _ := openFastSession(t, func(t *testing.T, sc *ServerConn) {
+		checkClientOpenStream(t, sc)
+		sendFastFeatures(t, sc)
+		auth := readFastAuthenticate(t, sc)
+		if auth.Mechanism != "HT-SHA-256-NONE" {
+			t.Errorf("expected token authentication, got %s", auth.Mechanism)
+		}
+		initial, _ := base64.StdEncoding.DecodeString(auth.InitialResponse)
+		if expected := append([]byte("test\x00"), htHash(testFastToken, "Initiator", nil)...); string(initial) != string(expected) {
+			t.Errorf("unexpected initial response: %q", initial)
+		}
+		if auth.Fast == nil || auth.Fast.Count != 5 {
+			t.Errorf("client should send the token use count: %+v", auth.Fast)
+		}
+		sendFastSuccess(t, sc, htHash(testFastToken, "Responder", nil), "rotated-token")
+	}, store)
+
+	if client.Session == nil || client.Session.Path != PathSASL2Bind2 {
+		t.Fatalf("session should be bound with SASL2")
+	}
+	token, _ := store.LoadToken("test@localhost")
+	if token == nil || token.Token != "rotated-token" {
+		t.Errorf("rotated token should be stored: %+v", token)
+	}
+}
+
+// Server rejects the stored token: client forgets it, and authenticates with its password.
+func TestFastTokenRejected(t *testing.T) {
+	store := &testTokenStore{tokens: map[string]FastToken{
+		"test@localhost": {Mechanism: "HT-SHA-256-NONE", Token: testFastToken, Expiry: time.Now().Add(time.Hour)},
+	}}
+	client, tokens := openFastSession(t, func(t *testing.T, sc *ServerConn) {
+		checkClientOpenStream(t, sc)
+		sendFastFeatures(t, sc)
+		if auth := readFastAuthenticate(t, sc); auth.Mechanism != "HT-SHA-256-NONE" {
+			t.Errorf("expected token authentication, got %s", auth.Mechanism)
+		}
+		fmt.Fprint(sc.connection, "<failure xmlns='urn:xmpp:sasl:2'><credentials-expired xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/></failure>")
+		if auth := readFastAuthenticate(t, sc); auth.Mechanism != "PLAIN" || auth.RequestToken == nil {
+			t.Errorf("expected password authentication with token request, got %+v", auth)
+		}
+		sendFastSuccess(t, sc, nil, "new-token")
+	}, store)
+
+	if client.Session == nil || client.Session.Path != PathSASL2Bind2 {
+		t.Fatalf("session should be bound with SASL2")
+	}
+	if token, _ := store.LoadToken("test@localhost"); token == nil || token.Token != "new-token" {
+		t.Errorf("new token should be stored: %+v", token)
+	}
+	if len(tokens) != 2 || tokens[0].Type != TokenInvalidated || tokens[1].Type != TokenStored {
+		t.Errorf("client should be notified of the rejected and stored tokens: %+v", tokens)
+	}
+}
+
+func TestClient_TokenStoreRequiresUserAgent(t *testing.T) {
+	config := Config{
+		TransportConfiguration: TransportConfiguration{Address: testXMPPAddress},
+		Jid:                    "test@localhost",
+		Credential:             Password("test"),
+		TokenStore:             &testTokenStore{},
+	}
+	if _, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler); err == nil {
+		t.Error("token store without user agent id should be rejected")
+	}
+}
@@ -0,0 +1,256 @@
+package xmpp
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// SCRAM SASL mechanisms
+// Reference: RFC 5802 (SCRAM-SHA-1), RFC 7677 (SCRAM-SHA-256) and
+// draft-melnikov-scram-sha-512 (SCRAM-SHA-512)
+// Channel binding (-PLUS variants): RFC 5929 (tls-server-end-point), RFC 9266 (tls-exporter)
+
+const scramNonceSize = 24
+
+// scramHashes maps the supported SCRAM mechanism names to their hash function.
+var scramHashes = map[string]func() hash.Hash{
+	"SCRAM-SHA-1":   sha1.New,
+	"SCRAM-SHA-256": sha256.New,
+	"SCRAM-SHA-512": sha512.New,
+}
+
+// scramMechanism implements the SCRAM SASL mechanisms, with or without channel binding.
+// It holds the state of the exchange for the current authentication attempt.
+type scramMechanism struct {
+	name     string
+	hash     func() hash.Hash
+	password string
+
+	// Per attempt state, reset by Start
+	user string
+	// nonce is the client nonce
+	nonce string
+	// gs2Header is the GS2 header sent in the client-first-message. It is "n,," when
+	// no channel binding is used, "y,," when the client supports channel binding but
+	// the server did not offer it, and "p=<type>,," for -PLUS mechanisms.
+	gs2Header string
+	// cbData is the channel binding data for -PLUS mechanisms
+	cbData []byte
+	// downgradeProtection is the mechanism and channel binding list, as received in the
+	// stream features, used to check the server hash (XEP-0474).
+	downgradeProtection string
+
+	clientFirstBare string
+	serverSignature []byte
+	verified        bool
+}
+
+// newScramMechanism returns a SCRAM mechanism for one of the names in scramHashes,
+// optionally with the -PLUS suffix. It returns nil for unknown names.
+func newScramMechanism(name, password string) *scramMechanism {
+	h, ok := scramHashes[strings.TrimSuffix(name, "-PLUS")]
+	if !ok {
+		return nil
+	}
+	return &scramMechanism{name: name, hash: h, password: password}
+}
+
+func (sc *scramMechanism) Name() string {
+	return sc.name
+}
+
+// Start resets the exchange state and returns the client-first-message.
+func (sc *scramMechanism) Start(s *SASLSession) ([]byte, error) {
+	var err error
+	if sc.nonce, err = generateScramNonce(); err != nil {
+		return nil, err
+	}
+	sc.user = s.Username
+	sc.serverSignature = nil
+	sc.verified = false
+	sc.cbData = nil
+	sc.downgradeProtection = scramDowngradeProtection(s.Mechanisms, s.ChannelBindingTypes)
+
+	switch {
+	case isPlusMech(sc.name):
+		if s.ChannelBindingType == "" || s.ChannelBinding == nil {
+			return nil, errors.New(sc.name + ": channel binding data is not available")
+		}
+		sc.gs2Header = "p=" + s.ChannelBindingType + ","
+		sc.cbData = s.ChannelBinding
+	case s.ChannelBindingType != "" && !hasPlusMech(s.Mechanisms):
+		// We support channel binding, but the server does not seem to: tell it, so that
+		// it can detect a downgrade.
+		sc.gs2Header = "y,"
+	default:
+		sc.gs2Header = "n,"
+	}
+	if s.Authzid != "" {
+		sc.gs2Header += "a=" + scramEscape(s.Authzid)
+	}
+	sc.gs2Header += ","
+
+	sc.clientFirstBare = "n=" + scramEscape(sc.user) + ",r=" + sc.nonce
+	return []byte(sc.gs2Header + sc.clientFirstBare), nil
+}
+
+// Next computes the client-final-message from the server-first-message. Some servers send
+// the server-final-message as a challenge, and expect an empty response before sending success.
+func (sc *scramMechanism) Next(challenge []byte) ([]byte, error) {
+	if sc.serverSignature != nil {
+		if err := sc.verify(challenge); err != nil {
+			return nil, err
+		}
+		sc.verified = true
+		return []byte{}, nil
+	}
+	return sc.next(challenge)
+}
+
+// Verify checks the server-final-message sent with success, to make sure the server also
+// knows our credentials.
+func (sc *scramMechanism) Verify(successData []byte) error {
+	if sc.verified && len(successData) == 0 {
+		return nil
+	}
+	return sc.verify(successData)
+}
+
+// next computes the client-final-message from the server-first-message.
+func (sc *scramMechanism) next(serverFirst []byte) ([]byte, error) {
+	attrs, err := scramParse(string(serverFirst))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := attrs["m"]; ok {
+		return nil, errors.New("SCRAM: unsupported mandatory extension in server-first-message")
+	}
+	if d, ok := attrs["d"]; ok && sc.downgradeProtection != "" {
+		h := sc.hash()
+		h.Write([]byte(sc.downgradeProtection))
+		if subtle.ConstantTimeCompare([]byte(d), []byte(base64.StdEncoding.EncodeToString(h.Sum(nil)))) != 1 {
+			return nil, errors.New("SCRAM: downgrade attack detected, mechanism list mismatch")
+		}
+	}
+
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, sc.nonce) || len(nonce) == len(sc.nonce) {
+		return nil, errors.New("SCRAM: server nonce does not extend client nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("SCRAM: invalid salt in server-first-message")
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations <= 0 {
+		return nil, errors.New("SCRAM: invalid iteration count in server-first-message")
+	}
+
+	saltedPassword, err := pbkdf2.Key(sc.hash, sc.password, salt, iterations, sc.hash().Size())
+	if err != nil {
+		return nil, err
+	}
+	clientKey := sc.hmac(saltedPassword, []byte("Client Key"))
+	h := sc.hash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+
+	cbInput := append([]byte(sc.gs2Header), sc.cbData...)
+	clientFinalWithoutProof := "c=" + base64.StdEncoding.EncodeToString(cbInput) + ",r=" + nonce
+	authMessage := []byte(sc.clientFirstBare + "," + string(serverFirst) + "," + clientFinalWithoutProof)
+
+	clientSignature := sc.hmac(storedKey, authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	serverKey := sc.hmac(saltedPassword, []byte("Server Key"))
+	sc.serverSignature = sc.hmac(serverKey, authMessage)
+
+	return []byte(clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify checks the server-final-message signature.
+func (sc *scramMechanism) verify(serverFinal []byte) error {
+	if sc.serverSignature == nil {
+		return errors.New("SCRAM: authentication succeeded before the exchange completed")
+	}
+	attrs, err := scramParse(string(serverFinal))
+	if err != nil {
+		return err
+	}
+	if e, ok := attrs["e"]; ok {
+		return errors.New("SCRAM: server error: " + e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil {
+		return errors.New("SCRAM: invalid server signature encoding")
+	}
+	if subtle.ConstantTimeCompare(signature, sc.serverSignature) != 1 {
+		return errors.New("SCRAM: server signature mismatch")
+	}
+	return nil
+}
+
+func (sc *scramMechanism) hmac(key, data []byte) []byte {
+	mac := hmac.New(sc.hash, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// generateScramNonce returns a random printable client nonce. It is a variable so that
+// tests can use fixed nonces.
+var generateScramNonce = func() (string, error) {
+	b := make([]byte, scramNonceSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+// scramDowngradeProtection builds the string hashed by the server for SCRAM downgrade
+// protection: sorted mechanisms, then sorted channel binding types if any.
+// Reference: XEP-0474 - https://xmpp.org/extensions/xep-0474.html
+func scramDowngradeProtection(mechanisms, cbTypes []string) string {
+	mechs := append([]string(nil), mechanisms...)
+	sort.Strings(mechs)
+	s := strings.Join(mechs, ",")
+	if len(cbTypes) > 0 {
+		types := append([]string(nil), cbTypes...)
+		sort.Strings(types)
+		s += "|" + strings.Join(types, ",")
+	}
+	return s
+}
+
+// scramEscape escapes the characters '=' and ',' in a SCRAM saslname.
+func scramEscape(s string) string {
+	s = strings.ReplaceAll(s, "=", "=3D")
+	return strings.ReplaceAll(s, ",", "=2C")
+}
+
+// scramParse splits a SCRAM message into its attributes.
+func scramParse(msg string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, field := range strings.Split(msg, ",") {
+		if len(field) < 2 || field[1] != '=' {
+			return nil, fmt.Errorf("SCRAM: malformed attribute %q", field)
+		}
+		attrs[field[:1]] = field[2:]
+	}
+	return attrs, nil
+}
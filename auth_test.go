@@ -0,0 +1,348 @@
+package xmpp
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+// Test vectors from RFC 5802 (SCRAM-SHA-1) and RFC 7677 (SCRAM-SHA-256)
+var scramVectors = []struct {
+	mech        string
+	clientNonce string
+	clientFirst string
+	serverFirst string
+	clientFinal string
+	serverFinal string
+}{
+	{
+		mech:        "SCRAM-SHA-1",
+		clientNonce: "fyko+d2lbbFgONRv9qkxdawL",
+		clientFirst: "n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL",
+		serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+		serverFinal: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+	},
+	{
+		mech:        "SCRAM-SHA-256",
+		clientNonce: "rOprNGfwEbeRWgbNEkqO",
+		clientFirst: "n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+		serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+	},
+}
+
+// withScramNonce forces the SCRAM client nonce, to match test vectors.
+func withScramNonce(nonce string) func() {
+	defaultNonce := generateScramNonce
+	generateScramNonce = func() (string, error) { return nonce, nil }
+	return func() { generateScramNonce = defaultNonce }
+}
+
+func TestScramMechanism(t *testing.T) {
+	for _, v := range scramVectors {
+		restore := withScramNonce(v.clientNonce)
+		sc := newScramMechanism(v.mech, "pencil")
+		if sc == nil {
+			t.Fatalf("%s: cannot create SCRAM mechanism", v.mech)
+		}
+
+		first, err := sc.Start(&SASLSession{Username: "user"})
+		if err != nil {
+			t.Fatalf("%s: start failed: %s", v.mech, err)
+		}
+		if string(first) != v.clientFirst {
+			t.Errorf("%s: incorrect client-first-message: %q", v.mech, first)
+		}
+
+		final, err := sc.Next([]byte(v.serverFirst))
+		if err != nil {
+			t.Fatalf("%s: next failed: %s", v.mech, err)
+		}
+		if string(final) != v.clientFinal {
+			t.Errorf("%s: incorrect client-final-message: %q", v.mech, final)
+		}
+
+		if err = sc.Verify([]byte(v.serverFinal)); err != nil {
+			t.Errorf("%s: server signature should be valid: %s", v.mech, err)
+		}
+		if err = sc.Verify([]byte("v=AAAA")); err == nil {
+			t.Errorf("%s: invalid server signature should be rejected", v.mech)
+		}
+		restore()
+	}
+}
+
+func TestScramMechanismRejectsNonceMismatch(t *testing.T) {
+	defer withScramNonce("abcdef")()
+	sc := newScramMechanism("SCRAM-SHA-256", "pencil")
+	if _, err := sc.Start(&SASLSession{Username: "user"}); err != nil {
+		t.Fatalf("start failed: %s", err)
+	}
+	if _, err := sc.Next([]byte("r=zzzzzz123,s=QSXCR+Q6sek8bf92,i=4096")); err == nil {
+		t.Error("server nonce not extending client nonce should be rejected")
+	}
+}
+
+func TestScramEscape(t *testing.T) {
+	if got := scramEscape("a=b,c"); got != "a=3Db=2Cc" {
+		t.Errorf("incorrect escaping: %s", got)
+	}
+}
+
+// Check that authSASL selects SCRAM and drives the challenge / response exchange.
+func TestAuthSASLScram(t *testing.T) {
+	v := scramVectors[1]
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- func() error {
+			decoder := xml.NewDecoder(server)
+			var auth stanza.SASLAuth
+			if err := decoder.Decode(&auth); err != nil {
+				return err
+			}
+			if auth.Mechanism != "SCRAM-SHA-256" {
+				t.Errorf("unexpected mechanism: %s", auth.Mechanism)
+			}
+			challenge := stanza.SASLChallenge{Value: base64.StdEncoding.EncodeToString([]byte(v.serverFirst))}
+			if err := sendSASLNonza(server, challenge); err != nil {
+				return err
+			}
+			var resp stanza.SASLResponse
+			if err := decoder.Decode(&resp); err != nil {
+				return err
+			}
+			if clientFinal, _ := base64.StdEncoding.DecodeString(resp.Value); string(clientFinal) != v.clientFinal {
+				t.Errorf("incorrect client-final-message: %q", clientFinal)
+			}
+			success := stanza.SASLSuccess{Value: base64.StdEncoding.EncodeToString([]byte(v.serverFinal))}
+			return sendSASLNonza(server, success)
+		}()
+	}()
+
+	features := stanza.StreamFeatures{}
+	features.Mechanisms.Mechanism = []string{"PLAIN", "SCRAM-SHA-1", "SCRAM-SHA-256"}
+
+	// Force the client nonce to match the test vector
+	defer withScramNonce(v.clientNonce)()
+
+	if err := authSASL(client, xml.NewDecoder(client), features, "user", Password("pencil")); err != nil {
+		t.Errorf("SCRAM authentication failed: %s", err)
+	}
+	if err := <-serverErr; err != nil {
+		t.Errorf("mock server error: %s", err)
+	}
+}
+
+// bindingConn is a connection providing fake channel binding data.
+type bindingConn struct {
+	net.Conn
+	types []string
+}
+
+func (c bindingConn) ChannelBindingTypes() []string {
+	return c.types
+}
+
+func (c bindingConn) ChannelBinding(cbType string) ([]byte, error) {
+	return []byte("cb-" + cbType), nil
+}
+
+// Check that SCRAM -PLUS is selected and bound to the transport when the server offers it.
+func TestAuthSASLScramPlus(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	authChan := make(chan stanza.SASLAuth, 1)
+	go func() {
+		var auth stanza.SASLAuth
+		_ = xml.NewDecoder(server).Decode(&auth)
+		authChan <- auth
+		server.Write([]byte("<failure xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><aborted/></failure>"))
+	}()
+
+	features := stanza.StreamFeatures{}
+	features.Mechanisms.Mechanism = []string{"SCRAM-SHA-256", "SCRAM-SHA-256-PLUS", "PLAIN"}
+	conn := bindingConn{Conn: client, types: []string{"tls-exporter", "tls-server-end-point"}}
+	_ = authSASL(conn, xml.NewDecoder(client), features, "user", Password("pencil"))
+
+	auth := <-authChan
+	if auth.Mechanism != "SCRAM-SHA-256-PLUS" {
+		t.Errorf("SCRAM-SHA-256-PLUS should have been selected, got %s", auth.Mechanism)
+	}
+	clientFirst, _ := base64.StdEncoding.DecodeString(auth.Value)
+	if !strings.HasPrefix(string(clientFirst), "p=tls-exporter,,") {
+		t.Errorf("client-first-message should request tls-exporter binding: %s", clientFirst)
+	}
+}
+
+// Check that authentication fails closed when -PLUS mechanisms are stripped while the
+// server advertises channel binding support.
+func TestAuthSASLScramPlusDowngrade(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	features := stanza.StreamFeatures{}
+	features.Mechanisms.Mechanism = []string{"SCRAM-SHA-256", "PLAIN"}
+	features.ChannelBinding.Types = []stanza.ChannelBindingType{{Type: "tls-exporter"}}
+	conn := bindingConn{Conn: client, types: []string{"tls-exporter"}}
+	if err := authSASL(conn, xml.NewDecoder(client), features, "user", Password("pencil")); err == nil {
+		t.Error("authentication should fail when -PLUS mechanisms are stripped")
+	}
+}
+
+// Check that SCRAM detects a tampered mechanism list, using the XEP-0474 server hash.
+func TestScramDowngradeProtection(t *testing.T) {
+	v := scramVectors[1]
+	defer withScramNonce(v.clientNonce)()
+	sc := newScramMechanism(v.mech, "pencil")
+	session := &SASLSession{Username: "user", Mechanisms: []string{"SCRAM-SHA-256", "PLAIN"}}
+	if _, err := sc.Start(session); err != nil {
+		t.Fatalf("start failed: %s", err)
+	}
+
+	h := sha256.Sum256([]byte("PLAIN,SCRAM-SHA-256,SCRAM-SHA-256-PLUS|tls-exporter"))
+	serverFirst := v.serverFirst + ",d=" + base64.StdEncoding.EncodeToString(h[:])
+	if _, err := sc.Next([]byte(serverFirst)); err == nil {
+		t.Error("mechanism list mismatch should be detected")
+	}
+
+	h = sha256.Sum256([]byte("PLAIN,SCRAM-SHA-256"))
+	serverFirst = v.serverFirst + ",d=" + base64.StdEncoding.EncodeToString(h[:])
+	if _, err := sc.Next([]byte(serverFirst)); err != nil {
+		t.Errorf("matching mechanism list should be accepted: %s", err)
+	}
+}
+
+// Check the SASL EXTERNAL initial response, with and without authorization identity.
+func TestAuthSASLExternal(t *testing.T) {
+	for authzid, expected := range map[string]string{"": "=", "admin@localhost": "YWRtaW5AbG9jYWxob3N0"} {
+		client, server := net.Pipe()
+
+		authChan := make(chan stanza.SASLAuth, 1)
+		go func() {
+			var auth stanza.SASLAuth
+			_ = xml.NewDecoder(server).Decode(&auth)
+			authChan <- auth
+			server.Write([]byte("<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>"))
+		}()
+
+		features := stanza.StreamFeatures{}
+		features.Mechanisms.Mechanism = []string{"EXTERNAL", "PLAIN"}
+		if err := authSASL(client, xml.NewDecoder(client), features, "", ClientCertificateAs(authzid)); err != nil {
+			t.Errorf("EXTERNAL authentication failed: %s", err)
+		}
+		auth := <-authChan
+		if auth.Mechanism != "EXTERNAL" || auth.Value != expected {
+			t.Errorf("unexpected auth for authzid %q: %s %q", authzid, auth.Mechanism, auth.Value)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// tokenMechanism is a custom mechanism used to check that applications can plug their own.
+type tokenMechanism struct {
+	challenges int
+}
+
+func (m *tokenMechanism) Name() string {
+	return "X-CORP-TOKEN"
+}
+
+func (m *tokenMechanism) Start(s *SASLSession) ([]byte, error) {
+	m.challenges = 0
+	return nil, nil
+}
+
+func (m *tokenMechanism) Next(challenge []byte) ([]byte, error) {
+	m.challenges++
+	return append([]byte("signed:"), challenge...), nil
+}
+
+func (m *tokenMechanism) Verify(data []byte) error {
+	if string(data) != "welcome" {
+		return errors.New("unexpected success data")
+	}
+	return nil
+}
+
+// Check that a custom mechanism drives a multi-round exchange through the generic negotiation.
+func TestAuthSASLCustomMechanism(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	var responses []string
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		decoder := xml.NewDecoder(server)
+		var auth stanza.SASLAuth
+		_ = decoder.Decode(&auth)
+		for _, c := range []string{"round1", "round2"} {
+			_ = sendSASLNonza(server, stanza.SASLChallenge{Value: saslEncode([]byte(c))})
+			var resp stanza.SASLResponse
+			_ = decoder.Decode(&resp)
+			data, _ := saslDecode(resp.Value)
+			responses = append(responses, string(data))
+		}
+		_ = sendSASLNonza(server, stanza.SASLSuccess{Value: saslEncode([]byte("welcome"))})
+	}()
+
+	mech := &tokenMechanism{}
+	features := stanza.StreamFeatures{}
+	features.Mechanisms.Mechanism = []string{"PLAIN", "X-CORP-TOKEN"}
+	credential := NewCredential(mech, NewSASLMechanism("PLAIN", "secret"))
+	if err := authSASL(client, xml.NewDecoder(client), features, "user", credential); err != nil {
+		t.Errorf("custom mechanism authentication failed: %s", err)
+	}
+	<-serverDone
+	if mech.challenges != 2 || len(responses) != 2 || responses[1] != "signed:round2" {
+		t.Errorf("unexpected exchange: %d challenges, responses %v", mech.challenges, responses)
+	}
+}
+
+func TestSASLRegistry(t *testing.T) {
+	if NewSASLMechanism("X-UNKNOWN", "") != nil {
+		t.Error("unknown mechanism should not be created")
+	}
+	RegisterSASLMechanism("X-CORP-TOKEN", func(string) SASLMechanism { return &tokenMechanism{} })
+	if mech := NewSASLMechanism("X-CORP-TOKEN", ""); mech == nil || mech.Name() != "X-CORP-TOKEN" {
+		t.Error("registered mechanism should be created")
+	}
+	if names := Password("secret").mechanismNames(); names[0] != "SCRAM-SHA-512-PLUS" || names[len(names)-1] != "PLAIN" {
+		t.Errorf("unexpected password mechanisms: %v", names)
+	}
+}
+
+// The copies of a credential do not share the state of the mechanisms.
+func TestCredential_MechanismPerAttempt(t *testing.T) {
+	credential := Password("secret")
+	var features stanza.StreamFeatures
+	offered := []string{"SCRAM-SHA-256"}
+	first, _, err := selectSASLMechanism(nil, features, offered, "user", credential)
+	if err != nil {
+		t.Fatalf("cannot select mechanism: %s", err)
+	}
+	second, _, err := selectSASLMechanism(nil, features, offered, "user", credential)
+	if err != nil {
+		t.Fatalf("cannot select mechanism: %s", err)
+	}
+	if first == second {
+		t.Error("each authentication attempt should use its own mechanism")
+	}
+}
@@ -17,7 +17,6 @@ The functions for Backoff are not threadsafe, but you can:
 - Use lock in your own code to protect the Backoff structure.
 
 TODO: Implement Backoff Ticker channel
-TODO: Implement throttler interface. Throttler could be used to implement various reconnect strategies.
 */
 
 package xmpp
@@ -62,9 +61,9 @@ func (b *backoff) wait() {
 // durationForAttempt returns a duration for an attempt number, in a stateless way.
 func (b *backoff) durationForAttempt(attempt int) time.Duration {
 	b.setDefault()
-	expBackoff := math.Min(float64(b.Cap), float64(b.Base)*math.Pow(float64(b.Factor), float64(b.attempt)))
+	expBackoff := math.Min(float64(b.Cap), float64(b.Base)*math.Pow(float64(b.Factor), float64(attempt)))
 	d := int(math.Trunc(expBackoff))
-	if !b.NoJitter {
+	if !b.NoJitter && d > 0 {
 		d = rand.Intn(d)
 	}
 	return time.Duration(d) * time.Millisecond
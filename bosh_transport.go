@@ -0,0 +1,612 @@
+package xmpp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+// ============================================================================
+// BOSH transport
+// Reference: XEP-0124 - https://xmpp.org/extensions/xep-0124.html
+// XMPP over BOSH: XEP-0206 - https://xmpp.org/extensions/xep-0206.html
+
+const (
+	nsBOSH  = "http://jabber.org/protocol/httpbind"
+	nsXBOSH = "urn:xmpp:xbosh"
+
+	boshDefaultWait = 60 * time.Second
+	boshDefaultHold = 1
+	// boshRetries is the number of times a failed request is sent again with the same request id,
+	// before ending the session. See XEP-0124 §14 - Broken Connections.
+	boshRetries    = 3
+	boshRetryDelay = 500 * time.Millisecond
+)
+
+var ErrBOSHNotConnected = errors.New("bosh: session is not established")
+
+// BOSHTransport implements XMPP over BOSH: the stream is carried by HTTP long-polling
+// requests, for networks that only allow HTTP through a proxy.
+// It is selected by NewClientTransport for http:// and https:// addresses.
+type BOSHTransport struct {
+	Config TransportConfiguration
+	// Wait is the longest time the server may hold a request before responding. Default to 60 seconds.
+	Wait time.Duration
+	// Hold is the maximum number of requests the server may keep waiting at the same time.
+	// Default to 1.
+	Hold int
+
+	client  *http.Client
+	decoder *xml.Decoder
+	logFile io.Writer
+
+	// Session parameters, set on session creation
+	sid      string
+	rid      uint64
+	wait     time.Duration
+	hold     int
+	requests int
+	maxPause time.Duration
+
+	// queue holds the incoming payloads, in request order. It is closed when the session ends.
+	queue  chan []byte
+	buffer []byte
+	// out passes the requests to send to the request loop
+	out      chan boshRequest
+	resume   chan struct{}
+	loopDone chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mu  sync.Mutex
+	err error
+}
+
+// boshRequest is a request to send on the session, with its payload or its control attributes.
+type boshRequest struct {
+	payload   []byte
+	restart   bool
+	terminate bool
+	pause     time.Duration
+}
+
+// boshResult is the outcome of a request sent by the request loop.
+type boshResult struct {
+	rid     uint64
+	request boshRequest
+	body    *boshBody
+	err     error
+}
+
+// boshBody is the <body/> wrapper element of the responses.
+type boshBody struct {
+	XMLName   xml.Name `xml:"http://jabber.org/protocol/httpbind body"`
+	Type      string   `xml:"type,attr,omitempty"`
+	Condition string   `xml:"condition,attr,omitempty"`
+	SID       string   `xml:"sid,attr,omitempty"`
+	Wait      int      `xml:"wait,attr,omitempty"`
+	Requests  int      `xml:"requests,attr,omitempty"`
+	Hold      int      `xml:"hold,attr,omitempty"`
+	MaxPause  int      `xml:"maxpause,attr,omitempty"`
+	Payload   []byte   `xml:",innerxml"`
+}
+
+func (t *BOSHTransport) Connect() (string, error) {
+	return t.ConnectContext(context.Background())
+}
+
+func (t *BOSHTransport) ConnectContext(ctx context.Context) (string, error) {
+	t.Close()
+
+	if t.client == nil {
+		t.client = t.Config.httpClient()
+	}
+	t.sid = ""
+	// The initial request id is random, with enough room to never exceed 2^53 - 1
+	t.rid = uint64(rand.Int63n(1<<32)) + 1
+	t.err = nil
+	t.buffer = nil
+	t.queue = make(chan []byte, 64)
+	t.out = make(chan boshRequest)
+	t.resume = make(chan struct{})
+	t.loopDone = nil
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+
+	t.decoder = xml.NewDecoder(bufio.NewReaderSize(t, maxPacketSize))
+	t.decoder.CharsetReader = t.Config.CharsetReader
+
+	// Cancelling the context ends the session being created
+	stop := context.AfterFunc(ctx, t.cancel)
+	sessionID, err := t.StartStream()
+	if !stop() {
+		t.Close()
+		return "", NewConnError(ctx.Err(), false)
+	}
+	return sessionID, err
+}
+
+// StartStream creates the BOSH session on first call, then requests a stream restart, for
+// example after SASL authentication.
+func (t *BOSHTransport) StartStream() (string, error) {
+	if t.sid == "" {
+		if err := t.createSession(); err != nil {
+			t.Close()
+			// The connection manager may be temporarily unreachable, unless it refused the session
+			var connErr ConnError
+			if !errors.As(err, &connErr) {
+				err = NewConnError(err, false)
+			}
+			return "", err
+		}
+	} else if err := t.send(boshRequest{restart: true}); err != nil {
+		return "", NewConnError(err, false)
+	}
+
+	sessionID, err := stanza.InitStream(t.GetDecoder())
+	if err != nil {
+		t.Close()
+		return "", NewConnError(err, false)
+	}
+	return sessionID, nil
+}
+
+// createSession sends the session creation request, and starts the request loop.
+func (t *BOSHTransport) createSession() error {
+	wait, hold := t.Wait, t.Hold
+	if wait == 0 {
+		wait = boshDefaultWait
+	}
+	if hold == 0 {
+		hold = boshDefaultHold
+	}
+
+	var attrs bytes.Buffer
+	writeAttr(&attrs, "content", "text/xml; charset=utf-8")
+	writeAttr(&attrs, "hold", fmt.Sprint(hold))
+	writeAttr(&attrs, "to", t.Config.Domain)
+	writeAttr(&attrs, "ver", "1.6")
+	writeAttr(&attrs, "wait", fmt.Sprint(int(wait/time.Second)))
+	writeAttr(&attrs, "xml:lang", "en")
+	writeAttr(&attrs, "xmpp:version", "1.0")
+	rid := t.rid
+	t.rid++
+
+	ctx, cancel := context.WithTimeout(t.ctx, wait+t.connectTimeout())
+	defer cancel()
+	body, err := t.post(ctx, rid, attrs.String(), nil)
+	if err != nil {
+		return err
+	}
+	if body.Type == "terminate" {
+		return NewConnError(errors.New("bosh: session creation failed: "+body.Condition), true)
+	}
+	if body.SID == "" {
+		return NewConnError(errors.New("bosh: missing session id"), true)
+	}
+
+	t.sid = body.SID
+	t.wait, t.hold = wait, hold
+	if body.Wait > 0 {
+		t.wait = time.Duration(body.Wait) * time.Second
+	}
+	if body.Hold > 0 {
+		t.hold = body.Hold
+	}
+	t.requests = body.Requests
+	if t.requests == 0 {
+		t.requests = t.hold + 1
+	}
+	t.maxPause = time.Duration(body.MaxPause) * time.Second
+
+	t.queue <- t.streamHeader()
+	if len(bytes.TrimSpace(body.Payload)) > 0 {
+		t.queue <- body.Payload
+	}
+	t.loopDone = make(chan struct{})
+	go t.loop(rid)
+	return nil
+}
+
+// streamHeader is the stream open element passed to the decoder when the stream starts, as
+// BOSH does not transport it.
+func (t *BOSHTransport) streamHeader() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<stream:stream xmlns='%s' xmlns:stream='%s' version='1.0'", stanza.NSClient, stanza.NSStream)
+	writeAttr(&b, "id", t.sid)
+	b.WriteString(">")
+	return b.Bytes()
+}
+
+// loop sends the requests, keeping a request waiting on the server to receive its data, and
+// passes the response payloads to the decoder in request order.
+// It is the only sender on the queue, and closes it when the session ends.
+func (t *BOSHTransport) loop(lastRID uint64) {
+	defer close(t.loopDone)
+	defer close(t.queue)
+	defer t.cancel()
+
+	results := make(chan boshResult)
+	received := make(map[uint64]boshResult)
+	nextRID := lastRID + 1
+	var pending []boshRequest
+	var inflight int
+	var paused, terminating bool
+
+	for {
+		// Send pending requests, then keep a request waiting on the server
+		for inflight < t.requests && !terminating {
+			var req boshRequest
+			if len(pending) > 0 {
+				req, pending = combineBOSHRequests(pending)
+			} else if inflight == 0 && !paused {
+				// Empty request, held by the server until it has data to send
+			} else {
+				break
+			}
+			if req.terminate {
+				terminating = true
+			}
+			if req.pause > 0 {
+				paused = true
+			}
+			inflight++
+			go t.request(t.rid, req, results)
+			t.rid++
+		}
+
+		select {
+		case req := <-t.out:
+			pending = append(pending, req)
+		case <-t.resume:
+			paused = false
+		case res := <-results:
+			inflight--
+			received[res.rid] = res
+			// Deliver the payloads in request order
+			for {
+				res, ok := received[nextRID]
+				if !ok {
+					break
+				}
+				delete(received, nextRID)
+				nextRID++
+				if !t.deliver(res) {
+					return
+				}
+			}
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// combineBOSHRequests merges the pending payloads into a single request. Control requests,
+// like stream restart, are sent alone.
+func combineBOSHRequests(pending []boshRequest) (boshRequest, []boshRequest) {
+	req := pending[0]
+	if req.restart || req.terminate || req.pause > 0 {
+		return req, pending[1:]
+	}
+	i := 1
+	for ; i < len(pending); i++ {
+		next := pending[i]
+		if next.restart || next.pause > 0 {
+			break
+		}
+		req.payload = append(req.payload, next.payload...)
+		if next.terminate {
+			req.terminate = true
+			i++
+			break
+		}
+	}
+	return req, pending[i:]
+}
+
+// deliver passes the response payload to the decoder. It returns false when the session ended.
+func (t *BOSHTransport) deliver(res boshResult) bool {
+	if res.err != nil {
+		t.fail(res.err)
+		return false
+	}
+	var data []byte
+	if res.request.restart {
+		data = append(data, t.streamHeader()...)
+	}
+	data = append(data, bytes.TrimSpace(res.body.Payload)...)
+
+	ended := res.request.terminate || res.body.Type == "terminate"
+	if ended {
+		// Report the session termination as a stream error, followed by the stream close
+		if c := res.body.Condition; c != "" && c != "remote-stream-error" {
+			var e bytes.Buffer
+			e.WriteString("<stream:error><undefined-condition xmlns='urn:ietf:params:xml:ns:xmpp-streams'/>")
+			e.WriteString("<text xmlns='urn:ietf:params:xml:ns:xmpp-streams'>")
+			_ = xml.EscapeText(&e, []byte(c))
+			e.WriteString("</text></stream:error>")
+			data = append(data, e.Bytes()...)
+		}
+		data = append(data, stanza.StreamClose...)
+	}
+	if len(data) > 0 {
+		select {
+		case t.queue <- data:
+		case <-t.ctx.Done():
+			return false
+		}
+	}
+	return !ended
+}
+
+// request sends a request on the session, and reports the result to the request loop. A failed
+// request is sent again, a few times, before reporting the failure.
+func (t *BOSHTransport) request(rid uint64, req boshRequest, results chan<- boshResult) {
+	var attrs bytes.Buffer
+	writeAttr(&attrs, "sid", t.sid)
+	switch {
+	case req.restart:
+		writeAttr(&attrs, "to", t.Config.Domain)
+		writeAttr(&attrs, "xml:lang", "en")
+		writeAttr(&attrs, "xmpp:restart", "true")
+	case req.terminate:
+		writeAttr(&attrs, "type", "terminate")
+	case req.pause > 0:
+		writeAttr(&attrs, "pause", fmt.Sprint(int(req.pause/time.Second)))
+	}
+
+	var body *boshBody
+	var err error
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(t.ctx, t.wait+t.connectTimeout())
+		body, err = t.post(ctx, rid, attrs.String(), req.payload)
+		cancel()
+		if err == nil || attempt == boshRetries {
+			break
+		}
+		// The connection may have been broken: the request is sent again with the same id
+		select {
+		case <-time.After(boshRetryDelay):
+		case <-t.ctx.Done():
+			return
+		}
+	}
+	if err == nil && body.Type == "terminate" && req.terminate {
+		body.Condition = ""
+	}
+	select {
+	case results <- boshResult{rid: rid, request: req, body: body, err: err}:
+	case <-t.ctx.Done():
+	}
+}
+
+// post sends a <body/> element to the connection manager, and returns the response body.
+func (t *BOSHTransport) post(ctx context.Context, rid uint64, attrs string, payload []byte) (*boshBody, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<body rid='%d' xmlns='%s' xmlns:xmpp='%s'%s", rid, nsBOSH, nsXBOSH, attrs)
+	if len(payload) == 0 {
+		b.WriteString("/>")
+	} else {
+		b.WriteString(">")
+		b.Write(payload)
+		b.WriteString("</body>")
+	}
+	t.log("SEND", b.Bytes())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.Config.Address, &b)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4*maxPacketSize))
+	if err != nil {
+		return nil, err
+	}
+	t.log("RECV", data)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bosh: unexpected HTTP status: %s", resp.Status)
+	}
+
+	var body boshBody
+	if err = xml.Unmarshal(data, &body); err != nil {
+		return nil, errors.New("bosh: cannot decode response: " + err.Error())
+	}
+	return &body, nil
+}
+
+// send passes a request to the request loop.
+func (t *BOSHTransport) send(req boshRequest) error {
+	if t.loopDone == nil {
+		return ErrBOSHNotConnected
+	}
+	select {
+	case t.out <- req:
+		return nil
+	case <-t.loopDone:
+		if err := t.failure(); err != nil {
+			return err
+		}
+		return ErrBOSHNotConnected
+	}
+}
+
+// Pause asks the server to keep the session open without requests for the duration, for
+// example while the application is in background. The session continues on Resume.
+func (t *BOSHTransport) Pause(d time.Duration) error {
+	if t.maxPause == 0 {
+		return errors.New("bosh: server does not support session pause")
+	}
+	if d > t.maxPause {
+		d = t.maxPause
+	}
+	if d < time.Second {
+		d = time.Second
+	}
+	return t.send(boshRequest{pause: d})
+}
+
+// Resume continues a paused session.
+func (t *BOSHTransport) Resume() error {
+	if t.loopDone == nil {
+		return ErrBOSHNotConnected
+	}
+	select {
+	case t.resume <- struct{}{}:
+		return nil
+	case <-t.loopDone:
+		return ErrBOSHNotConnected
+	}
+}
+
+func (t *BOSHTransport) fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+// failure returns the error that ended the session, if any.
+func (t *BOSHTransport) failure() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+func (t *BOSHTransport) connectTimeout() time.Duration {
+	if t.Config.ConnectTimeout > 0 {
+		return time.Duration(t.Config.ConnectTimeout) * time.Second
+	}
+	return 15 * time.Second
+}
+
+func (t *BOSHTransport) log(direction string, data []byte) {
+	if t.logFile != nil {
+		_, _ = fmt.Fprintf(t.logFile, "%s:\n%s\n\n", direction, data)
+	}
+}
+
+func (t *BOSHTransport) DoesStartTLS() bool {
+	return false
+}
+
+func (t *BOSHTransport) StartTLS() error {
+	return ErrTLSNotSupported
+}
+
+func (t *BOSHTransport) GetDomain() string {
+	return t.Config.Domain
+}
+
+func (t *BOSHTransport) GetDecoder() *xml.Decoder {
+	return t.decoder
+}
+
+func (t *BOSHTransport) IsSecure() bool {
+	return strings.HasPrefix(t.Config.Address, "https:")
+}
+
+// Ping checks that the session is still alive. Requests waiting on the server already keep
+// the session open.
+func (t *BOSHTransport) Ping() error {
+	if t.loopDone == nil {
+		return ErrBOSHNotConnected
+	}
+	select {
+	case <-t.loopDone:
+		if err := t.failure(); err != nil {
+			return err
+		}
+		return ErrBOSHNotConnected
+	default:
+		return nil
+	}
+}
+
+// Read returns the payloads received from the server, in request order.
+func (t *BOSHTransport) Read(p []byte) (int, error) {
+	if len(t.buffer) == 0 {
+		if t.queue == nil {
+			return 0, ErrBOSHNotConnected
+		}
+		data, ok := <-t.queue
+		if !ok {
+			if err := t.failure(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		t.buffer = data
+	}
+	n := copy(p, t.buffer)
+	t.buffer = t.buffer[n:]
+	return n, nil
+}
+
+// Write sends stanzas and nonzas to the server. Payloads written while the maximum number of
+// requests are pending are combined in the next request.
+func (t *BOSHTransport) Write(p []byte) (int, error) {
+	payload := make([]byte, len(p))
+	copy(payload, p)
+	if err := t.send(boshRequest{payload: payload}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close terminates the BOSH session, and waits for the pending requests to complete.
+func (t *BOSHTransport) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.connectTimeout())
+	defer cancel()
+	return t.CloseContext(ctx)
+}
+
+// CloseContext terminates the BOSH session, and waits for the pending requests to complete
+// until the context is done.
+func (t *BOSHTransport) CloseContext(ctx context.Context) error {
+	if t.loopDone == nil {
+		if t.cancel != nil {
+			t.cancel()
+		}
+		return nil
+	}
+	if ctx.Err() == nil && t.send(boshRequest{terminate: true}) == nil {
+		select {
+		case <-t.loopDone:
+		case <-ctx.Done():
+		}
+	}
+	t.cancel()
+	<-t.loopDone
+	return nil
+}
+
+func (t *BOSHTransport) LogTraffic(logFile io.Writer) {
+	t.logFile = logFile
+}
+
+// ReceivedStreamClose is not used for BOSH: the session ends with the terminate request.
+func (t *BOSHTransport) ReceivedStreamClose() {
+}
+
+// writeAttr writes an escaped XML attribute.
+func writeAttr(b *bytes.Buffer, name, value string) {
+	b.WriteString(" " + name + "='")
+	_ = xml.EscapeText(b, []byte(value))
+	b.WriteString("'")
+}
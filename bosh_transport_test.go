@@ -0,0 +1,275 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+// boshServer is a minimal BOSH connection manager, answering the client session with
+// canned XMPP responses.
+type boshServer struct {
+	t *testing.T
+	// creation is the response to the session creation request
+	creation string
+	// failures is the number of session requests to fail, as if the connection was broken
+	failures int
+
+	mu         sync.Mutex
+	rids       []uint64
+	restarts   int
+	terminated bool
+	data       chan string
+}
+
+type boshTestRequest struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/httpbind body"`
+	RID     uint64   `xml:"rid,attr"`
+	SID     string   `xml:"sid,attr"`
+	Type    string   `xml:"type,attr"`
+	Restart string   `xml:"urn:xmpp:xbosh restart,attr"`
+	Payload []byte   `xml:",innerxml"`
+}
+
+func newBOSHServer(t *testing.T) *boshServer {
+	return &boshServer{
+		t: t,
+		creation: `<body xmlns='http://jabber.org/protocol/httpbind' xmlns:stream='http://etherx.jabber.org/streams'
+  sid='sid-1' wait='2' hold='1' requests='2' ver='1.6'>
+  <stream:features>
+    <mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms>
+  </stream:features>
+</body>`,
+		data: make(chan string, 10),
+	}
+}
+
+func (s *boshServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req boshTestRequest
+	data, _ := io.ReadAll(r.Body)
+	if err := xml.Unmarshal(data, &req); err != nil {
+		s.t.Errorf("cannot decode BOSH request %s: %s", data, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.rids = append(s.rids, req.RID)
+	failed := req.SID != "" && s.failures > 0
+	if failed {
+		s.failures--
+	}
+	s.mu.Unlock()
+	if failed {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	switch {
+	case req.SID == "":
+		fmt.Fprint(w, s.creation)
+		return
+	case req.SID != "sid-1":
+		fmt.Fprint(w, "<body xmlns='http://jabber.org/protocol/httpbind' type='terminate' condition='item-not-found'/>")
+		return
+	case req.Type == "terminate":
+		s.mu.Lock()
+		s.terminated = true
+		s.mu.Unlock()
+		fmt.Fprint(w, "<body xmlns='http://jabber.org/protocol/httpbind' type='terminate'/>")
+		return
+	case req.Restart == "true":
+		s.mu.Lock()
+		s.restarts++
+		s.mu.Unlock()
+		fmt.Fprint(w, `<body xmlns='http://jabber.org/protocol/httpbind' xmlns:stream='http://etherx.jabber.org/streams'>
+  <stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>
+</body>`)
+		return
+	}
+	s.process(req.Payload)
+
+	// Hold the request until there is data to send
+	var payload string
+	select {
+	case d := <-s.data:
+		payload = d
+	case <-time.After(200 * time.Millisecond):
+	}
+	fmt.Fprintf(w, "<body xmlns='http://jabber.org/protocol/httpbind' xmlns:stream='http://etherx.jabber.org/streams'>%s</body>", payload)
+}
+
+// process answers the authentication and resource binding requests.
+func (s *boshServer) process(payload []byte) {
+	decoder := xml.NewDecoder(bytes.NewReader(payload))
+	for {
+		se, err := stanza.NextStart(decoder)
+		if err != nil {
+			return
+		}
+		switch se.Name.Local {
+		case "auth":
+			_ = decoder.Skip()
+			s.data <- "<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>"
+		case "iq":
+			var iq stanza.IQ
+			if err = decoder.DecodeElement(&iq, &se); err != nil {
+				s.t.Errorf("cannot decode iq: %s", err)
+				return
+			}
+			if _, ok := iq.Payload.(*stanza.Bind); ok {
+				s.data <- fmt.Sprintf("<iq type='result' id='%s' xmlns='jabber:client'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>test@localhost/bosh</jid></bind></iq>", iq.Id)
+			}
+		default:
+			_ = decoder.Skip()
+		}
+	}
+}
+
+func TestBOSHTransport_Session(t *testing.T) {
+	server := newBOSHServer(t)
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Address: httpServer.URL,
+		},
+		Jid:        "test@localhost",
+		Credential: Password("test"),
+		Insecure:   true,
+	}
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("cannot create XMPP client: %s", err)
+	}
+	if _, ok := client.transport.(*BOSHTransport); !ok {
+		t.Fatalf("expected BOSH transport for http address, got %T", client.transport)
+	}
+	if err = client.Connect(); err != nil {
+		t.Fatalf("XMPP connection failed: %s", err)
+	}
+	if client.Session.BindJid != "test@localhost/bosh" {
+		t.Errorf("unexpected bound jid: %s", client.Session.BindJid)
+	}
+	if err = client.Disconnect(); err != nil {
+		t.Errorf("disconnect failed: %s", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.restarts != 1 {
+		t.Errorf("expected 1 stream restart after authentication, got %d", server.restarts)
+	}
+	if !server.terminated {
+		t.Error("session should be terminated on disconnect")
+	}
+	// Request ids must be unique and consecutive
+	rids := append([]uint64(nil), server.rids...)
+	sort.Slice(rids, func(i, j int) bool { return rids[i] < rids[j] })
+	for i := 1; i < len(rids); i++ {
+		if rids[i] != rids[i-1]+1 {
+			t.Errorf("request ids are not consecutive: %v", rids)
+			break
+		}
+	}
+}
+
+// A request failing because of a broken connection is sent again with the same request id.
+func TestBOSHTransport_BrokenConnection(t *testing.T) {
+	server := newBOSHServer(t)
+	server.failures = 1
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Address: httpServer.URL,
+		},
+		Jid:        "test@localhost",
+		Credential: Password("test"),
+		Insecure:   true,
+	}
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("cannot create XMPP client: %s", err)
+	}
+	if err = client.Connect(); err != nil {
+		t.Fatalf("XMPP connection failed: %s", err)
+	}
+	if client.Session.BindJid != "test@localhost/bosh" {
+		t.Errorf("unexpected bound jid: %s", client.Session.BindJid)
+	}
+	if err = client.Disconnect(); err != nil {
+		t.Errorf("disconnect failed: %s", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	seen := make(map[uint64]int)
+	for _, rid := range server.rids {
+		seen[rid]++
+	}
+	if len(seen) != len(server.rids)-1 {
+		t.Errorf("expected one request to be sent again, got request ids %v", server.rids)
+	}
+}
+
+func TestBOSHTransport_SessionCreationFailure(t *testing.T) {
+	server := newBOSHServer(t)
+	server.creation = "<body xmlns='http://jabber.org/protocol/httpbind' type='terminate' condition='host-unknown'/>"
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	transport := NewClientTransport(TransportConfiguration{Address: httpServer.URL, Domain: "localhost"})
+	_, err := transport.Connect()
+	if err == nil || !strings.Contains(err.Error(), "host-unknown") {
+		t.Errorf("expected host-unknown error, got %v", err)
+	}
+	var connErr ConnError
+	if !errors.As(err, &connErr) || !connErr.Permanent {
+		t.Errorf("a session refused by the connection manager should be permanent: %v", err)
+	}
+}
+
+// A connection manager which is temporarily unavailable can be retried.
+func TestBOSHTransport_SessionCreationUnavailable(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer httpServer.Close()
+
+	transport := NewClientTransport(TransportConfiguration{Address: httpServer.URL, Domain: "localhost"})
+	_, err := transport.Connect()
+	var connErr ConnError
+	if !errors.As(err, &connErr) || connErr.Permanent {
+		t.Errorf("expected a temporary connection error, got %v", err)
+	}
+}
+
+func TestCombineBOSHRequests(t *testing.T) {
+	pending := []boshRequest{
+		{payload: []byte("<a/>")},
+		{payload: []byte("<b/>")},
+		{restart: true},
+		{payload: []byte("<c/>")},
+	}
+	req, pending := combineBOSHRequests(pending)
+	if string(req.payload) != "<a/><b/>" || len(pending) != 2 {
+		t.Errorf("payloads should be combined up to the restart: %q, %d pending", req.payload, len(pending))
+	}
+	req, pending = combineBOSHRequests(pending)
+	if !req.restart || len(req.payload) != 0 || len(pending) != 1 {
+		t.Errorf("restart should be sent alone: %+v", req)
+	}
+}
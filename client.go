@@ -4,9 +4,13 @@ import (
 	"context"
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gosrc.io/xmpp/stanza"
@@ -39,6 +43,15 @@ func (scs *SyncConnState) setState(cs ConnState) {
 	scs.Unlock()
 }
 
+// swapState is a thread-safe setter returning the previous state
+func (scs *SyncConnState) swapState(cs ConnState) ConnState {
+	scs.Lock()
+	previous := scs.state
+	scs.state = cs
+	scs.Unlock()
+	return previous
+}
+
 // This is a the list of events happening on the connection that the
 // client can be notified about.
 const (
@@ -47,18 +60,62 @@ const (
 	StateSessionEstablished
 	StateStreamError
 	StatePermanentError
+	// StateConnecting is the connection of the transport, including the name resolution
+	StateConnecting
+	// StateTLSNegotiating is the TLS negotiation with STARTTLS
+	StateTLSNegotiating
+	// StateAuthenticating is the authentication, and the stream management resumption
+	StateAuthenticating
+	// StateBinding is the resource binding, and the stream management enablement
+	StateBinding
+	// StateSessionResumed is a session established by resuming the stream management session of a
+	// previous connection, instead of StateSessionEstablished for a fresh session
+	StateSessionResumed
 	InitialPresence = "<presence/>"
 )
 
+// sessionEstablished tells if the state is an established session, fresh or resumed.
+func sessionEstablished(state ConnState) bool {
+	return state == StateSessionEstablished || state == StateSessionResumed
+}
+
 // Event is a structure use to convey event changes related to client state. This
 // is for example used to notify the client when the client get disconnected.
 type Event struct {
-	State       SyncConnState
+	State SyncConnState
+	// Previous is the state before the transition
+	Previous ConnState
+	// Time is the time of the event
+	Time time.Time
+	// Err is the error which caused the transition, if any
+	Err         error
 	Description string
 	StreamError string
 	SMState     SMState
+	// Token is set when the FAST authentication token was stored or invalidated. The connection
+	// state is unchanged: State and Previous are both the current state.
+	Token *TokenEvent
+	// Resumption tells how the client reconnected, when it had a stream management session to resume
+	Resumption ResumptionPath
 }
 
+// ResumptionPath tells how the client reconnected when it had a stream management session to
+// resume (XEP-0198).
+type ResumptionPath string
+
+const (
+	// ResumptionLocation is a session resumed on the location advertised by the server
+	ResumptionLocation ResumptionPath = "location"
+	// ResumptionAddress is a session resumed on the configured or resolved address, when the server
+	// did not advertise a location or the client could not connect to it
+	ResumptionAddress ResumptionPath = "address"
+	// ResumptionExpired is a new session bound without trying to resume, as the maximum resumption
+	// time set by the server had passed
+	ResumptionExpired ResumptionPath = "expired"
+	// ResumptionFailed is a new session bound after the server failed to resume the session
+	ResumptionFailed ResumptionPath = "failed"
+)
+
 // SMState holds Stream Management information regarding the session that can be
 // used to resume session after disconnect
 type SMState struct {
@@ -67,16 +124,68 @@ type SMState struct {
 	// Inbound stanza count
 	Inbound uint
 
-	// IP affinity
-	preferredReconAddr string
+	// IP affinity: the address to reconnect to when resuming the session, if set by the server
+	Location string
+	// Max is the maximum resumption time in seconds set by the server, 0 if unknown
+	Max uint
+	// Timestamp is the time the state was saved in the SMStateStore
+	Timestamp time.Time
+	// Lost is the time the connection was lost, zero while the session is established
+	Lost time.Time
 
 	// Error
 	StreamErrorGroup stanza.StanzaErrorGroup
 
 	// Track sent stanzas
 	*stanza.UnAckQueue
+}
 
-	// TODO Store max and timestamp, to check if we should retry resumption or not
+// Expired tells if the session cannot be resumed anymore, as the maximum resumption time set by
+// the server has passed since the connection was lost. When the time of the loss is unknown, for
+// example after the process crashed, the time the state was saved is used instead.
+func (s SMState) Expired() bool {
+	since := s.Lost
+	if since.IsZero() {
+		since = s.Timestamp
+	}
+	return s.Max > 0 && !since.IsZero() && time.Since(since) > time.Duration(s.Max)*time.Second
+}
+
+// snapshot returns a copy of the state, with a copy of the unacknowledged stanzas queue.
+func (s SMState) snapshot() SMState {
+	if s.UnAckQueue == nil {
+		return s
+	}
+	queue := stanza.NewUnAckQueue()
+	s.UnAckQueue.RLock()
+	queue.Handled = s.UnAckQueue.Handled
+	for _, stz := range s.UnAckQueue.Uslice {
+		copied := *stz
+		queue.Uslice = append(queue.Uslice, &copied)
+	}
+	s.UnAckQueue.RUnlock()
+	s.UnAckQueue = queue
+	return s
+}
+
+// Notification reports something which happened on the connection without changing its state.
+type Notification struct {
+	// Time is the time of the notification
+	Time        time.Time
+	Description string
+	// Redirect is the address the server redirected the client to
+	Redirect string
+}
+
+// NotificationHandler is used to pass the notifications of the connection to the client
+// implementation.
+type NotificationHandler func(Notification)
+
+// clone returns a copy of the event.
+func (e *Event) clone() *Event {
+	return &Event{State: SyncConnState{state: e.State.state}, Previous: e.Previous, Time: e.Time, Err: e.Err,
+		Description: e.Description, StreamError: e.StreamError, SMState: e.SMState, Token: e.Token,
+		Resumption: e.Resumption}
 }
 
 // EventHandler is use to pass events about state of the connection to
@@ -89,32 +198,148 @@ type EventManager struct {
 
 	// Callback used to propagate connection state changes
 	Handler EventHandler
+	// Callback used to propagate the notifications which do not change the connection state
+	NotificationHandler NotificationHandler
+
+	subscriptionsMu sync.Mutex
+	subscriptions   []*Subscription
+}
+
+// Subscription receives the events of a connection on a channel, in addition to the handler. See
+// EventManager.Subscribe.
+type Subscription struct {
+	// C receives the events. It is closed when the subscription is closed.
+	C <-chan *Event
+
+	c       chan *Event
+	em      *EventManager
+	dropped atomic.Uint64
+}
+
+// Subscribe returns a subscription receiving the events of the connection, buffering up to buffer
+// events. The events are not delivered when the buffer is full, so that a slow listener does not
+// block the connection. There can be any number of subscriptions, each one receiving its own copy
+// of the events. The subscription must be closed when it is not used anymore.
+func (em *EventManager) Subscribe(buffer int) *Subscription {
+	c := make(chan *Event, buffer)
+	s := &Subscription{C: c, c: c, em: em}
+	em.subscriptionsMu.Lock()
+	em.subscriptions = append(em.subscriptions, s)
+	em.subscriptionsMu.Unlock()
+	return s
+}
+
+// Close stops the delivery of the events, and closes the channel.
+func (s *Subscription) Close() {
+	em := s.em
+	em.subscriptionsMu.Lock()
+	defer em.subscriptionsMu.Unlock()
+	for i, sub := range em.subscriptions {
+		if sub == s {
+			em.subscriptions = append(em.subscriptions[:i:i], em.subscriptions[i+1:]...)
+			close(s.c)
+			return
+		}
+	}
+}
+
+// Dropped returns the number of events not delivered as the buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// State returns the current connection state. It is thread safe.
+func (em *EventManager) State() ConnState {
+	return em.CurrentState.getState()
 }
 
 // updateState changes the CurrentState in the event manager. The state read is threadsafe but there is no guarantee
 // regarding the triggered callback function.
 func (em *EventManager) updateState(state ConnState) {
-	em.CurrentState.setState(state)
+	em.transition(state, &Event{})
+}
+
+// transition changes the CurrentState in the event manager, and notifies the subscribers and the
+// handler with the event, completed with the states and the time of the transition.
+func (em *EventManager) transition(state ConnState, e *Event) {
+	e.Previous = em.CurrentState.swapState(state)
+	e.State = SyncConnState{state: state}
+	e.Time = time.Now()
+	em.publish(e)
+}
+
+// publish delivers the event to the subscribers, then calls the handler. The subscribers are
+// notified first, as the handler may run a whole reconnection.
+func (em *EventManager) publish(e *Event) {
+	em.subscriptionsMu.Lock()
+	for _, s := range em.subscriptions {
+		select {
+		case s.c <- e.clone():
+		default:
+			s.dropped.Add(1)
+		}
+	}
+	em.subscriptionsMu.Unlock()
 	if em.Handler != nil {
-		em.Handler(Event{State: em.CurrentState})
+		em.Handler(*e.clone())
 	}
 }
 
-// disconnected changes the CurrentState in the event manager to "disconnected". The state read is threadsafe but there is no guarantee
+// disconnected changes the CurrentState in the event manager to "disconnected". err is the error
+// which caused the disconnection, if any. The state read is threadsafe but there is no guarantee
 // regarding the triggered callback function.
-func (em *EventManager) disconnected(state SMState) {
-	em.CurrentState.setState(StateDisconnected)
-	if em.Handler != nil {
-		em.Handler(Event{State: em.CurrentState, SMState: state})
+func (em *EventManager) disconnected(state SMState, err error) {
+	em.transition(StateDisconnected, &Event{SMState: state, Err: err})
+}
+
+// connectionFailed changes the CurrentState in the event manager to "permanentError" when err is a
+// permanent ConnError, or to "disconnected", after a connection attempt failed with err. It returns
+// err. The stream manager does not reconnect on this event, as the caller gets the error.
+func (em *EventManager) connectionFailed(state SMState, err error) error {
+	next := StateDisconnected
+	var connErr ConnError
+	if errors.As(err, &connErr) && connErr.Permanent {
+		next = StatePermanentError
+	}
+	em.transition(next, &Event{SMState: state, Err: err})
+	return err
+}
+
+// established changes the CurrentState in the event manager to "sessionEstablished", or
+// "sessionResumed" when the stream management session was resumed, telling how the session was
+// resumed if the client had one.
+func (em *EventManager) established(resumed bool, resumption ResumptionPath) {
+	state := StateSessionEstablished
+	if resumed {
+		state = StateSessionResumed
 	}
+	em.transition(state, &Event{Resumption: resumption})
 }
 
 // streamError changes the CurrentState in the event manager to "streamError". The state read is threadsafe but there is no guarantee
 // regarding the triggered callback function.
 func (em *EventManager) streamError(error, desc string) {
-	em.CurrentState.setState(StateStreamError)
-	if em.Handler != nil {
-		em.Handler(Event{State: em.CurrentState, StreamError: error, Description: desc})
+	em.transition(StateStreamError, &Event{StreamError: error, Description: desc,
+		Err: &StreamError{Condition: error, Text: desc}})
+}
+
+// redirected notifies the client that the server redirected it to another address.
+func (em *EventManager) redirected(address string) {
+	em.notify(Notification{Redirect: address, Description: "redirected to " + address})
+}
+
+// tokenChanged notifies the client that the FAST authentication token was stored or
+// invalidated. The event is published with the current state, which is unchanged.
+func (em *EventManager) tokenChanged(ev TokenEvent) {
+	state := em.CurrentState.getState()
+	em.publish(&Event{State: SyncConnState{state: state}, Previous: state, Time: time.Now(), Token: &ev})
+}
+
+// notify calls the notification handler, setting the time of the notification.
+func (em *EventManager) notify(n Notification) {
+	if em.NotificationHandler != nil {
+		n.Time = time.Now()
+		em.NotificationHandler(n)
 	}
 }
 
@@ -123,6 +348,9 @@ func (em *EventManager) streamError(error, desc string) {
 
 var ErrCanOnlySendGetOrSetIq = errors.New("SendIQ can only send get and set IQ stanzas")
 
+// maxRedirects is the maximum number of redirects followed on a connection, to prevent loops.
+const maxRedirects = 5
+
 // Client is the main structure used to connect as a client on an XMPP
 // server.
 type Client struct {
@@ -131,6 +359,23 @@ type Client struct {
 	// Session gather data that can be accessed by users of this library
 	Session   *Session
 	transport Transport
+	// writer writes the packets of the connection, from a bounded queue
+	writer atomic.Pointer[packetWriter]
+	// managed is set once the connection is managed by Connect or Resume
+	managed atomic.Bool
+	// offline buffers the stanzas sent while disconnected, when enabled
+	offline *offlineBuffer
+	// sm tracks the stanzas until the server acknowledges them, with stream management
+	sm streamManagement
+	// smMu guards the stream management state of the session, updated by the receiving goroutine
+	smMu sync.Mutex
+	// credentialMu guards the credential of the configuration, changed by ChangePassword
+	credentialMu sync.RWMutex
+	// recvDone is closed when the receiving goroutine of the connection stops using the transport
+	// and the session
+	recvDone chan struct{}
+	// atLocation is set when the transport is connected to the stream management location
+	atLocation bool
 	// Router is used to dispatch packets
 	router *Router
 	// Track and broadcast connection state
@@ -162,29 +407,17 @@ func NewClient(config *Config, r *Router, errorHandler func(error)) (c *Client,
 		return nil, NewConnError(err, true)
 	}
 
-	if config.Credential.secret == "" {
-		err = errors.New("missing credential")
+	if config.CredentialProvider == nil {
+		if err = config.Credential.validate(config.TLSConfig); err != nil {
+			return nil, NewConnError(err, true)
+		}
+	}
+	// FAST tokens are bound to the client instance, identified by its user agent id
+	if config.TokenStore != nil && (config.UserAgent == nil || config.UserAgent.Id == "") {
+		err = errors.New("token store requires a user agent id")
 		return nil, NewConnError(err, true)
 	}
 
-	// Fallback to jid domain
-	if config.Address == "" {
-		config.Address = config.parsedJid.Domain
-
-		// Fetch SRV DNS-Entries
-		_, srvEntries, err := net.LookupSRV("xmpp-client", "tcp", config.parsedJid.Domain)
-
-		if err == nil && len(srvEntries) > 0 {
-			// If we found matching DNS records, use the entry with highest weight
-			bestSrv := srvEntries[0]
-			for _, srv := range srvEntries {
-				if srv.Priority <= bestSrv.Priority && srv.Weight >= bestSrv.Weight {
-					bestSrv = srv
-					config.Address = ensurePort(srv.Target, int(srv.Port))
-				}
-			}
-		}
-	}
 	if config.Domain == "" {
 		// Fallback to jid domain
 		config.Domain = config.parsedJid.Domain
@@ -194,6 +427,18 @@ func NewClient(config *Config, r *Router, errorHandler func(error)) (c *Client,
 	c.config = config
 	c.router = r
 	c.ErrorHandler = errorHandler
+	c.sm = streamManagement{threshold: config.StreamManagementRequestThreshold,
+		interval: config.StreamManagementRequestInterval, timeout: config.StreamManagementAckTimeout}
+	if config.OfflineBuffer != nil {
+		c.offline = newOfflineBuffer(*config.OfflineBuffer)
+	}
+	if config.SMStateStore != nil && config.StreamManagementEnable {
+		config.streamManagementResume = true
+		if err = c.loadSMState(); err != nil {
+			err = fmt.Errorf("cannot load stream management state: %w", err)
+			return nil, NewConnError(err, true)
+		}
+	}
 
 	if c.config.ConnectTimeout == 0 {
 		c.config.ConnectTimeout = 15 // 15 second as default
@@ -203,11 +448,7 @@ func NewClient(config *Config, r *Router, errorHandler func(error)) (c *Client,
 		config.TransportConfiguration.Domain = config.parsedJid.Domain
 	}
 	c.config.TransportConfiguration.ConnectTimeout = c.config.ConnectTimeout
-	c.transport = NewClientTransport(c.config.TransportConfiguration)
-
-	if config.StreamLogger != nil {
-		c.transport.LogTraffic(config.StreamLogger)
-	}
+	c.transport = c.newTransport(c.config.TransportConfiguration)
 
 	return
 }
@@ -215,13 +456,22 @@ func NewClient(config *Config, r *Router, errorHandler func(error)) (c *Client,
 // Connect establishes a first time connection to a XMPP server.
 // It calls the PostConnectHook
 func (c *Client) Connect() error {
-	err := c.connect()
+	return c.ConnectContext(context.Background())
+}
+
+// ConnectContext is like Connect, but cancelling the context aborts the connection, including the
+// name resolution, TLS handshake, authentication and resource binding.
+func (c *Client) ConnectContext(ctx context.Context) error {
+	err := c.connect(ctx)
 	if err != nil {
-		return err
+		return c.failed(err)
 	}
 	// TODO: Do we always want to send initial presence automatically ?
 	// Do we need an option to avoid that or do we rely on client to send the presence itself ?
-	err = c.sendWithWriter(c.transport, []byte(InitialPresence))
+	// A session resumed from a saved state is already available.
+	if !c.Session.Resumed {
+		err = c.send(ctx, []byte(InitialPresence), nil, false, true, true)
+	}
 	// Execute the post first connection hook. Typically this holds "ask for roster" and this type of actions.
 	if c.PostConnectHook != nil {
 		err = c.PostConnectHook()
@@ -230,75 +480,386 @@ func (c *Client) Connect() error {
 		}
 	}
 
-	// Start the keepalive go routine
-	keepaliveQuit := make(chan struct{})
-	go keepalive(c.transport, c.config.KeepaliveInterval, keepaliveQuit)
-	// Start the receiver go routine
-	go c.recv(keepaliveQuit)
+	c.run()
 	return err
 }
 
+// run starts the go routines of the connection: the receiver, the keepalive and the stream
+// management ack requests.
+func (c *Client) run() {
+	quit := make(chan struct{})
+	c.recvDone = quit
+	go keepalive(c.transport, c.config.KeepaliveInterval, quit)
+	c.sm.start(c.transport, c.Send, c.ErrorHandler, quit)
+	go c.recv(c.transport, quit)
+}
+
+// stopReceiving waits for the receiving goroutine of the previous connection to stop using the
+// transport and the session, closing the connection if it is still open.
+func (c *Client) stopReceiving() {
+	done := c.recvDone
+	if done == nil {
+		return
+	}
+	select {
+	case <-done:
+	default:
+		_ = c.transport.CloseContext(canceledContext())
+		<-done
+	}
+}
+
 // connect establishes an actual TCP connection, based on previously defined parameters, as well as a XMPP session
-func (c *Client) connect() error {
+func (c *Client) connect(ctx context.Context) error {
 	var state SMState
 	var err error
-	// This is the TCP connection
-	streamId, err := c.transport.Connect()
-	if err != nil {
-		return err
+	c.managed.Store(true)
+	// The packets of the previous connection cannot be written anymore
+	c.offline.detach()
+	c.writer.Load().close(canceledContext())
+	c.writer.Store(nil)
+	c.stopReceiving()
+
+	// The stream management session is resumed on the location advertised by the server, unless the
+	// server already discarded it
+	var resumption ResumptionPath
+	var location string
+	if c.Session != nil {
+		previous := c.smState()
+		if previous.Id != "" && previous.Expired() {
+			resumption = ResumptionExpired
+			c.smMu.Lock()
+			c.Session.SMState = SMState{}
+			c.smMu.Unlock()
+			c.deleteSMState()
+		} else if previous.Id != "" {
+			resumption = ResumptionAddress
+			location = previous.Location
+		}
 	}
 
-	// Client is ok, we now open XMPP session with TLS negotiation if possible and session resume or binding
-	// depending on state.
-	if c.Session, err = NewSession(c, state); err != nil {
-		// Try to get the stream close tag from the server.
-		go func() {
-			for {
-				val, err := stanza.NextPacket(c.transport.GetDecoder())
-				if err != nil {
-					c.ErrorHandler(err)
-					c.disconnected(state)
-					return
-				}
-				switch val.(type) {
-				case stanza.StreamClosePacket:
-					// TCP messages should arrive in order, so we can expect to get nothing more after this occurs
-					c.transport.ReceivedStreamClose()
-					return
-				}
+	// This is the TCP connection
+	c.updateState(StateConnecting)
+	var streamId string
+	if location != "" {
+		if streamId, err = c.connectLocation(ctx, location); err == nil {
+			resumption = ResumptionLocation
+		} else if ctx.Err() != nil {
+			return err
+		}
+	}
+	if resumption != ResumptionLocation {
+		if c.atLocation {
+			// The location is only used to resume the session it was advertised for
+			c.transport = c.newTransport(c.config.TransportConfiguration)
+			c.atLocation = false
+		}
+		streamId, err = c.connectTransport(ctx)
+	}
+	session := c.Session
+	for redirects := 0; ; redirects++ {
+		var redirect *RedirectError
+		if err == nil {
+			// Client is ok, we now open XMPP session with TLS negotiation if possible and session resume or binding
+			// depending on state.
+			if c.Session, err = c.newSession(ctx, state); err == nil {
+				break
 			}
-		}()
-		c.Disconnect()
-		return err
+			if ctx.Err() != nil {
+				// The connection was interrupted: close it without waiting for the server
+				c.transport.CloseContext(ctx)
+				return err
+			}
+			if !errors.As(err, &redirect) {
+				// Try to get the stream close tag from the server.
+				go func(transport Transport) {
+					if err := readUntilStreamClose(transport); err != nil {
+						c.ErrorHandler(err)
+					}
+				}(c.transport)
+				c.transport.Close()
+				return err
+			}
+			// The server closes the stream after redirecting the client
+			go readUntilStreamClose(c.transport)
+			c.transport.Close()
+			c.Session = session
+		} else if !errors.As(err, &redirect) {
+			return err
+		}
+
+		if redirects == maxRedirects {
+			return NewConnError(errors.New("too many redirects, last one to "+redirect.Address), false)
+		}
+		var config TransportConfiguration
+		if config, err = c.redirectConfiguration(redirect.Address); err != nil {
+			return NewConnError(err, true)
+		}
+		c.redirected(redirect.Address)
+		c.transport = c.newTransport(config)
+		c.atLocation = false
+		c.updateState(StateConnecting)
+		streamId, err = c.transport.ConnectContext(ctx)
 	}
 	c.Session.StreamId = streamId
-	c.updateState(StateSessionEstablished)
+	c.smMu.Lock()
+	c.Session.SMState.Lost = time.Time{}
+	c.smMu.Unlock()
+	if resumption != "" && resumption != ResumptionExpired && !c.Session.Resumed {
+		resumption = ResumptionFailed
+	}
+	c.Session.Resumption = resumption
+	s := c.Session
+	unacked, ackErr := c.sm.established(s.SMState, c.config.StreamManagementEnable, s.Resumed, s.handled)
+	if ackErr != nil {
+		c.ErrorHandler(ackErr)
+	}
+	c.saveSMState(c.smState())
+	writer := newPacketWriter(c.transport, c.config.TransportConfiguration, c.sm.tracker(c.Send, c.ErrorHandler))
+	c.writer.Store(writer)
+	// The stanzas not acknowledged before the connection was lost are sent again
+	for _, stz := range unacked {
+		if err = writer.send(ctx, []byte(stz), false, false, true); err != nil {
+			err = fmt.Errorf("cannot send unacknowledged stanzas: %w", err)
+			break
+		}
+	}
+	if err == nil {
+		err = c.offline.attach(ctx, writer, c.sm.acks)
+	}
+	if err != nil {
+		// The connection was lost: the remaining stanzas are sent on the next one
+		c.ErrorHandler(err)
+		err = nil
+	}
+	c.established(s.Resumed, resumption)
 
 	return err
 }
 
+// failed notifies that the connection attempt failed with err, and returns it.
+func (c *Client) failed(err error) error {
+	var state SMState
+	if c.Session != nil {
+		state = c.Session.SMState
+	}
+	return c.connectionFailed(state, err)
+}
+
+// newSession negotiates the session on the connected transport. As the negotiation reads from
+// the transport, the connection is closed when the context is done.
+func (c *Client) newSession(ctx context.Context, state SMState) (*Session, error) {
+	transport := c.transport
+	stop := context.AfterFunc(ctx, func() {
+		_ = transport.CloseContext(ctx)
+	})
+	session, err := newSessionContext(ctx, c, state)
+	if !stop() {
+		return session, NewConnError(ctx.Err(), false)
+	}
+	return session, err
+}
+
+// connectTransport connects the transport. When no address is configured, the connection methods
+// are tried by order of preference, discovering the HTTP endpoints on each connection.
+func (c *Client) connectTransport(ctx context.Context) (string, error) {
+	if c.config.Address != "" || len(c.config.ConnectionMethods) == 0 {
+		return c.transport.ConnectContext(ctx)
+	}
+
+	var endpoints *hostMeta
+	var discovered bool
+	err := errors.New("no connection method available")
+	for _, method := range c.config.ConnectionMethods {
+		config := c.config.TransportConfiguration
+		if method != MethodTCP {
+			if !discovered {
+				discovered = true
+				discoveryCtx, cancel := context.WithTimeout(ctx, time.Duration(c.config.ConnectTimeout)*time.Second)
+				endpoints, _ = discoverHostMeta(discoveryCtx, c.config.httpClient(), c.config.parsedJid.Domain)
+				cancel()
+			}
+			switch method {
+			case MethodWebsocket:
+				config.Address = endpoints.endpoint(relWebsocket)
+			case MethodBOSH:
+				config.Address = endpoints.endpoint(relBOSH)
+			}
+			if config.Address == "" {
+				continue
+			}
+		}
+
+		transport := c.newTransport(config)
+		var streamId string
+		if streamId, err = transport.ConnectContext(ctx); err == nil {
+			c.transport = transport
+			return streamId, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if _, ok := err.(ConnError); !ok {
+		err = NewConnError(err, false)
+	}
+	return "", err
+}
+
+// connectLocation connects a transport to the location advertised by the server to resume the
+// stream management session. The location is an address, so it is only used with TCP connections.
+func (c *Client) connectLocation(ctx context.Context, location string) (string, error) {
+	if _, ok := c.transport.(*XMPPTransport); !ok || strings.Contains(location, "/") {
+		return "", errors.New("unsupported stream management location: " + location)
+	}
+	config := c.config.TransportConfiguration
+	config.Address = location
+	transport := c.newTransport(config)
+	streamId, err := transport.ConnectContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.transport = transport
+	c.atLocation = true
+	return streamId, nil
+}
+
+// newTransport creates a client transport, logging its traffic if a stream logger is configured.
+func (c *Client) newTransport(config TransportConfiguration) Transport {
+	transport := NewClientTransport(config)
+	if c.config.StreamLogger != nil {
+		transport.LogTraffic(c.config.StreamLogger)
+	}
+	return transport
+}
+
+// credential returns the credential for the next authentication attempt, from the credential
+// provider if the client has one. Set refresh when the server rejected the previous credential
+// as expired. The provider is cancelled with the connection, or after the connect timeout.
+func (c *Client) credential(ctx context.Context, refresh bool) (Credential, error) {
+	if c.config.CredentialProvider == nil {
+		c.credentialMu.RLock()
+		defer c.credentialMu.RUnlock()
+		return c.config.Credential, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.config.ConnectTimeout)*time.Second)
+	defer cancel()
+	credential, err := c.config.CredentialProvider(ctx, refresh)
+	if err != nil {
+		// The provider may be temporarily unable to get a token: let the client retry later
+		return credential, NewConnError(errors.New("credential provider: "+err.Error()), false)
+	}
+	if err = credential.validate(c.config.TLSConfig); err != nil {
+		return credential, NewConnError(err, true)
+	}
+	return credential, nil
+}
+
+// redirectConfiguration returns the configuration of the transport to the redirect address. As the
+// redirect may come from an unauthenticated stream, the new server must be in the XMPP domain,
+// unless its certificate is verified against the XMPP domain. A secure WebSocket connection
+// cannot be redirected to an insecure one.
+func (c *Client) redirectConfiguration(address string) (TransportConfiguration, error) {
+	config := c.config.TransportConfiguration
+	config.Address = address
+
+	var host string
+	switch c.transport.(type) {
+	case *XMPPTransport:
+		if strings.Contains(address, "/") {
+			return config, errors.New("invalid see-other-host address: " + address)
+		}
+		host = strings.Trim(address, "[]")
+		if h, _, err := net.SplitHostPort(address); err == nil {
+			host = h
+		}
+		if !c.config.Insecure && (config.TLSConfig == nil || !config.TLSConfig.InsecureSkipVerify) {
+			// The TLS certificate of the new server is verified against the XMPP domain
+			return config, nil
+		}
+	case *WebsocketTransport:
+		u, err := url.Parse(address)
+		if err != nil {
+			return config, errors.New("invalid see-other-uri: " + err.Error())
+		}
+		if u.Scheme != "wss" && (u.Scheme != "ws" || c.transport.IsSecure()) {
+			return config, errors.New("insecure or unsupported see-other-uri: " + address)
+		}
+		host = u.Hostname()
+	default:
+		return config, errors.New("redirect is not supported by the transport: " + address)
+	}
+
+	domain := strings.ToLower(c.config.parsedJid.Domain)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host != domain && !strings.HasSuffix(host, "."+domain) {
+		return config, fmt.Errorf("redirect to %s is outside of domain %s", host, domain)
+	}
+	return config, nil
+}
+
+// readUntilStreamClose discards incoming packets until the server closes the stream, so
+// that closing the transport does not wait for the timeout when no receiver is running.
+func readUntilStreamClose(transport Transport) error {
+	for {
+		val, err := stanza.NextPacket(transport.GetDecoder())
+		if err != nil {
+			return err
+		}
+		switch val.(type) {
+		case stanza.StreamClosePacket:
+			// TCP messages should arrive in order, so we can expect to get nothing more after this occurs
+			transport.ReceivedStreamClose()
+			return nil
+		}
+	}
+}
+
 // Resume attempts resuming  a Stream Managed session, based on the provided stream management
 // state. See XEP-0198
+// The client first connects to the location advertised by the server, if any, and falls back to
+// the configured or resolved address. When the maximum resumption time set by the server has
+// passed since the connection was lost, a new session is bound without trying to resume. The
+// Resumption field of the session established event tells which path was taken.
 func (c *Client) Resume() error {
+	return c.ResumeContext(context.Background())
+}
+
+// ResumeContext is like Resume, but cancelling the context aborts the reconnection.
+func (c *Client) ResumeContext(ctx context.Context) error {
 	c.EventManager.updateState(StateResuming)
-	err := c.connect()
+	err := c.connect(ctx)
 	if err != nil {
-		return err
+		return c.failed(err)
 	}
 	// Execute post reconnect hook. This can be different from the first connection hook, and not trigger roster retrieval
 	// for example.
 	if c.PostResumeHook != nil {
 		err = c.PostResumeHook()
 	}
+	c.run()
 	return err
 }
 
 // Disconnect disconnects the client from the server, sending a stream close nonza and closing the TCP connection.
 func (c *Client) Disconnect() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.config.ConnectTimeout)*time.Second)
+	defer cancel()
+	return c.DisconnectContext(ctx)
+}
+
+// DisconnectContext closes the stream, waiting for the server to close it until the context is done.
+func (c *Client) DisconnectContext(ctx context.Context) error {
 	if c.transport != nil {
-		err := c.transport.Close()
+		if sessionEstablished(c.CurrentState.getState()) {
+			// Closing the stream ends the stream management session
+			c.deleteSMState()
+		}
+		// Write the queued packets before closing the stream
+		c.writer.Load().close(ctx)
+		err := c.transport.CloseContext(ctx)
 		if c.Session != nil {
-			c.disconnected(c.Session.SMState)
+			c.disconnected(c.smState(), nil)
 		}
 		return err
 	}
@@ -310,28 +871,37 @@ func (c *Client) SetHandler(handler EventHandler) {
 	c.Handler = handler
 }
 
-// Send marshals XMPP stanza and sends it to the server.
+// Send marshals XMPP stanza and queues it to be sent to the server. It does not wait for the
+// packet to be written, and returns ErrSendQueueFull when too many packets are waiting.
 func (c *Client) Send(packet stanza.Packet) error {
-	conn := c.transport
-	if conn == nil {
-		return errors.New("client is not connected")
+	data, err := xml.Marshal(packet)
+	if err != nil {
+		return errors.New("cannot marshal packet " + err.Error())
 	}
+	return c.send(context.Background(), data, nil, isResponse(packet), isStanza(packet), false)
+}
 
+// SendContext is like Send, but waits for the packet to be written until the context is done.
+// The packet is dropped if it is still queued when the context is done. When the context is done
+// while the packet is being written, the connection is closed, as the stream would be corrupted.
+func (c *Client) SendContext(ctx context.Context, packet stanza.Packet) error {
 	data, err := xml.Marshal(packet)
 	if err != nil {
 		return errors.New("cannot marshal packet " + err.Error())
 	}
+	return c.send(ctx, data, nil, isResponse(packet), isStanza(packet), true)
+}
 
-	// Store stanza as non-acked as part of stream management
-	// See https://xmpp.org/extensions/xep-0198.html#scenarios
-	if c.config.StreamManagementEnable {
-		if _, ok := packet.(stanza.SMRequest); !ok {
-			toStore := stanza.UnAckedStz{Stz: string(data)}
-			c.Session.SMState.UnAckQueue.Push(&toStore)
-		}
+// SendWithAck is like Send, and calls onAck when the server acknowledges the stanza with stream
+// management (XEP-0198). onAck is called with ErrStreamManagementDisabled when stream management is
+// not enabled, or ErrStanzaNotAcked when the stanza cannot be acknowledged anymore, for example
+// when the session was not resumed after a disconnection.
+func (c *Client) SendWithAck(packet stanza.Packet, onAck AckHandler) error {
+	data, err := xml.Marshal(packet)
+	if err != nil {
+		return errors.New("cannot marshal packet " + err.Error())
 	}
-
-	return c.sendWithWriter(c.transport, data)
+	return c.send(context.Background(), data, onAck, false, true, false)
 }
 
 // SendIQ sends an IQ set or get stanza to the server. If a result is received
@@ -353,23 +923,77 @@ func (c *Client) SendIQ(ctx context.Context, iq *stanza.IQ) (chan stanza.IQ, err
 	return c.router.NewIQResultRoute(ctx, iq.Attrs.Id), nil
 }
 
-// SendRaw sends an XMPP stanza as a string to the server.
+// SendRaw queues an XMPP stanza as a string to be sent to the server.
 // It can be invalid XML or XMPP content. In that case, the server will
 // disconnect the client. It is up to the user of this method to
 // carefully craft the XML content to produce valid XMPP.
 func (c *Client) SendRaw(packet string) error {
-	conn := c.transport
-	if conn == nil {
-		return errors.New("client is not connected")
+	return c.send(context.Background(), []byte(packet), nil, false, true, false)
+}
+
+// SendRawContext is like SendRaw, but waits for the packet to be written until the context is done.
+func (c *Client) SendRawContext(ctx context.Context, packet string) error {
+	return c.send(ctx, []byte(packet), nil, false, true, true)
+}
+
+// send sends the data with the writer of the connection. When the offline buffer is enabled, the
+// stanzas sent while the client is disconnected are buffered until the next connection.
+func (c *Client) send(ctx context.Context, data []byte, onAck AckHandler, priority, track, wait bool) error {
+	if c.offline != nil && track {
+		return c.offline.send(ctx, data, onAck, priority, wait)
+	}
+	if w := c.writer.Load(); w != nil {
+		return w.enqueue(sendRequest{ctx: ctx, data: data, track: track, onAck: onAck}, priority, wait)
 	}
+	return sendDirect(ctx, c.transport, c.managed.Load(), data)
+}
+
+// loadSMState starts from the stream management state saved in the store, to resume the session.
+func (c *Client) loadSMState() error {
+	store := c.config.SMStateStore
+	jid := c.config.parsedJid.Full()
+	state, err := store.LoadSMState(jid)
+	if err != nil || state == nil {
+		return err
+	}
+	if state.Expired() {
+		return store.DeleteSMState(jid)
+	}
+	c.Session = &Session{SMState: *state}
+	return nil
+}
+
+// smState returns a copy of the stream management state of the session.
+func (c *Client) smState() SMState {
+	c.smMu.Lock()
+	defer c.smMu.Unlock()
+	return c.Session.SMState
+}
+
+// saveSMState saves the stream management state of the session in the store. The state is removed
+// when the session cannot be resumed.
+func (c *Client) saveSMState(state SMState) {
+	store := c.config.SMStateStore
+	if store == nil || c.Session == nil {
+		return
+	}
+	if state.Id == "" || !IsStreamResumable(c) {
+		c.deleteSMState()
+		return
+	}
+	state = state.snapshot()
+	state.Timestamp = time.Now()
+	if err := store.StoreSMState(c.config.parsedJid.Full(), state); err != nil {
+		c.ErrorHandler(fmt.Errorf("cannot save stream management state: %w", err))
+	}
+}
 
-	// Store stanza as non-acked as part of stream management
-	// See https://xmpp.org/extensions/xep-0198.html#scenarios
-	if c.config.StreamManagementEnable {
-		toStore := stanza.UnAckedStz{Stz: packet}
-		c.Session.SMState.UnAckQueue.Push(&toStore)
+func (c *Client) deleteSMState() {
+	if store := c.config.SMStateStore; store != nil {
+		if err := store.DeleteSMState(c.config.parsedJid.Full()); err != nil {
+			c.ErrorHandler(fmt.Errorf("cannot delete stream management state: %w", err))
+		}
 	}
-	return c.sendWithWriter(c.transport, []byte(packet))
 }
 
 func (c *Client) sendWithWriter(writer io.Writer, packet []byte) error {
@@ -382,14 +1006,22 @@ func (c *Client) sendWithWriter(writer io.Writer, packet []byte) error {
 // Go routines
 
 // Loop: Receive data from server
-func (c *Client) recv(keepaliveQuit chan<- struct{}) {
-	defer close(keepaliveQuit)
-
+// The quit channel is closed before notifying the end of the stream, as the handlers may reconnect
+// the client.
+func (c *Client) recv(transport Transport, quit chan<- struct{}) {
 	for {
-		val, err := stanza.NextPacket(c.transport.GetDecoder())
+		val, err := stanza.NextPacket(transport.GetDecoder())
 		if err != nil {
+			// The queued packets cannot be written anymore
+			c.writer.Load().close(canceledContext())
+			c.smMu.Lock()
+			c.Session.SMState.Lost = time.Now()
+			state := c.Session.SMState
+			c.smMu.Unlock()
+			c.saveSMState(state)
+			close(quit)
 			c.ErrorHandler(err)
-			c.disconnected(c.Session.SMState)
+			c.disconnected(state, err)
 			return
 		}
 
@@ -397,28 +1029,32 @@ func (c *Client) recv(keepaliveQuit chan<- struct{}) {
 		switch packet := val.(type) {
 		case stanza.StreamError:
 			c.router.route(c, val)
+			close(quit)
 			c.streamError(packet.Error.Local, packet.Text)
 			c.ErrorHandler(errors.New("stream error: " + packet.Error.Local))
-			// We don't return here, because we want to wait for the stream close tag from the server, or timeout.
-			c.Disconnect()
-		// Process Stream management nonzas
-		case stanza.SMRequest:
-			answer := stanza.SMAnswer{XMLName: xml.Name{
-				Space: stanza.NSStreamManagement,
-				Local: "a",
-			}, H: c.Session.SMState.Inbound}
-			err = c.Send(answer)
-			if err != nil {
-				c.ErrorHandler(err)
-				return
+			// The handler may already have disconnected, or reconnected, the client
+			if c.CurrentState.getState() == StateStreamError {
+				c.Disconnect()
 			}
+			return
 		case stanza.StreamClosePacket:
 			// TCP messages should arrive in order, so we can expect to get nothing more after this occurs
-			c.transport.ReceivedStreamClose()
+			transport.ReceivedStreamClose()
+			close(quit)
 			c.Disconnect()
-			continue
+			return
 		default:
-			c.Session.SMState.Inbound++
+			// Process Stream management nonzas, and count the stanzas
+			c.smMu.Lock()
+			nonza, err := c.sm.receive(&c.Session.SMState, val, c.Send)
+			state := c.Session.SMState
+			c.smMu.Unlock()
+			if err != nil {
+				c.ErrorHandler(err)
+			}
+			if nonza {
+				c.saveSMState(state)
+			}
 		}
 		// Do normal route processing in a go-routine so we can immediately
 		// start receiving other stanzas. This also allows route handlers to
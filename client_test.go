@@ -2,9 +2,19 @@ package xmpp
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"math/big"
+	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -25,7 +35,7 @@ func TestEventManager(t *testing.T) {
 		t.Fatal("CurrentState not updated by updateState()")
 	}
 
-	mgr.disconnected(SMState{})
+	mgr.disconnected(SMState{}, nil)
 
 	if mgr.CurrentState.getState() != StateDisconnected {
 		t.Fatalf("CurrentState not reset by disconnected()")
@@ -38,6 +48,117 @@ func TestEventManager(t *testing.T) {
 	}
 }
 
+func TestEventManager_Subscribe(t *testing.T) {
+	mgr := EventManager{}
+	sub := mgr.Subscribe(4)
+	full := mgr.Subscribe(1)
+
+	mgr.updateState(StateConnecting)
+	connErr := NewConnError(errors.New("not authorized"), true)
+	if err := mgr.connectionFailed(SMState{}, connErr); err != connErr {
+		t.Errorf("unexpected error returned: %v", err)
+	}
+
+	expected := []struct {
+		previous, state ConnState
+		err             error
+	}{
+		{previous: StateDisconnected, state: StateConnecting},
+		{previous: StateConnecting, state: StatePermanentError, err: connErr},
+	}
+	for _, exp := range expected {
+		e := <-sub.C
+		if e.Previous != exp.previous || e.State.getState() != exp.state || e.Err != exp.err {
+			t.Errorf("unexpected transition %d -> %d (%v)", e.Previous, e.State.getState(), e.Err)
+		}
+		if e.Time.IsZero() {
+			t.Error("event time is not set")
+		}
+	}
+
+	// The events are dropped when the buffer is full
+	if e := <-full.C; e.State.getState() != StateConnecting {
+		t.Errorf("unexpected first event state: %d", e.State.getState())
+	}
+	if full.Dropped() != 1 {
+		t.Errorf("expected 1 dropped event, got %d", full.Dropped())
+	}
+
+	// A closed subscription does not receive the events anymore
+	sub.Close()
+	mgr.updateState(StateConnecting)
+	if _, ok := <-sub.C; ok {
+		t.Error("subscription channel should be closed")
+	}
+	if e := <-full.C; e.State.getState() != StateConnecting {
+		t.Errorf("unexpected event state: %d", e.State.getState())
+	}
+	full.Close()
+}
+
+// The subscribers can follow the negotiation steps of the connection.
+func TestClient_ConnectStates(t *testing.T) {
+	mock := ServerMock{}
+	testServerAddress := fmt.Sprintf("%s:%d", testClientDomain, testClientConnectStates)
+	mock.Start(t, testServerAddress, handlerClientConnectSuccess)
+	defer mock.Stop()
+
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Address: testServerAddress,
+		},
+		Jid:        "test@localhost",
+		Credential: Password("test"),
+		Insecure:   true}
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("connect create XMPP client: %s", err)
+	}
+	sub := client.Subscribe(10)
+	defer sub.Close()
+	if err = client.Connect(); err != nil {
+		t.Fatalf("XMPP connection failed: %s", err)
+	}
+
+	previous := StateDisconnected
+	for _, state := range []ConnState{StateConnecting, StateAuthenticating, StateBinding, StateSessionEstablished} {
+		e := <-sub.C
+		if e.Previous != previous || e.State.getState() != state {
+			t.Fatalf("expected transition %d -> %d, got %d -> %d", previous, state, e.Previous, e.State.getState())
+		}
+		previous = state
+	}
+}
+
+// A failed connection attempt tells the error and the step which failed.
+func TestClient_ConnectFailureState(t *testing.T) {
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Address: fmt.Sprintf("%s:%d", testClientDomain, testClientConnectFailure),
+		},
+		Jid:        "test@localhost",
+		Credential: Password("test"),
+		Insecure:   true}
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("connect create XMPP client: %s", err)
+	}
+	sub := client.Subscribe(10)
+	defer sub.Close()
+	if err = client.Connect(); err == nil {
+		t.Fatal("connection should fail without server")
+	}
+
+	<-sub.C
+	e := <-sub.C
+	if e.Previous != StateConnecting || e.Err != err {
+		t.Errorf("unexpected failure event from %d: %v", e.Previous, e.Err)
+	}
+	if state := e.State.getState(); state != StateDisconnected && state != StatePermanentError {
+		t.Errorf("unexpected state after failure: %d", state)
+	}
+}
+
 func TestClient_Connect(t *testing.T) {
 	// Setup Mock server
 	mock := ServerMock{}
@@ -66,6 +187,112 @@ func TestClient_Connect(t *testing.T) {
 	mock.Stop()
 }
 
+// Check that a client certificate credential does not require a secret, but requires a certificate.
+func TestClient_ClientCertificateCredential(t *testing.T) {
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Address: testXMPPAddress,
+		},
+		Jid:        "test@localhost",
+		Credential: ClientCertificate(),
+	}
+	if _, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler); err == nil {
+		t.Error("client certificate credential without certificate should be rejected")
+	}
+
+	config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{{}}}
+	if _, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler); err != nil {
+		t.Errorf("client certificate credential should not require a secret: %s", err)
+	}
+}
+
+// Check that an expired token from the credential provider is refreshed and retried once,
+// when the server rejects it.
+func TestClient_CredentialProviderRefresh(t *testing.T) {
+	mock := ServerMock{}
+	mock.Start(t, testXMPPAddress, func(t *testing.T, sc *ServerConn) {
+		checkClientOpenStream(t, sc)
+		sendOAuthFeatures(t, sc)
+		if token := readAuthToken(t, sc); token != "expired-token" {
+			t.Errorf("expected expired token first, got %q", token)
+		}
+		fmt.Fprint(sc.connection, "<failure xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><not-authorized/></failure>")
+		if token := readAuthToken(t, sc); token != "fresh-token" {
+			t.Errorf("expected refreshed token, got %q", token)
+		}
+		fmt.Fprint(sc.connection, "<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>")
+
+		checkClientOpenStream(t, sc) // Reset stream
+		sendBindFeature(t, sc)       // Send post auth features
+		bind(t, sc)
+	})
+	defer mock.Stop()
+
+	var refreshes []bool
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Address: testXMPPAddress,
+		},
+		Jid: "test@localhost",
+		CredentialProvider: func(ctx context.Context, refresh bool) (Credential, error) {
+			refreshes = append(refreshes, refresh)
+			if refresh {
+				return OAuthToken("fresh-token").WithExpiry(time.Now().Add(time.Hour)), nil
+			}
+			return OAuthToken("expired-token").WithExpiry(time.Now().Add(-time.Minute)), nil
+		},
+		Insecure: true}
+
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("connect create XMPP client: %s", err)
+	}
+	if err = client.Connect(); err != nil {
+		t.Errorf("XMPP connection failed: %s", err)
+	}
+	if len(refreshes) != 2 || refreshes[0] || !refreshes[1] {
+		t.Errorf("unexpected credential provider calls: %v", refreshes)
+	}
+}
+
+// Check that a rejected credential that did not expire is not retried.
+func TestClient_CredentialProviderNoRefresh(t *testing.T) {
+	mock := ServerMock{}
+	mock.Start(t, testXMPPAddress, func(t *testing.T, sc *ServerConn) {
+		checkClientOpenStream(t, sc)
+		sendOAuthFeatures(t, sc)
+		readAuthToken(t, sc)
+		fmt.Fprint(sc.connection, "<failure xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><not-authorized/></failure>")
+		closeConn(t, sc)
+	})
+	defer mock.Stop()
+
+	calls := 0
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Address: testXMPPAddress,
+		},
+		Jid: "test@localhost",
+		CredentialProvider: func(ctx context.Context, refresh bool) (Credential, error) {
+			calls++
+			return OAuthToken("revoked-token").WithExpiry(time.Now().Add(time.Hour)), nil
+		},
+		Insecure: true}
+
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("connect create XMPP client: %s", err)
+	}
+	err = client.Connect()
+	var connErr ConnError
+	if !errors.As(err, &connErr) || !connErr.Permanent {
+		t.Errorf("expected permanent authentication error, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("credential provider should be called once, got %d calls", calls)
+	}
+}
+
 func TestClient_NoInsecure(t *testing.T) {
 	// Setup Mock server
 	mock := ServerMock{}
@@ -596,6 +823,27 @@ func handlerClientConnectWithSession(t *testing.T, sc *ServerConn) {
 	session(t, sc)
 }
 
+func sendOAuthFeatures(t *testing.T, sc *ServerConn) {
+	features := `<stream:features>
+  <mechanisms xmlns="urn:ietf:params:xml:ns:xmpp-sasl">
+    <mechanism>X-OAUTH2</mechanism>
+  </mechanisms>
+</stream:features>`
+	if _, err := fmt.Fprintln(sc.connection, features); err != nil {
+		t.Errorf("cannot send stream feature: %s", err)
+	}
+}
+
+// readAuthToken reads a SASL auth and returns the token sent with X-OAUTH2.
+func readAuthToken(t *testing.T, sc *ServerConn) string {
+	data, err := base64.StdEncoding.DecodeString(readAuth(t, sc.decoder))
+	if err != nil {
+		t.Errorf("cannot decode auth: %s", err)
+	}
+	parts := strings.Split(string(data), "\x00")
+	return parts[len(parts)-1]
+}
+
 func checkClientOpenStream(t *testing.T, sc *ServerConn) {
 	err := sc.connection.SetDeadline(time.Now().Add(defaultTimeout))
 	if err != nil {
@@ -657,3 +905,361 @@ func mockClientConnection(t *testing.T, serverHandler func(*testing.T, *ServerCo
 // It's just meant to be a placeholder when error handling is not needed at this level
 func clientDefaultErrorHandler(err error) {
 }
+
+// Check that the client negotiates TLS from the first byte in direct TLS mode, offering the
+// xmpp-client ALPN protocol, and skips STARTTLS.
+func TestClient_DirectTLS(t *testing.T) {
+	cert, pool := testCertificate(t, testClientDomain)
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"xmpp-client"}}
+	testAddress := fmt.Sprintf("%s:%d", testClientDomain, testClientDirectTLS)
+
+	mock := ServerMock{}
+	mock.StartDirectTLS(t, testAddress, serverConfig, func(t *testing.T, sc *ServerConn) {
+		tlsConn := sc.connection.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			t.Errorf("TLS handshake failed: %s", err)
+			return
+		}
+		if proto := tlsConn.ConnectionState().NegotiatedProtocol; proto != "xmpp-client" {
+			t.Errorf("unexpected ALPN protocol: %q", proto)
+		}
+		handlerClientConnectSuccess(t, sc)
+	})
+	defer mock.Stop()
+
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Address:   testAddress,
+			TLSConfig: &tls.Config{RootCAs: pool},
+			TLSMode:   TLSModeDirectTLS,
+		},
+		Jid:        "test@localhost",
+		Credential: Password("test"),
+	}
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("cannot create XMPP client: %s", err)
+	}
+	if err = client.Connect(); err != nil {
+		t.Fatalf("XMPP connection failed: %s", err)
+	}
+	if !client.transport.IsSecure() {
+		t.Error("direct TLS connection should be secure")
+	}
+}
+
+// testCertificate generates a self-signed certificate for the host, and a pool trusting it.
+func testCertificate(t *testing.T, host string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("cannot parse certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// Check that the client resolves the SRV records on connection, and tries the next server
+// when the preferred one is down.
+func TestClient_SRVFailover(t *testing.T) {
+	// Get a free port, for a server that is down
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	downPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	mock := ServerMock{}
+	mock.Start(t, fmt.Sprintf("%s:%d", testClientDomain, testClientSRVFailover), handlerClientConnectSuccess)
+	defer mock.Stop()
+
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Resolver: fakeResolver{"xmpp-client": {
+				{Target: "localhost.", Port: uint16(downPort), Priority: 1},
+				{Target: "localhost.", Port: testClientSRVFailover, Priority: 2},
+			}},
+		},
+		Jid:        "test@localhost",
+		Credential: Password("test"),
+		Insecure:   true,
+	}
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("cannot create XMPP client: %s", err)
+	}
+	if err = client.Connect(); err != nil {
+		t.Fatalf("XMPP connection failed: %s", err)
+	}
+	if config.Address != "" {
+		t.Errorf("resolved address should not be stored in the configuration: %s", config.Address)
+	}
+}
+
+// seeOtherHost returns a server handler redirecting the client to the address.
+func seeOtherHost(address string) ClientHandler {
+	return func(t *testing.T, sc *ServerConn) {
+		checkClientOpenStream(t, sc)
+		fmt.Fprintf(sc.connection, "<stream:error><see-other-host xmlns='%s'>%s</see-other-host></stream:error>%s",
+			stanza.NSStreamErrors, address, stanza.StreamClose)
+	}
+}
+
+func TestClient_SeeOtherHost(t *testing.T) {
+	target := ServerMock{}
+	target.Start(t, fmt.Sprintf("%s:%d", testClientDomain, testClientRedirectTarget), handlerClientConnectSuccess)
+	defer target.Stop()
+
+	targetAddress := fmt.Sprintf("%s:%d", testClientDomain, testClientRedirectTarget)
+	mock := ServerMock{}
+	address := fmt.Sprintf("%s:%d", testClientDomain, testClientRedirect)
+	mock.Start(t, address, seeOtherHost(targetAddress))
+	defer mock.Stop()
+
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Address: address,
+		},
+		Jid:        "test@localhost",
+		Credential: Password("test"),
+		Insecure:   true,
+	}
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("cannot create XMPP client: %s", err)
+	}
+	var notifications []Notification
+	client.NotificationHandler = func(n Notification) {
+		notifications = append(notifications, n)
+	}
+
+	// The client connection fails if the redirect is not followed
+	if err = client.Connect(); err != nil {
+		t.Fatalf("XMPP connection failed: %s", err)
+	}
+	if client.Session.BindJid == "" {
+		t.Error("session should be established on the redirect target")
+	}
+	if len(notifications) != 1 || notifications[0].Redirect != targetAddress {
+		t.Errorf("client should be notified of the redirect: %+v", notifications)
+	}
+}
+
+func TestClient_SeeOtherHostOutsideDomain(t *testing.T) {
+	err := connectRedirected(t, seeOtherHost(fmt.Sprintf("127.0.0.1:%d", testClientRedirectTarget)), testClientRedirect)
+	if err == nil || !strings.Contains(err.Error(), "outside of domain") {
+		t.Errorf("redirect outside of the domain without TLS verification should fail, got %v", err)
+	}
+}
+
+func TestClient_RedirectLoop(t *testing.T) {
+	address := fmt.Sprintf("%s:%d", testClientDomain, testClientRedirectLoop)
+	err := connectRedirected(t, seeOtherHost(address), testClientRedirectLoop)
+	if err == nil || !strings.Contains(err.Error(), "too many redirects") {
+		t.Errorf("redirect loop should be detected, got %v", err)
+	}
+}
+
+// connectRedirected connects a client to a server redirecting it, and returns the connection error.
+func connectRedirected(t *testing.T, handler ClientHandler, port int) error {
+	mock := ServerMock{}
+	address := fmt.Sprintf("%s:%d", testClientDomain, port)
+	mock.Start(t, address, handler)
+	defer mock.Stop()
+
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Address: address,
+		},
+		Jid:        "test@localhost",
+		Credential: Password("test"),
+		Insecure:   true,
+	}
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("cannot create XMPP client: %s", err)
+	}
+	return client.Connect()
+}
+
+// waitClose reads from the connection until the client closes it.
+func waitClose(sc *ServerConn) {
+	for {
+		if _, err := sc.decoder.Token(); err != nil {
+			return
+		}
+	}
+}
+
+func TestClient_ConnectContextCancelsAuthentication(t *testing.T) {
+	mock := ServerMock{}
+	address := fmt.Sprintf("%s:%d", testClientDomain, testClientConnectContext)
+	mock.Start(t, address, func(t *testing.T, sc *ServerConn) {
+		checkClientOpenStream(t, sc)
+		sendStreamFeatures(t, sc)
+		readAuth(t, sc.decoder)
+		// Never answer the authentication
+		waitClose(sc)
+	})
+	defer mock.Stop()
+
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Address: address,
+		},
+		Jid:        "test@localhost",
+		Credential: Password("test"),
+		Insecure:   true,
+	}
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("cannot create XMPP client: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = client.ConnectContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("connection should be aborted by the context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("connection was not aborted on time: %s", elapsed)
+	}
+}
+
+func TestClient_ConnectContextCancelsCredentialProvider(t *testing.T) {
+	mock := ServerMock{}
+	address := fmt.Sprintf("%s:%d", testClientDomain, testClientCredentialContext)
+	mock.Start(t, address, func(t *testing.T, sc *ServerConn) {
+		checkClientOpenStream(t, sc)
+		sendStreamFeatures(t, sc)
+		waitClose(sc)
+	})
+	defer mock.Stop()
+
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Address: address,
+		},
+		Jid:      "test@localhost",
+		Insecure: true,
+		// The provider waits for the connection to be cancelled
+		CredentialProvider: func(ctx context.Context, refresh bool) (Credential, error) {
+			<-ctx.Done()
+			return Credential{}, ctx.Err()
+		},
+	}
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("cannot create XMPP client: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err = client.ConnectContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("connection should be aborted by the context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("credential provider was not cancelled on time: %s", elapsed)
+	}
+}
+
+func TestTransport_ConnectContextCancelsStreamOpen(t *testing.T) {
+	mock := ServerMock{}
+	address := fmt.Sprintf("%s:%d", testClientDomain, testClientOpenContext)
+	// The server never opens the stream
+	mock.Start(t, address, func(t *testing.T, sc *ServerConn) {
+		waitClose(sc)
+	})
+	defer mock.Stop()
+
+	transport := NewClientTransport(TransportConfiguration{Address: address, Domain: "localhost", ConnectTimeout: 15})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := transport.ConnectContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("stream opening should be cancelled, got %v", err)
+	}
+}
+
+func TestClient_SendContextDone(t *testing.T) {
+	client, mock := mockClientConnection(t, func(t *testing.T, sc *ServerConn) {
+		handlerClientConnectSuccess(t, sc)
+		closeConn(t, sc)
+	}, testClientBasePort)
+	defer mock.Stop()
+	defer client.Disconnect()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	msg := stanza.NewMessage(stanza.Attrs{To: "test@localhost"})
+	if err := client.SendContext(ctx, msg); !errors.Is(err, context.Canceled) {
+		t.Errorf("send with a cancelled context should fail, got %v", err)
+	}
+	if err := client.SendRawContext(ctx, "<presence/>"); !errors.Is(err, context.Canceled) {
+		t.Errorf("raw send with a cancelled context should fail, got %v", err)
+	}
+	if err := client.SendContext(context.Background(), msg); err != nil {
+		t.Errorf("send should still work after a cancelled send: %s", err)
+	}
+}
+
+// Stanzas cannot be sent while the stream is negotiated, as they would be mixed with it.
+func TestClient_SendDuringConnect(t *testing.T) {
+	clients := make(chan *Client, 1)
+	mock := ServerMock{}
+	address := fmt.Sprintf("%s:%d", testClientDomain, testClientSendDuringConnect)
+	mock.Start(t, address, func(t *testing.T, sc *ServerConn) {
+		client := <-clients
+		checkClientOpenStream(t, sc)
+		sendStreamFeatures(t, sc)
+		readAuth(t, sc.decoder)
+		msg := stanza.NewMessage(stanza.Attrs{To: "test@localhost"})
+		if err := client.Send(msg); !errors.Is(err, ErrNotConnected) {
+			t.Errorf("send during the negotiation should fail, got %v", err)
+		}
+		sc.connection.Write([]byte("<success xmlns=\"urn:ietf:params:xml:ns:xmpp-sasl\"/>"))
+
+		checkClientOpenStream(t, sc)
+		sendBindFeature(t, sc)
+		bind(t, sc)
+	})
+	defer mock.Stop()
+
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Address: address,
+		},
+		Jid:        "test@localhost",
+		Credential: Password("test"),
+		Insecure:   true,
+	}
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("cannot create XMPP client: %s", err)
+	}
+	clients <- client
+	if err = client.Connect(); err != nil {
+		t.Errorf("XMPP connection failed: %s", err)
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"gosrc.io/xmpp/stanza"
 	"io"
+	"sync/atomic"
+	"time"
 )
 
 type ComponentOptions struct {
@@ -21,6 +23,10 @@ type ComponentOptions struct {
 	Domain string
 	// Secret is the "password" used by the XMPP server to secure component access
 	Secret string
+	// Credential can be set to ClientCertificate() to authenticate the component with a
+	// TLS client certificate, using SASL EXTERNAL over a jabber:component:connect stream
+	// (XEP-0225) instead of the XEP-0114 handshake. Secret is ignored in that case.
+	Credential Credential
 
 	// =================================
 	// Component discovery
@@ -31,6 +37,23 @@ type ComponentOptions struct {
 	Category string
 	Type     string
 
+	// =================================
+	// Stream management (XEP-0198)
+
+	// StreamManagementEnable enables stream management on the component stream, for servers
+	// supporting it on component connections. Resumption is requested, and the session is resumed
+	// after the connection is lost when the server accepted it.
+	StreamManagementEnable bool
+	// StreamManagementRequestInterval is the interval between the stream management ack requests,
+	// sent while stanzas are not acknowledged. Disabled when 0.
+	StreamManagementRequestInterval time.Duration
+	// StreamManagementRequestThreshold is the number of stanzas sent before requesting an ack.
+	// Disabled when 0.
+	StreamManagementRequestThreshold int
+	// StreamManagementAckTimeout is the time to wait for the answer to an ack request. The connection
+	// is considered dead and closed after it. Disabled when 0.
+	StreamManagementAckTimeout time.Duration
+
 	// =================================
 	// Communication with developer client / StreamManager
 
@@ -46,6 +69,15 @@ type Component struct {
 	router *Router
 
 	transport Transport
+	// writer writes the packets of the connection, from a bounded queue
+	writer atomic.Pointer[packetWriter]
+	// managed is set once the connection is managed by Connect or Resume
+	managed atomic.Bool
+	// SMState is the stream management state of the session, when stream management is enabled.
+	// It is kept to resume the session after the connection is lost.
+	SMState SMState
+	// sm tracks the stanzas until the server acknowledges them, with stream management
+	sm streamManagement
 
 	// read / write
 	socketProxy  io.ReadWriter // TODO
@@ -54,6 +86,8 @@ type Component struct {
 
 func NewComponent(opts ComponentOptions, r *Router, errorHandler func(error)) (*Component, error) {
 	c := Component{ComponentOptions: opts, router: r, ErrorHandler: errorHandler}
+	c.sm = streamManagement{threshold: opts.StreamManagementRequestThreshold,
+		interval: opts.StreamManagementRequestInterval, timeout: opts.StreamManagementAckTimeout}
 	return &c, nil
 }
 
@@ -63,34 +97,82 @@ func (c *Component) Connect() error {
 	return c.Resume()
 }
 
+// ConnectContext is like Connect, but cancelling the context aborts the connection and the
+// authentication.
+func (c *Component) ConnectContext(ctx context.Context) error {
+	return c.ResumeContext(ctx)
+}
+
 func (c *Component) Resume() error {
+	return c.ResumeContext(context.Background())
+}
+
+// ResumeContext is like Resume, but cancelling the context aborts the connection and the
+// authentication.
+func (c *Component) ResumeContext(ctx context.Context) error {
 	var err error
+	c.managed.Store(true)
+	// The packets of the previous connection cannot be written anymore
+	c.writer.Load().close(canceledContext())
+	c.writer.Store(nil)
 	var streamId string
 	if c.ComponentOptions.TransportConfiguration.Domain == "" {
 		c.ComponentOptions.TransportConfiguration.Domain = c.ComponentOptions.Domain
 	}
-	c.transport, err = NewComponentTransport(c.ComponentOptions.TransportConfiguration)
+	if c.Credential.isExternal() {
+		c.transport, err = newComponentConnectTransport(c.ComponentOptions.TransportConfiguration)
+	} else {
+		c.transport, err = NewComponentTransport(c.ComponentOptions.TransportConfiguration)
+	}
 	if err != nil {
-		c.updateState(StatePermanentError)
-		return NewConnError(err, true)
+		return c.connectionFailed(c.SMState, NewConnError(err, true))
 	}
 
-	if streamId, err = c.transport.Connect(); err != nil {
-		c.updateState(StatePermanentError)
-		return NewConnError(err, true)
+	c.updateState(StateConnecting)
+	if streamId, err = c.transport.ConnectContext(ctx); err != nil {
+		// The transport tells whether the connection can be retried
+		return c.connectionFailed(c.SMState, err)
+	}
+
+	// The authentication reads from the transport: the connection is closed when the context is done
+	transport := c.transport
+	stop := context.AfterFunc(ctx, func() {
+		_ = transport.CloseContext(ctx)
+	})
+	err = c.authenticate(streamId)
+	var resumption ResumptionPath
+	var handled *uint
+	if err == nil {
+		resumption, handled, err = c.negotiateStreamManagement()
+	}
+	if !stop() {
+		return c.connectionFailed(c.SMState, NewConnError(ctx.Err(), false))
+	}
+	if err != nil {
+		return c.connectionFailed(c.SMState, err)
+	}
+	c.start(ctx, resumption, handled)
+	return nil
+}
+
+// authenticate authenticates the component on the opened stream.
+func (c *Component) authenticate(streamId string) error {
+	if c.Credential.isExternal() {
+		if err := c.authExternal(); err != nil {
+			return NewConnError(err, true)
+		}
+		return nil
 	}
 
 	// Authentication
+	c.updateState(StateAuthenticating)
 	if err := c.sendWithWriter(c.transport, []byte(fmt.Sprintf("<handshake>%s</handshake>", c.handshake(streamId)))); err != nil {
-		c.updateState(StateStreamError)
-
 		return NewConnError(errors.New("cannot send handshake "+err.Error()), false)
 	}
 
 	// Check server response for authentication
 	val, err := stanza.NextPacket(c.transport.GetDecoder())
 	if err != nil {
-		c.updateState(StatePermanentError)
 		return NewConnError(err, true)
 	}
 
@@ -99,35 +181,134 @@ func (c *Component) Resume() error {
 		c.streamError("conflict", "no auth loop")
 		return NewConnError(errors.New("handshake failed "+v.Error.Local), true)
 	case stanza.Handshake:
-		// Start the receiver go routine
-		c.updateState(StateSessionEstablished)
-		go c.recv()
-		return err // Should be empty at this point
+		return nil
 	default:
-		c.updateState(StatePermanentError)
 		return NewConnError(errors.New("expecting handshake result, got "+v.Name()), true)
 	}
 }
 
+// negotiateStreamManagement resumes the stream management session of the previous connection, or
+// enables stream management on the authenticated stream, when it is enabled. It tells how the
+// session was resumed, and returns the number of stanzas handled by the server when it sent it.
+func (c *Component) negotiateStreamManagement() (ResumptionPath, *uint, error) {
+	if !c.StreamManagementEnable {
+		return "", nil, nil
+	}
+	var resumption ResumptionPath
+	state := c.SMState
+	if state.Id != "" {
+		resumption = ResumptionFailed
+		if state.Expired() {
+			resumption, state = ResumptionExpired, SMState{}
+		}
+	}
+
+	n, err := negotiateSM(c.transport, state, true, true, nil)
+	if err != nil {
+		return "", nil, NewConnError(err, n.failed)
+	}
+	if n.resumed {
+		return ResumptionAddress, n.handled, nil
+	}
+	if !n.resumable {
+		// The id is only used to resume the session
+		n.state.Id = ""
+	}
+	c.SMState = n.state
+	return resumption, n.handled, nil
+}
+
+// start starts the writer and the receiver of the authenticated stream. The stanzas not
+// acknowledged before the connection was lost are sent again when the session is resumed.
+func (c *Component) start(ctx context.Context, resumption ResumptionPath, handled *uint) {
+	c.SMState.Lost = time.Time{}
+	resumed := resumption == ResumptionAddress
+	unacked, err := c.sm.established(c.SMState, c.StreamManagementEnable, resumed, handled)
+	if err != nil {
+		c.ErrorHandler(err)
+	}
+	writer := newPacketWriter(c.transport, c.ComponentOptions.TransportConfiguration, c.sm.tracker(c.Send, c.ErrorHandler))
+	c.writer.Store(writer)
+	for _, stz := range unacked {
+		if err = writer.send(ctx, []byte(stz), false, false, true); err != nil {
+			// The connection was lost: the remaining stanzas are sent on the next one
+			c.ErrorHandler(fmt.Errorf("cannot send unacknowledged stanzas: %w", err))
+			break
+		}
+	}
+	c.established(resumed, resumption)
+
+	quit := make(chan struct{})
+	c.sm.start(c.transport, c.Send, c.ErrorHandler, quit)
+	go c.recv(quit)
+}
+
+// authExternal negotiates TLS and authenticates the component with SASL EXTERNAL,
+// as defined in XEP-0225.
+func (c *Component) authExternal() error {
+	s := &Session{transport: c.transport}
+	s.init()
+	// TLS is mandatory, as the client certificate is our credential
+	c.updateState(StateTLSNegotiating)
+	s.startTlsIfSupported(&Config{})
+	if s.err != nil {
+		return s.err
+	}
+	s.reset()
+	if s.err != nil {
+		return s.err
+	}
+	c.updateState(StateAuthenticating)
+	if err := authSASL(c.transport, c.transport.GetDecoder(), s.Features, "", c.Credential); err != nil {
+		return err
+	}
+	s.reset()
+	return s.err
+}
+
 func (c *Component) Disconnect() error {
 	// TODO: Add a way to wait for stream close acknowledgement from the server for clean disconnect
 	if c.transport != nil {
+		// Write the queued packets before closing the stream
+		timeout := time.Duration(c.ConnectTimeout) * time.Second
+		if timeout <= 0 {
+			timeout = 15 * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		c.writer.Load().close(ctx)
 		return c.transport.Close()
 	}
 	// No transport so no connection.
 	return nil
 }
 
+// DisconnectContext closes the stream, waiting for the server to close it until the context is done.
+func (c *Component) DisconnectContext(ctx context.Context) error {
+	if c.transport != nil {
+		// Write the queued packets before closing the stream
+		c.writer.Load().close(ctx)
+		return c.transport.CloseContext(ctx)
+	}
+	// No transport so no connection.
+	return nil
+}
+
 func (c *Component) SetHandler(handler EventHandler) {
 	c.Handler = handler
 }
 
 // Receiver Go routine receiver
-func (c *Component) recv() {
+func (c *Component) recv(quit chan<- struct{}) {
+	defer close(quit)
+
 	for {
 		val, err := stanza.NextPacket(c.transport.GetDecoder())
 		if err != nil {
-			c.updateState(StateDisconnected)
+			// The queued packets cannot be written anymore
+			c.writer.Load().close(canceledContext())
+			c.SMState.Lost = time.Now()
+			c.disconnected(c.SMState, err)
 			c.ErrorHandler(err)
 			return
 		}
@@ -143,29 +324,61 @@ func (c *Component) recv() {
 			// TCP messages should arrive in order, so we can expect to get nothing more after this occurs
 			c.transport.ReceivedStreamClose()
 			return
+		default:
+			// Process Stream management nonzas, and count the stanzas
+			if _, err = c.sm.receive(&c.SMState, val, c.Send); err != nil {
+				c.ErrorHandler(err)
+			}
 		}
 		c.router.route(c, val)
 	}
 }
 
-// Send marshalls XMPP stanza and sends it to the server.
+// Send marshalls XMPP stanza and queues it to be sent to the server. It does not wait for the
+// packet to be written, and returns ErrSendQueueFull when too many packets are waiting.
 func (c *Component) Send(packet stanza.Packet) error {
-	transport := c.transport
-	if transport == nil {
-		return errors.New("component is not connected")
+	data, err := xml.Marshal(packet)
+	if err != nil {
+		return errors.New("cannot marshal packet " + err.Error())
 	}
+	return c.send(context.Background(), data, nil, isResponse(packet), isStanza(packet), false)
+}
 
+// SendContext is like Send, but waits for the packet to be written until the context is done.
+// The packet is dropped if it is still queued when the context is done. When the context is done
+// while the packet is being written, the connection is closed, as the stream would be corrupted.
+func (c *Component) SendContext(ctx context.Context, packet stanza.Packet) error {
 	data, err := xml.Marshal(packet)
 	if err != nil {
 		return errors.New("cannot marshal packet " + err.Error())
 	}
 
-	if err := c.sendWithWriter(transport, data); err != nil {
-		return errors.New("cannot send packet " + err.Error())
+	if err := c.send(ctx, data, nil, isResponse(packet), isStanza(packet), true); err != nil {
+		return fmt.Errorf("cannot send packet: %w", err)
 	}
 	return nil
 }
 
+// SendWithAck is like Send, and calls onAck when the server acknowledges the stanza with stream
+// management (XEP-0198). onAck is called with ErrStreamManagementDisabled when stream management is
+// not enabled, or ErrStanzaNotAcked when the stanza cannot be acknowledged anymore, for example
+// when the session was not resumed after a disconnection.
+func (c *Component) SendWithAck(packet stanza.Packet, onAck AckHandler) error {
+	data, err := xml.Marshal(packet)
+	if err != nil {
+		return errors.New("cannot marshal packet " + err.Error())
+	}
+	return c.send(context.Background(), data, onAck, false, true, false)
+}
+
+// send sends the data with the writer of the connection.
+func (c *Component) send(ctx context.Context, data []byte, onAck AckHandler, priority, track, wait bool) error {
+	if w := c.writer.Load(); w != nil {
+		return w.enqueue(sendRequest{ctx: ctx, data: data, track: track, onAck: onAck}, priority, wait)
+	}
+	return sendDirect(ctx, c.transport, c.managed.Load(), data)
+}
+
 func (c *Component) sendWithWriter(writer io.Writer, packet []byte) error {
 	var err error
 	_, err = writer.Write(packet)
@@ -191,19 +404,17 @@ func (c *Component) SendIQ(ctx context.Context, iq *stanza.IQ) (chan stanza.IQ,
 	return c.router.NewIQResultRoute(ctx, iq.Attrs.Id), nil
 }
 
-// SendRaw sends an XMPP stanza as a string to the server.
+// SendRaw queues an XMPP stanza as a string to be sent to the server.
 // It can be invalid XML or XMPP content. In that case, the server will
 // disconnect the component. It is up to the user of this method to
 // carefully craft the XML content to produce valid XMPP.
 func (c *Component) SendRaw(packet string) error {
-	transport := c.transport
-	if transport == nil {
-		return errors.New("component is not connected")
-	}
+	return c.send(context.Background(), []byte(packet), nil, false, true, false)
+}
 
-	var err error
-	err = c.sendWithWriter(transport, []byte(packet))
-	return err
+// SendRawContext is like SendRaw, but waits for the packet to be written until the context is done.
+func (c *Component) SendRawContext(ctx context.Context, packet string) error {
+	return c.send(ctx, []byte(packet), nil, false, true, true)
 }
 
 // handshake generates an authentication token based on StreamID and shared secret.
@@ -5,7 +5,9 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -308,7 +310,8 @@ func TestSendRaw(t *testing.T) {
 					t.Errorf("This test is not supposed to err ! => %s", err.Error())
 				}
 			}
-			c.transport.Close()
+			// Sends are asynchronous: disconnecting writes the queued packets first
+			c.Disconnect()
 			select {
 			case <-done:
 				m.Stop()
@@ -364,6 +367,194 @@ func TestStreamManagerDisconnect(t *testing.T) {
 	mock.Stop()
 }
 
+// The component enables stream management, answers the ack requests of the server, and resumes the
+// session after the connection is lost, sending the unacknowledged stanzas again.
+func TestComponentStreamManagement(t *testing.T) {
+	serverDone := make(chan struct{})
+	var connections atomic.Int32
+	address := fmt.Sprintf("%s:%d", testComponentDomain, testComponentStreamManagement)
+	mock := ServerMock{}
+	mock.Start(t, address, func(t *testing.T, sc *ServerConn) {
+		first := connections.Add(1) == 1
+		handlerForComponentHandshakeDefaultID(t, sc)
+		if first {
+			var enable stanza.SMEnable
+			if se, err := stanza.NextStart(sc.decoder); err != nil || se.Name.Local != "enable" {
+				t.Errorf("cannot read enable request: %v", err)
+				return
+			} else if err = sc.decoder.DecodeElement(&enable, &se); err != nil || enable.Resume == nil || !*enable.Resume {
+				t.Errorf("expected enable request with resumption, got %#v", enable)
+				return
+			}
+			fmt.Fprintf(sc.connection, "<enabled xmlns='urn:xmpp:sm:3' id='%s' resume='true' max='300'/>", streamManagementID)
+			fmt.Fprintf(sc.connection, "<message to='%s' id='in1'/>", testComponentDomain)
+			for i := 0; i < 2; i++ {
+				if _, err := stanza.NextPacket(sc.decoder); err != nil {
+					t.Errorf("cannot read message: %s", err)
+					return
+				}
+			}
+			// Only the first message is handled before the connection is lost
+			fmt.Fprintf(sc.connection, "<a xmlns='urn:xmpp:sm:3' h='1'/><r xmlns='urn:xmpp:sm:3'/>")
+			if p, err := stanza.NextPacket(sc.decoder); err != nil {
+				t.Errorf("cannot read ack: %s", err)
+			} else if a, ok := p.(stanza.SMAnswer); !ok || a.H != 1 {
+				t.Errorf("expected ack of the received message, got %#v", p)
+			}
+			sc.connection.Close()
+			return
+		}
+
+		defer close(serverDone)
+		p, err := stanza.NextPacket(sc.decoder)
+		if err != nil {
+			t.Errorf("cannot read resume request: %s", err)
+			return
+		}
+		if r, ok := p.(stanza.SMResume); !ok || r.PrevId != streamManagementID || r.H == nil || *r.H != 1 {
+			t.Errorf("unexpected resume request: %#v", p)
+			return
+		}
+		fmt.Fprintf(sc.connection, "<resumed xmlns='urn:xmpp:sm:3' previd='%s' h='1'/>", streamManagementID)
+		if p, err = stanza.NextPacket(sc.decoder); err != nil {
+			t.Errorf("cannot read resent message: %s", err)
+		} else if msg, ok := p.(stanza.Message); !ok || msg.Id != "m2" {
+			t.Errorf("expected second message to be sent again, got %#v", p)
+		}
+	})
+	defer mock.Stop()
+
+	c := makeBasicComponent(defaultComponentName, address, t)
+	c.StreamManagementEnable = true
+	if err := c.Connect(); err != nil {
+		t.Fatalf("cannot connect component: %s", err)
+	}
+	acked := make(chan error, 2)
+	for _, id := range []string{"m1", "m2"} {
+		if err := c.SendWithAck(stanza.Message{Attrs: stanza.Attrs{Id: id}}, func(err error) { acked <- err }); err != nil {
+			t.Fatalf("cannot send message: %s", err)
+		}
+	}
+	select {
+	case err := <-acked:
+		if err != nil {
+			t.Errorf("first message should be acknowledged: %s", err)
+		}
+	case <-time.After(defaultChannelTimeout):
+		t.Fatal("first message was not acknowledged")
+	}
+
+	deadline := time.Now().Add(defaultChannelTimeout)
+	for c.CurrentState.getState() != StateDisconnected {
+		if time.Now().After(deadline) {
+			t.Fatal("component should be disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := c.Resume(); err != nil {
+		t.Fatalf("cannot resume session: %s", err)
+	}
+	waitForEntity(t, serverDone)
+	if c.SMState.Id != streamManagementID || c.SMState.Inbound != 1 {
+		t.Errorf("unexpected stream management state: %+v", c.SMState)
+	}
+}
+
+// The stream manager connects the component, and reconnects it after the connection is lost.
+func TestStreamManagerComponent(t *testing.T) {
+	var connections atomic.Int32
+	address := fmt.Sprintf("%s:%d", testComponentDomain, testSManComponentPort)
+	mock := ServerMock{}
+	mock.Start(t, address, func(t *testing.T, sc *ServerConn) {
+		handlerForComponentHandshakeDefaultID(t, sc)
+		if connections.Add(1) == 1 {
+			sc.connection.Close()
+		}
+	})
+	defer mock.Stop()
+
+	c := makeBasicComponent(defaultComponentName, address, t)
+	connected := make(chan Sender, 2)
+	cm := NewStreamManager(c, func(s Sender) { connected <- s })
+	errChan := make(chan error)
+	go func() {
+		errChan <- cm.Run()
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-connected:
+			if s != c {
+				t.Errorf("post connect hook called with %v", s)
+			}
+		case err := <-errChan:
+			t.Fatalf("stream manager stopped: %v", err)
+		case <-time.After(defaultChannelTimeout):
+			t.Fatalf("component not connected %d times", i+1)
+		}
+	}
+	cm.Stop()
+	if err := <-errChan; err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+// flakyDialer fails the dials following the first one, failures times.
+type flakyDialer struct {
+	dials    atomic.Int32
+	failures int32
+}
+
+func (d *flakyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if n := d.dials.Add(1); n > 1 && n <= d.failures+1 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+// The stream manager keeps reconnecting the component while the server cannot be reached.
+func TestStreamManagerComponent_DialFailures(t *testing.T) {
+	var connections atomic.Int32
+	address := fmt.Sprintf("%s:%d", testComponentDomain, testSManDialFailures)
+	mock := ServerMock{}
+	mock.Start(t, address, func(t *testing.T, sc *ServerConn) {
+		handlerForComponentHandshakeDefaultID(t, sc)
+		if connections.Add(1) == 1 {
+			sc.connection.Close()
+		}
+	})
+	defer mock.Stop()
+
+	c := makeBasicComponent(defaultComponentName, address, t)
+	dialer := &flakyDialer{failures: 3}
+	c.ComponentOptions.TransportConfiguration.Dialer = dialer
+	connected := make(chan struct{}, 2)
+	cm := NewStreamManager(c, func(s Sender) { connected <- struct{}{} })
+	cm.Clock = &fakeClock{now: time.Now()}
+	errChan := make(chan error)
+	go func() {
+		errChan <- cm.Run()
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-connected:
+		case err := <-errChan:
+			t.Fatalf("stream manager stopped: %v", err)
+		case <-time.After(defaultChannelTimeout):
+			t.Fatalf("component not connected %d times", i+1)
+		}
+	}
+	if dials := dialer.dials.Load(); dials != dialer.failures+2 {
+		t.Errorf("expected %d dials, got %d", dialer.failures+2, dials)
+	}
+	cm.Stop()
+	if err := <-errChan; err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
 //=============================================================================
 // Basic XMPP Server Mock Handlers.
 
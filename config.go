@@ -21,11 +21,42 @@ type Config struct {
 	// Insecure can be set to true to allow to open a session without TLS. If TLS
 	// is supported on the server, we will still try to use it.
 	Insecure bool
+	// CredentialProvider, when set, is called before each authentication to get the credential,
+	// instead of using Credential.
+	CredentialProvider CredentialProvider
+	// ConnectionMethods are tried by order of preference to connect, when Address is empty.
+	// WebSocket and BOSH endpoints are discovered through the domain host-meta (XEP-0156).
+	// Default to TCP only.
+	ConnectionMethods []ConnectionMethod
 
 	// Activate stream management process during session
 	StreamManagementEnable bool
 	// Enable stream management resume capability
 	streamManagementResume bool
+	// StreamManagementRequestInterval is the interval between the stream management ack requests,
+	// sent while stanzas are not acknowledged. Disabled when 0.
+	StreamManagementRequestInterval time.Duration
+	// StreamManagementRequestThreshold is the number of stanzas sent before requesting an ack.
+	// Disabled when 0.
+	StreamManagementRequestThreshold int
+	// StreamManagementAckTimeout is the time to wait for the answer to an ack request. The connection
+	// is considered dead and closed after it. Disabled when 0.
+	StreamManagementAckTimeout time.Duration
+	// SMStateStore saves the stream management state, to resume the session after the process
+	// restarts. Resumption is requested when it is set. Optional.
+	SMStateStore SMStateStore
+
+	// DisableSASL2 forces the legacy SASL authentication, even when the server supports SASL2 (XEP-0388)
+	DisableSASL2 bool
+	// UserAgent identifies the client software and device during SASL2 authentication. Optional.
+	UserAgent *stanza.SASL2UserAgent
+	// TokenStore enables FAST token authentication (XEP-0484) with SASL2: tokens issued by the server
+	// are saved in the store, and used on the next connections before falling back to Credential.
+	// It requires a UserAgent with a stable id.
+	TokenStore TokenStore
+	// OfflineBuffer enables the buffering of the stanzas sent while the client is disconnected,
+	// to send them after reconnecting. Disabled when nil.
+	OfflineBuffer *OfflineBufferConfig
 }
 
 // IsStreamResumable tells if a stream session is resumable by reading the "config" part of a client.
@@ -0,0 +1,97 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ============================================================================
+// Discovering Alternative XMPP Connection Methods
+// Reference: XEP-0156 - https://xmpp.org/extensions/xep-0156.html
+
+// ConnectionMethod is a way to connect to the server. When no address is configured, the
+// client tries the connection methods by order of preference.
+type ConnectionMethod uint8
+
+const (
+	// MethodTCP connects with the XMPP TCP transport, resolving the server from the SRV records.
+	MethodTCP ConnectionMethod = iota
+	// MethodWebsocket connects with the WebSocket endpoint discovered through host-meta.
+	MethodWebsocket
+	// MethodBOSH connects with the BOSH endpoint discovered through host-meta.
+	MethodBOSH
+)
+
+const (
+	relWebsocket = "urn:xmpp:alt-connections:websocket"
+	relBOSH      = "urn:xmpp:alt-connections:xbosh"
+)
+
+// hostMeta is the host-meta document of a domain, in XML (XRD) or JSON (JRD) format.
+type hostMeta struct {
+	XMLName xml.Name       `xml:"http://docs.oasis-open.org/ns/xri/xrd-1.0 XRD" json:"-"`
+	Links   []hostMetaLink `xml:"Link" json:"links"`
+}
+
+type hostMetaLink struct {
+	Rel  string `xml:"rel,attr" json:"rel"`
+	Href string `xml:"href,attr" json:"href"`
+}
+
+// endpoint returns the first link of the relation type. Only encrypted endpoints are used, as
+// the host-meta document may be served from another host than the XMPP server.
+func (h *hostMeta) endpoint(rel string) string {
+	if h == nil {
+		return ""
+	}
+	for _, link := range h.Links {
+		if link.Rel == rel && (strings.HasPrefix(link.Href, "wss://") || strings.HasPrefix(link.Href, "https://")) {
+			return link.Href
+		}
+	}
+	return ""
+}
+
+// discoverHostMeta fetches the host-meta document of the domain, trying the JSON format first,
+// then the XML format.
+func discoverHostMeta(ctx context.Context, client *http.Client, domain string) (*hostMeta, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	h, err := fetchHostMeta(ctx, client, "https://"+domain+"/.well-known/host-meta.json", json.Unmarshal)
+	if err == nil {
+		return h, nil
+	}
+	return fetchHostMeta(ctx, client, "https://"+domain+"/.well-known/host-meta", xml.Unmarshal)
+}
+
+func fetchHostMeta(ctx context.Context, client *http.Client, url string, unmarshal func([]byte, interface{}) error) (*hostMeta, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("host-meta: unexpected HTTP status: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPacketSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var h hostMeta
+	if err = unmarshal(data, &h); err != nil {
+		return nil, errors.New("host-meta: " + err.Error())
+	}
+	return &h, nil
+}
@@ -0,0 +1,98 @@
+package xmpp
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testHostMetaXML = `<?xml version='1.0' encoding='utf-8'?>
+<XRD xmlns='http://docs.oasis-open.org/ns/xri/xrd-1.0'>
+  <Link rel="urn:xmpp:alt-connections:xbosh" href="http://insecure.example.com/http-bind"/>
+  <Link rel="urn:xmpp:alt-connections:xbosh" href="https://xmpp.example.com/http-bind"/>
+  <Link rel="urn:xmpp:alt-connections:websocket" href="wss://xmpp.example.com/ws"/>
+</XRD>`
+
+const testHostMetaJSON = `{
+  "links": [
+    {"rel": "urn:xmpp:alt-connections:xbosh", "href": "https://xmpp.example.com/http-bind"},
+    {"rel": "urn:xmpp:alt-connections:websocket", "href": "ws://insecure.example.com/ws"}
+  ]
+}`
+
+func TestHostMeta(t *testing.T) {
+	var h hostMeta
+	if err := xml.Unmarshal([]byte(testHostMetaXML), &h); err != nil {
+		t.Fatalf("cannot parse XML host-meta: %s", err)
+	}
+	if got := h.endpoint(relBOSH); got != "https://xmpp.example.com/http-bind" {
+		t.Errorf("unexpected BOSH endpoint: %q", got)
+	}
+	if got := h.endpoint(relWebsocket); got != "wss://xmpp.example.com/ws" {
+		t.Errorf("unexpected websocket endpoint: %q", got)
+	}
+
+	h = hostMeta{}
+	if err := json.Unmarshal([]byte(testHostMetaJSON), &h); err != nil {
+		t.Fatalf("cannot parse JSON host-meta: %s", err)
+	}
+	if got := h.endpoint(relBOSH); got != "https://xmpp.example.com/http-bind" {
+		t.Errorf("unexpected BOSH endpoint: %q", got)
+	}
+	if got := h.endpoint(relWebsocket); got != "" {
+		t.Errorf("insecure websocket endpoint should be ignored: %q", got)
+	}
+}
+
+// roundTripFunc redirects the requests of a HTTP client, to serve any host from a test server.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// Check that the client discovers the BOSH endpoint from the XML host-meta document, and
+// connects with it when there is no websocket endpoint.
+func TestClient_ConnectionMethodDiscovery(t *testing.T) {
+	bosh := newBOSHServer(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/host-meta", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<XRD xmlns='http://docs.oasis-open.org/ns/xri/xrd-1.0'>
+  <Link rel="urn:xmpp:alt-connections:xbosh" href="https://xmpp.example.com/http-bind"/>
+</XRD>`))
+	})
+	mux.Handle("/http-bind", bosh)
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	httpClient := server.Client()
+	transport := httpClient.Transport
+	httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		r.URL.Host = server.Listener.Addr().String()
+		return transport.RoundTrip(r)
+	})
+
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			HTTPClient: httpClient,
+		},
+		Jid:               "test@localhost",
+		Credential:        Password("test"),
+		ConnectionMethods: []ConnectionMethod{MethodWebsocket, MethodBOSH},
+	}
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("cannot create XMPP client: %s", err)
+	}
+	if err = client.Connect(); err != nil {
+		t.Fatalf("XMPP connection failed: %s", err)
+	}
+	if _, ok := client.transport.(*BOSHTransport); !ok {
+		t.Errorf("expected BOSH transport, got %T", client.transport)
+	}
+	if err = client.Disconnect(); err != nil {
+		t.Errorf("disconnect failed: %s", err)
+	}
+}
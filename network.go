@@ -1,8 +1,13 @@
 package xmpp
 
 import (
+	"context"
+	"math/rand"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // ensurePort adds a port to an address if none are provided.
@@ -30,3 +35,130 @@ func ensurePort(addr string, port int) string {
 		return "[" + addr + "]:" + strconv.Itoa(port)
 	}
 }
+
+// Resolver looks up the SRV records of a domain. It is implemented by *net.Resolver, and can be
+// replaced in TransportConfiguration, for example to query a specific DNS server.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+// srvTarget is a server address to connect to, usually resolved from a SRV record.
+type srvTarget struct {
+	address  string
+	priority uint16
+	weight   uint16
+	// directTLS is true for _xmpps-client._tcp records, using TLS from the first byte (XEP-0368)
+	directTLS bool
+}
+
+// lookupClientTargets returns the addresses to try in turn to connect to the domain: the SRV
+// records allowed by the TLS mode, STARTTLS and direct TLS merged as defined in XEP-0368 and
+// ordered as defined in RFC 2782, then the domain itself, resolved from its A/AAAA records.
+func lookupClientTargets(ctx context.Context, resolver Resolver, domain string, mode TLSMode) []srvTarget {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	var targets []srvTarget
+	lookup := func(service string, directTLS bool) {
+		_, records, err := resolver.LookupSRV(ctx, service, "tcp", domain)
+		if err != nil {
+			return
+		}
+		for _, srv := range records {
+			// A "." target means that the service is not available
+			if srv.Target == "." || srv.Target == "" {
+				continue
+			}
+			targets = append(targets, srvTarget{
+				address:   ensurePort(strings.TrimSuffix(srv.Target, "."), int(srv.Port)),
+				priority:  srv.Priority,
+				weight:    srv.Weight,
+				directTLS: directTLS,
+			})
+		}
+	}
+	if mode != TLSModeDirectTLS {
+		lookup("xmpp-client", false)
+	}
+	if mode != TLSModeStartTLS {
+		lookup("xmpps-client", true)
+	}
+	targets = orderSRV(targets, rand.Intn)
+
+	// Fallback to the domain A/AAAA records
+	if mode == TLSModeDirectTLS {
+		return append(targets, srvTarget{address: ensurePort(domain, 5223), directTLS: true})
+	}
+	return append(targets, srvTarget{address: ensurePort(domain, 5222)})
+}
+
+// orderSRV orders the records as defined in RFC 2782: by increasing priority, then at random
+// among records with the same priority, with a probability proportional to their weight.
+// intn returns a random number in [0,n).
+func orderSRV(records []srvTarget, intn func(n int) int) []srvTarget {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].priority < records[j].priority
+	})
+
+	ordered := make([]srvTarget, 0, len(records))
+	for start := 0; start < len(records); {
+		end := start
+		for end < len(records) && records[end].priority == records[start].priority {
+			end++
+		}
+		// Records with a zero weight are placed first, so that they have a small chance
+		// of being selected.
+		group := make([]srvTarget, 0, end-start)
+		for _, r := range records[start:end] {
+			if r.weight == 0 {
+				group = append(group, r)
+			}
+		}
+		for _, r := range records[start:end] {
+			if r.weight != 0 {
+				group = append(group, r)
+			}
+		}
+
+		for len(group) > 0 {
+			sum := 0
+			for _, r := range group {
+				sum += int(r.weight)
+			}
+			n := intn(sum + 1)
+			selected, running := len(group)-1, 0
+			for i, r := range group {
+				running += int(r.weight)
+				if running >= n {
+					selected = i
+					break
+				}
+			}
+			ordered = append(ordered, group[selected])
+			group = append(group[:selected], group[selected+1:]...)
+		}
+		start = end
+	}
+	return ordered
+}
+
+// handshakeContext runs the handshake on the connection, within the context deadline. The
+// handshake is aborted when the context is cancelled.
+func handshakeContext(ctx context.Context, conn net.Conn, handshake func() error) error {
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	err := handshake()
+	if !stop() {
+		// The connection was interrupted
+		return ctx.Err()
+	}
+	if err == nil && hasDeadline {
+		_ = conn.SetDeadline(time.Time{})
+	}
+	return err
+}
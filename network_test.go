@@ -1,6 +1,10 @@
 package xmpp
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
 	"strings"
 	"testing"
 )
@@ -64,3 +68,101 @@ func TestEnsurePort(t *testing.T) {
 	}
 
 }
+
+// fakeResolver returns SRV records from a map indexed by service, instead of querying the DNS.
+type fakeResolver map[string][]*net.SRV
+
+func (r fakeResolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	records, ok := r[service]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return "", records, nil
+}
+
+func TestLookupClientTargets(t *testing.T) {
+	resolver := fakeResolver{
+		"xmpp-client": {
+			{Target: "xmpp2.example.com.", Port: 5222, Priority: 10},
+			{Target: "xmpp1.example.com.", Port: 5222, Priority: 5},
+		},
+		"xmpps-client": {
+			{Target: "xmpps.example.com.", Port: 443, Priority: 1},
+			{Target: ".", Port: 0, Priority: 0},
+		},
+	}
+	tests := []struct {
+		name string
+		mode TLSMode
+		want []string
+	}{
+		{name: "any", mode: TLSModeAny, want: []string{
+			"xmpps.example.com:443/true",
+			"xmpp1.example.com:5222/false",
+			"xmpp2.example.com:5222/false",
+			"example.com:5222/false",
+		}},
+		{name: "starttls", mode: TLSModeStartTLS, want: []string{
+			"xmpp1.example.com:5222/false",
+			"xmpp2.example.com:5222/false",
+			"example.com:5222/false",
+		}},
+		{name: "directtls", mode: TLSModeDirectTLS, want: []string{
+			"xmpps.example.com:443/true",
+			"example.com:5223/true",
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(st *testing.T) {
+			targets := lookupClientTargets(context.Background(), resolver, "example.com", tc.mode)
+			if got := formatTargets(targets); got != strings.Join(tc.want, ",") {
+				st.Errorf("unexpected targets: %s", got)
+			}
+		})
+	}
+
+	// Without SRV records, the domain is used
+	targets := lookupClientTargets(context.Background(), fakeResolver{}, "example.com", TLSModeAny)
+	if got := formatTargets(targets); got != "example.com:5222/false" {
+		t.Errorf("unexpected fallback targets: %s", got)
+	}
+}
+
+func TestOrderSRV(t *testing.T) {
+	records := []srvTarget{
+		{address: "c:5222", priority: 20, weight: 0},
+		{address: "a1:5222", priority: 10, weight: 10},
+		{address: "a2:5222", priority: 10, weight: 30},
+		{address: "a0:5222", priority: 10, weight: 0},
+	}
+
+	// Random values select the last record of the running sum: zero weight records come first
+	// in the running sum, so they are only selected with a random value of 0.
+	last := func(n int) int { return n - 1 }
+	if got := formatTargets(orderSRV(append([]srvTarget(nil), records...), last)); got != "a2:5222/false,a1:5222/false,a0:5222/false,c:5222/false" {
+		t.Errorf("unexpected order with high random values: %s", got)
+	}
+	first := func(int) int { return 0 }
+	if got := formatTargets(orderSRV(append([]srvTarget(nil), records...), first)); got != "a0:5222/false,a1:5222/false,a2:5222/false,c:5222/false" {
+		t.Errorf("unexpected order with low random values: %s", got)
+	}
+
+	// Check that the selection is proportional to the weight
+	selected := map[string]int{}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		ordered := orderSRV(append([]srvTarget(nil), records[1:3]...), rnd.Intn)
+		selected[ordered[0].address]++
+	}
+	if selected["a2:5222"] < 7000 || selected["a2:5222"] > 8000 {
+		t.Errorf("weighted selection is not proportional to the weight: %v", selected)
+	}
+}
+
+func formatTargets(targets []srvTarget) string {
+	var s []string
+	for _, target := range targets {
+		s = append(s, fmt.Sprintf("%s/%t", target.address, target.directTLS))
+	}
+	return strings.Join(s, ",")
+}
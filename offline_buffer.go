@@ -0,0 +1,200 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Offline buffer
+
+// ErrOfflineBufferFull is returned when a stanza sent while the client is disconnected cannot be
+// buffered, as the offline buffer limits are reached.
+var ErrOfflineBufferFull = errors.New("offline buffer is full")
+
+// errStanzaExpired is passed to the ack handlers of the stanzas dropped from the offline buffer.
+var errStanzaExpired = fmt.Errorf("%w: expired in the offline buffer", ErrStanzaNotAcked)
+
+const (
+	defaultOfflineBufferStanzas = 100
+	defaultOfflineBufferBytes   = 1 << 20
+)
+
+// OfflineBufferConfig enables the buffering of the stanzas sent while the client is disconnected,
+// for example while the StreamManager is reconnecting. The buffered stanzas are sent after the
+// next connection or stream management resumption.
+type OfflineBufferConfig struct {
+	// MaxStanzas is the maximum number of buffered stanzas. Default to 100.
+	MaxStanzas int
+	// MaxBytes is the maximum size of the buffered stanzas. Default to 1 MiB.
+	MaxBytes int
+	// MaxAge is the duration after which a buffered stanza is dropped. Default to no limit.
+	MaxAge time.Duration
+}
+
+type bufferedStanza struct {
+	// seq identifies the stanza, as the same content may be sent several times
+	seq   uint64
+	data  []byte
+	onAck AckHandler
+	added time.Time
+}
+
+// offlineBuffer holds the stanzas sent while the client is disconnected. The packet writer of the
+// connection is attached once the session is established, after writing the buffered stanzas.
+type offlineBuffer struct {
+	config OfflineBufferConfig
+	now    func() time.Time
+
+	mu      sync.Mutex
+	writer  *packetWriter
+	stanzas []bufferedStanza
+	size    int
+	// seq is the sequence number of the last buffered stanza
+	seq uint64
+}
+
+func newOfflineBuffer(config OfflineBufferConfig) *offlineBuffer {
+	if config.MaxStanzas <= 0 {
+		config.MaxStanzas = defaultOfflineBufferStanzas
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaultOfflineBufferBytes
+	}
+	return &offlineBuffer{config: config, now: time.Now}
+}
+
+// send sends the stanza with the attached writer, or buffers it when the client is disconnected.
+func (b *offlineBuffer) send(ctx context.Context, data []byte, onAck AckHandler, priority, wait bool) error {
+	for {
+		b.mu.Lock()
+		w := b.writer
+		if w == nil {
+			expired, err := b.push(data, onAck)
+			b.mu.Unlock()
+			notifyExpired(expired)
+			return err
+		}
+		b.mu.Unlock()
+
+		err := w.enqueue(sendRequest{ctx: ctx, data: data, track: true, onAck: onAck}, priority, wait)
+		if !errors.Is(err, ErrNotConnected) {
+			return err
+		}
+		// The connection was lost before the stanza was written
+		b.mu.Lock()
+		if b.writer == w {
+			b.writer = nil
+		}
+		b.mu.Unlock()
+	}
+}
+
+// push adds a stanza to the buffer. The expired stanzas are dropped first, to make room: their
+// handlers are returned, to be called once the buffer is unlocked.
+func (b *offlineBuffer) push(data []byte, onAck AckHandler) ([]AckHandler, error) {
+	expired := b.expire()
+	if len(b.stanzas) >= b.config.MaxStanzas || b.size+len(data) > b.config.MaxBytes {
+		return expired, ErrOfflineBufferFull
+	}
+	b.seq++
+	b.stanzas = append(b.stanzas, bufferedStanza{seq: b.seq, data: data, onAck: onAck, added: b.now()})
+	b.size += len(data)
+	return expired, nil
+}
+
+// expire drops the stanzas older than MaxAge, and returns their handlers.
+func (b *offlineBuffer) expire() []AckHandler {
+	if b.config.MaxAge <= 0 {
+		return nil
+	}
+	var expired []AckHandler
+	deadline := b.now().Add(-b.config.MaxAge)
+	i := 0
+	for ; i < len(b.stanzas) && b.stanzas[i].added.Before(deadline); i++ {
+		b.size -= len(b.stanzas[i].data)
+		if b.stanzas[i].onAck != nil {
+			expired = append(expired, b.stanzas[i].onAck)
+		}
+	}
+	b.stanzas = b.stanzas[i:]
+	return expired
+}
+
+// notifyExpired calls the handlers of the expired stanzas. The handlers may send stanzas: they
+// must not be called while the buffer is locked.
+func notifyExpired(handlers []AckHandler) {
+	for _, handler := range handlers {
+		handler(errStanzaExpired)
+	}
+}
+
+// attach writes the buffered stanzas with the writer of the new connection, then sends the next
+// stanzas with it. The buffered stanzas already written, and still in the stream management
+// unacknowledged queue, are skipped, as they are sent again by the resumed session. When the
+// writer fails, the remaining stanzas are kept for the next connection.
+//
+// The buffer is not locked while the stanzas are written, so that sending is not blocked by a full
+// writer queue: the stanzas sent meanwhile are buffered, and written once the previous ones are.
+func (b *offlineBuffer) attach(ctx context.Context, w *packetWriter, acks *ackTracker) error {
+	if b == nil {
+		return nil
+	}
+	pending := acks.pendingBuffered()
+	for {
+		b.mu.Lock()
+		expired := b.expire()
+		stanzas := b.stanzas
+		if len(stanzas) == 0 {
+			b.stanzas = nil
+			b.writer = w
+			b.mu.Unlock()
+			notifyExpired(expired)
+			return nil
+		}
+		// The stanzas being written still count in the size of the buffer
+		b.stanzas = nil
+		b.mu.Unlock()
+		notifyExpired(expired)
+
+		for i, stz := range stanzas {
+			// The handler of an unacknowledged stanza was registered when it was written
+			if pending[stz.seq] {
+				continue
+			}
+			req := sendRequest{ctx: ctx, data: stz.data, track: true, onAck: stz.onAck, buffered: stz.seq}
+			if err := w.enqueue(req, false, true); err != nil {
+				b.mu.Lock()
+				b.stanzas = append(stanzas[i:len(stanzas):len(stanzas)], b.stanzas...)
+				b.size -= bufferedSize(stanzas[:i])
+				b.mu.Unlock()
+				return fmt.Errorf("cannot send buffered stanzas: %w", err)
+			}
+		}
+		b.mu.Lock()
+		b.size -= bufferedSize(stanzas)
+		b.mu.Unlock()
+	}
+}
+
+// bufferedSize returns the size of the stanzas.
+func bufferedSize(stanzas []bufferedStanza) int {
+	size := 0
+	for _, stz := range stanzas {
+		size += len(stz.data)
+	}
+	return size
+}
+
+// detach buffers the next stanzas, until a writer is attached.
+func (b *offlineBuffer) detach() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.writer = nil
+	b.mu.Unlock()
+}
@@ -0,0 +1,198 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+func TestOfflineBuffer_Limits(t *testing.T) {
+	b := newOfflineBuffer(OfflineBufferConfig{MaxStanzas: 2, MaxBytes: 10, MaxAge: time.Minute})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	if err := b.send(ctx, []byte("<a/>"), nil, false, false); err != nil {
+		t.Fatalf("cannot buffer stanza: %s", err)
+	}
+	if err := b.send(ctx, []byte("<message/>"), nil, false, false); !errors.Is(err, ErrOfflineBufferFull) {
+		t.Errorf("expected the size limit to be reached, got %v", err)
+	}
+	if err := b.send(ctx, []byte("<b/>"), nil, false, false); err != nil {
+		t.Fatalf("cannot buffer stanza: %s", err)
+	}
+	if err := b.send(ctx, []byte("<c/>"), nil, false, false); !errors.Is(err, ErrOfflineBufferFull) {
+		t.Errorf("expected the count limit to be reached, got %v", err)
+	}
+
+	// Expired stanzas make room for the new ones
+	now = now.Add(2 * time.Minute)
+	if err := b.send(ctx, []byte("<c/>"), nil, false, false); err != nil {
+		t.Errorf("expired stanzas should be dropped: %v", err)
+	}
+	if len(b.stanzas) != 1 || b.size != 4 {
+		t.Errorf("unexpected buffer: %d stanzas, %d bytes", len(b.stanzas), b.size)
+	}
+}
+
+func TestOfflineBuffer_Attach(t *testing.T) {
+	b := newOfflineBuffer(OfflineBufferConfig{})
+	ctx := context.Background()
+	var acked []string
+	for _, stz := range []string{"<a/>", "<b/>", "<a/>", "<c/>"} {
+		onAck := func(err error) {
+			if err == nil {
+				acked = append(acked, stz)
+			}
+		}
+		if err := b.send(ctx, []byte(stz), onAck, false, false); err != nil {
+			t.Fatalf("cannot buffer stanza: %s", err)
+		}
+	}
+
+	// The resumed session sends the unacknowledged stanzas again: a stanza with the same content as
+	// a buffered one, and the second buffered stanza, written before the connection was lost
+	acks := newAckTracker(stanza.NewUnAckQueue(), 0)
+	acks.track([]byte("<a/>"), nil, 0)
+	acks.track(b.stanzas[1].data, b.stanzas[1].onAck, b.stanzas[1].seq)
+
+	transport := newBlockingTransport()
+	close(transport.gate)
+	w := newPacketWriter(transport, TransportConfiguration{}, nil)
+	if err := b.attach(ctx, w, acks); err != nil {
+		t.Fatalf("cannot send buffered stanzas: %s", err)
+	}
+	if err := b.send(ctx, []byte("<d/>"), nil, false, true); err != nil {
+		t.Fatalf("cannot send stanza: %s", err)
+	}
+
+	packets := transport.packets()
+	expected := []string{"<a/>", "<a/>", "<c/>", "<d/>"}
+	if len(packets) != len(expected) {
+		t.Fatalf("unexpected packets: %v", packets)
+	}
+	for i := range expected {
+		if packets[i] != expected[i] {
+			t.Errorf("unexpected packets: %v", packets)
+			break
+		}
+	}
+
+	// The handler of the skipped stanza is called once, when the queued one is acknowledged
+	if err := acks.acknowledge(2); err != nil {
+		t.Fatalf("cannot acknowledge stanzas: %s", err)
+	}
+	if len(acked) != 1 || acked[0] != "<b/>" {
+		t.Errorf("unexpected acknowledged stanzas: %v", acked)
+	}
+}
+
+func TestOfflineBuffer_ConnectionLost(t *testing.T) {
+	b := newOfflineBuffer(OfflineBufferConfig{})
+	transport := newBlockingTransport()
+	transport.err = errors.New("broken pipe")
+	close(transport.gate)
+	w := newPacketWriter(transport, TransportConfiguration{}, nil)
+	ctx := context.Background()
+	if err := b.attach(ctx, w, nil); err != nil {
+		t.Fatalf("cannot attach writer: %s", err)
+	}
+
+	// The first stanza fails the connection
+	_ = b.send(ctx, []byte("<a/>"), nil, false, true)
+	<-w.done
+	if err := b.send(ctx, []byte("<b/>"), nil, false, true); err != nil {
+		t.Errorf("stanza should be buffered when the connection is lost: %v", err)
+	}
+	if len(b.stanzas) != 1 || string(b.stanzas[0].data) != "<b/>" {
+		t.Errorf("unexpected buffer: %v", b.stanzas)
+	}
+}
+
+// The handlers of the expired stanzas may send stanzas.
+func TestOfflineBuffer_ExpiredHandler(t *testing.T) {
+	b := newOfflineBuffer(OfflineBufferConfig{MaxAge: time.Minute})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	ctx := context.Background()
+	onAck := func(err error) {
+		if errors.Is(err, errStanzaExpired) {
+			_ = b.send(ctx, []byte("<expired/>"), nil, false, false)
+		}
+	}
+	if err := b.send(ctx, []byte("<a/>"), onAck, false, false); err != nil {
+		t.Fatalf("cannot buffer stanza: %s", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	done := make(chan error)
+	go func() {
+		done <- b.send(ctx, []byte("<b/>"), nil, false, false)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("cannot buffer stanza: %s", err)
+		}
+	case <-time.After(defaultChannelTimeout):
+		t.Fatal("sending from the handler of an expired stanza blocked")
+	}
+	if len(b.stanzas) != 2 || string(b.stanzas[0].data) != "<b/>" || string(b.stanzas[1].data) != "<expired/>" {
+		t.Errorf("unexpected buffer: %v", b.stanzas)
+	}
+}
+
+// Sending is not blocked while the buffered stanzas wait for room in the writer queue.
+func TestOfflineBuffer_SendWhileAttaching(t *testing.T) {
+	b := newOfflineBuffer(OfflineBufferConfig{})
+	ctx := context.Background()
+	for _, stz := range []string{"<a/>", "<b/>", "<c/>"} {
+		if err := b.send(ctx, []byte(stz), nil, false, false); err != nil {
+			t.Fatalf("cannot buffer stanza: %s", err)
+		}
+	}
+
+	transport := newBlockingTransport()
+	w := newPacketWriter(transport, TransportConfiguration{SendQueueSize: 1}, nil)
+	attached := make(chan error)
+	go func() {
+		attached <- b.attach(ctx, w, nil)
+	}()
+	<-transport.started
+
+	sent := make(chan error)
+	go func() {
+		sent <- b.send(ctx, []byte("<d/>"), nil, false, false)
+	}()
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatalf("cannot send stanza: %s", err)
+		}
+	case <-time.After(defaultChannelTimeout):
+		t.Fatal("sending blocked while the buffered stanzas were written")
+	}
+
+	close(transport.gate)
+	if err := <-attached; err != nil {
+		t.Fatalf("cannot send buffered stanzas: %s", err)
+	}
+	w.close(ctx)
+	packets := transport.packets()
+	expected := []string{"<a/>", "<b/>", "<c/>", "<d/>"}
+	if len(packets) != len(expected) {
+		t.Fatalf("unexpected packets: %v", packets)
+	}
+	for i := range expected {
+		if packets[i] != expected[i] {
+			t.Errorf("unexpected packets: %v", packets)
+			break
+		}
+	}
+	if b.size != 0 {
+		t.Errorf("unexpected buffer size: %d", b.size)
+	}
+}
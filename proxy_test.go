@@ -0,0 +1,171 @@
+package xmpp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// testProxy is a proxy server relaying connections, with a protocol specific handshake that
+// returns the target address.
+type testProxy struct {
+	listener net.Listener
+	// targets are the addresses requested by the clients
+	targets chan string
+}
+
+func startTestProxy(t *testing.T, handshake func(conn net.Conn, r *bufio.Reader) (string, error)) *testProxy {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	p := &testProxy{listener: l, targets: make(chan string, 1)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				target, err := handshake(conn, r)
+				if err != nil {
+					t.Errorf("proxy handshake failed: %s", err)
+					return
+				}
+				p.targets <- target
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					t.Errorf("proxy cannot connect to %s: %s", target, err)
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, r)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return p
+}
+
+// socks5Handshake accepts a connect request, with username and password authentication.
+func socks5Handshake(conn net.Conn, r *bufio.Reader) (string, error) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, buf[:buf[1]]); err != nil {
+		return "", err
+	}
+	conn.Write([]byte{0x05, 0x02})
+
+	// Username / password
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return "", err
+	}
+	user := make([]byte, buf[1])
+	io.ReadFull(r, user)
+	io.ReadFull(r, buf[:1])
+	password := make([]byte, buf[0])
+	io.ReadFull(r, password)
+	if string(user) != "user" || string(password) != "secret" {
+		conn.Write([]byte{0x01, 0x01})
+		return "", fmt.Errorf("invalid credentials %s:%s", user, password)
+	}
+	conn.Write([]byte{0x01, 0x00})
+
+	// Connect request, with a domain name
+	if _, err := io.ReadFull(r, buf[:5]); err != nil {
+		return "", err
+	}
+	if buf[1] != 0x01 || buf[3] != 0x03 {
+		return "", fmt.Errorf("unexpected connect request: %v", buf[:5])
+	}
+	host := make([]byte, buf[4])
+	io.ReadFull(r, host)
+	io.ReadFull(r, buf[:2])
+	port := int(buf[0])<<8 | int(buf[1])
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+	return net.JoinHostPort(string(host), fmt.Sprint(port)), nil
+}
+
+// httpConnectHandshake accepts a CONNECT request, with basic authentication.
+func httpConnectHandshake(conn net.Conn, r *bufio.Reader) (string, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return "", err
+	}
+	if req.Method != http.MethodConnect {
+		return "", fmt.Errorf("unexpected method %s", req.Method)
+	}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	if req.Header.Get("Proxy-Authorization") != auth {
+		fmt.Fprint(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return "", fmt.Errorf("invalid proxy authorization %q", req.Header.Get("Proxy-Authorization"))
+	}
+	fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host, nil
+}
+
+func TestClient_SOCKS5Proxy(t *testing.T) {
+	proxy := startTestProxy(t, socks5Handshake)
+	defer proxy.listener.Close()
+	dialer, err := NewProxyDialer("socks5://user:secret@" + proxy.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("cannot create proxy dialer: %s", err)
+	}
+	testClientProxy(t, proxy, dialer, testClientSOCKS5)
+}
+
+func TestClient_HTTPConnectProxy(t *testing.T) {
+	proxy := startTestProxy(t, httpConnectHandshake)
+	defer proxy.listener.Close()
+	dialer := NewHTTPConnectDialer(proxy.listener.Addr().String(), &ProxyAuth{Username: "user", Password: "secret"}, nil)
+	testClientProxy(t, proxy, dialer, testClientHTTPConnect)
+}
+
+// testClientProxy checks that the client connects to the server through the proxy dialer.
+func testClientProxy(t *testing.T, proxy *testProxy, dialer Dialer, port int) {
+	address := fmt.Sprintf("%s:%d", testClientDomain, port)
+	mock := ServerMock{}
+	mock.Start(t, address, handlerClientConnectSuccess)
+	defer mock.Stop()
+
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Address: address,
+			Dialer:  dialer,
+		},
+		Jid:        "test@localhost",
+		Credential: Password("test"),
+		Insecure:   true,
+	}
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("cannot create XMPP client: %s", err)
+	}
+	if err = client.Connect(); err != nil {
+		t.Fatalf("XMPP connection failed: %s", err)
+	}
+	if target := <-proxy.targets; target != address {
+		t.Errorf("unexpected proxy target: %s", target)
+	}
+}
+
+func TestNewProxyDialer(t *testing.T) {
+	if _, err := NewProxyDialer("ftp://proxy.example.com"); err == nil {
+		t.Error("unsupported proxy scheme should be rejected")
+	}
+	d, err := NewProxyDialer("http://proxy.example.com")
+	if err != nil {
+		t.Fatalf("cannot create HTTP proxy dialer: %s", err)
+	}
+	if addr := d.(*httpConnectDialer).proxyAddress; addr != "proxy.example.com:80" {
+		t.Errorf("unexpected default proxy port: %s", addr)
+	}
+}
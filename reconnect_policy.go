@@ -0,0 +1,126 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ============================================================================
+// Reconnection policy
+
+// ReconnectPolicy decides whether and when the StreamManager reconnects after the connection is
+// lost.
+type ReconnectPolicy interface {
+	// NextDelay returns the delay before the next reconnection attempt, or false to give up.
+	// attempt is the number of failed attempts since the connection was lost, and elapsed the time
+	// since then. err is the error of the last attempt, or the cause of the disconnection before
+	// the first attempt: a *StreamError when the server closed the stream with an error, nil
+	// otherwise.
+	NextDelay(attempt int, elapsed time.Duration, err error) (time.Duration, bool)
+}
+
+// ReconnectPolicyFunc adapts a function to a ReconnectPolicy, for custom decisions.
+type ReconnectPolicyFunc func(attempt int, elapsed time.Duration, err error) (time.Duration, bool)
+
+func (f ReconnectPolicyFunc) NextDelay(attempt int, elapsed time.Duration, err error) (time.Duration, bool) {
+	return f(attempt, elapsed, err)
+}
+
+// BackoffPolicy is a ReconnectPolicy reconnecting right away, then waiting an exponentially
+// increasing delay between the failed attempts. The zero value is the default policy of the
+// StreamManager: it retries with full jitter until the error is not retryable.
+type BackoffPolicy struct {
+	// Base is the delay after the first failed attempt. Defaults to 20ms.
+	Base time.Duration
+	// Factor multiplies the delay after each failed attempt. Defaults to 2.
+	Factor int
+	// Cap is the maximum delay between attempts. Defaults to 3 minutes.
+	Cap time.Duration
+	// NoJitter disables the full jitter, which waits a random delay up to the computed one, so that
+	// the clients disconnected at the same time do not reconnect together.
+	NoJitter bool
+	// MaxAttempts is the number of attempts before giving up. Unlimited when 0.
+	MaxAttempts int
+	// MaxElapsed is the time after which no attempt is made anymore. Unlimited when 0.
+	MaxElapsed time.Duration
+	// Retry tells if the connection should be retried after the error. Defaults to IsRetryable.
+	Retry func(err error) bool
+}
+
+func (p *BackoffPolicy) NextDelay(attempt int, elapsed time.Duration, err error) (time.Duration, bool) {
+	retry := p.Retry
+	if retry == nil {
+		retry = IsRetryable
+	}
+	switch {
+	case err != nil && !retry(err):
+		return 0, false
+	case p.MaxAttempts > 0 && attempt >= p.MaxAttempts:
+		return 0, false
+	case p.MaxElapsed > 0 && elapsed >= p.MaxElapsed:
+		return 0, false
+	case attempt == 0:
+		return 0, true
+	}
+	b := backoff{NoJitter: p.NoJitter, Base: int(p.Base / time.Millisecond), Factor: p.Factor,
+		Cap: int(p.Cap / time.Millisecond)}
+	return b.durationForAttempt(attempt - 1), true
+}
+
+// IsRetryable is the default decision of BackoffPolicy: the connection is retried, unless the
+// error is a permanent ConnError, or a conflict stream error telling that the session was replaced
+// by another one, to avoid a reconnection loop between them.
+func IsRetryable(err error) bool {
+	var connErr ConnError
+	if errors.As(err, &connErr) && connErr.Permanent {
+		return false
+	}
+	var streamErr *StreamError
+	if errors.As(err, &streamErr) && streamErr.Condition == "conflict" {
+		return false
+	}
+	return true
+}
+
+// StreamError is the cause of the disconnection passed to the ReconnectPolicy when the server
+// closed the stream with an error.
+type StreamError struct {
+	// Condition is the stream error condition, for example "conflict"
+	Condition string
+	Text      string
+}
+
+func (e *StreamError) Error() string {
+	if e.Text != "" {
+		return "stream error: " + e.Condition + ": " + e.Text
+	}
+	return "stream error: " + e.Condition
+}
+
+// Clock tells the time and waits, for the StreamManager. It can be replaced to test the
+// reconnection behaviour deterministically.
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for the duration, or until the context is done. It returns the error of the
+	// context when the wait is interrupted.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// systemClock is the Clock of the system.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,46 @@
+package xmpp
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoffPolicy(t *testing.T) {
+	p := &BackoffPolicy{Base: 100 * time.Millisecond, Cap: 300 * time.Millisecond, NoJitter: true, MaxAttempts: 4}
+	expected := []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}
+	for attempt, want := range expected {
+		if d, ok := p.NextDelay(attempt, 0, nil); !ok || d != want {
+			t.Errorf("attempt %d: expected %s, got %s, %t", attempt, want, d, ok)
+		}
+	}
+	if _, ok := p.NextDelay(4, 0, nil); ok {
+		t.Error("policy should give up after the maximum number of attempts")
+	}
+
+	p = &BackoffPolicy{MaxElapsed: time.Minute}
+	if _, ok := p.NextDelay(1, time.Minute, nil); ok {
+		t.Error("policy should give up after the maximum elapsed time")
+	}
+	if d, ok := p.NextDelay(1, 0, nil); !ok || d < 0 || d > 20*time.Millisecond {
+		t.Errorf("unexpected jittered delay: %s", d)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{err: errors.New("connection reset"), retryable: true},
+		{err: NewConnError(errors.New("connection refused"), false), retryable: true},
+		{err: NewConnError(errors.New("not authorized"), true), retryable: false},
+		{err: &StreamError{Condition: "system-shutdown"}, retryable: true},
+		{err: &StreamError{Condition: "conflict"}, retryable: false},
+	}
+	for _, tc := range tests {
+		if IsRetryable(tc.err) != tc.retryable {
+			t.Errorf("%v: expected retryable %t", tc.err, tc.retryable)
+		}
+	}
+}
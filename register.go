@@ -0,0 +1,180 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+// ============================================================================
+// In-Band Registration (XEP-0077)
+// Reference: https://xmpp.org/extensions/xep-0077.html
+
+// RegistrationHandler is called with the registration query sent by the server, listing the
+// fields to fill, either as legacy fields or as a data form, with optional instructions.
+// It returns the filled query to submit.
+type RegistrationHandler func(fields *stanza.Register) (*stanza.Register, error)
+
+// NewRegistrationSession negotiates TLS on a newly connected stream, then creates an account
+// with in-band registration, before any authentication. It is an alternative to NewSession
+// for account provisioning: the stream cannot be used to send stanzas afterwards.
+func NewRegistrationSession(c *Client, handler RegistrationHandler) (*Session, error) {
+	s := new(Session)
+	s.transport = c.transport
+	s.init()
+	if s.err != nil {
+		return nil, NewConnError(s.err, true)
+	}
+
+	if !c.transport.IsSecure() {
+		s.startTlsIfSupported(c.config)
+	}
+	if !c.transport.IsSecure() && !c.config.Insecure {
+		err := fmt.Errorf("failed to negotiate TLS session : %s", s.err)
+		return nil, NewConnError(err, true)
+	}
+	if s.TlsEnabled {
+		s.reset()
+	}
+
+	s.register(c.config, handler)
+	return s, s.err
+}
+
+// register requests the registration fields, and submits them once filled by the handler.
+func (s *Session) register(o *Config, handler RegistrationHandler) {
+	if s.err != nil {
+		return
+	}
+
+	iq, err := stanza.NewIQ(stanza.Attrs{Type: stanza.IQTypeGet, To: o.parsedJid.Domain, Id: s.PacketId()})
+	if err != nil {
+		s.err = err
+		return
+	}
+	iq.Register()
+	fields, err := s.registerIQ(iq)
+	if err != nil {
+		s.err = err
+		return
+	}
+
+	filled, err := handler(fields)
+	if err != nil {
+		s.err = err
+		return
+	}
+	if filled == nil {
+		s.err = errors.New("registration cancelled: no registration fields")
+		return
+	}
+	if iq, s.err = stanza.NewIQ(stanza.Attrs{Type: stanza.IQTypeSet, To: o.parsedJid.Domain, Id: s.PacketId()}); s.err != nil {
+		return
+	}
+	filled.XMLName = xml.Name{Space: stanza.NSRegister, Local: "query"}
+	iq.Payload = filled
+	_, s.err = s.registerIQ(iq)
+}
+
+// registerIQ sends a registration IQ on the unauthenticated stream, and returns the
+// registration query sent back by the server, if any.
+func (s *Session) registerIQ(iq *stanza.IQ) (*stanza.Register, error) {
+	data, err := xml.Marshal(iq)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.transport.Write(data); err != nil {
+		return nil, err
+	}
+
+	var result stanza.IQ
+	if err = s.transport.GetDecoder().Decode(&result); err != nil {
+		return nil, errors.New("error decoding iq register result: " + err.Error())
+	}
+	if result.Type == stanza.IQTypeError {
+		return nil, registrationError(result)
+	}
+	fields, _ := result.Payload.(*stanza.Register)
+	if fields == nil && iq.Type == stanza.IQTypeGet {
+		return nil, errors.New("iq register result missing")
+	}
+	return fields, nil
+}
+
+// registrationError converts an IQ error reply to an error, like conflict when the username
+// is already taken.
+func registrationError(iq stanza.IQ) error {
+	reason := "unknown error"
+	if iq.Error != nil {
+		reason = iq.Error.Reason
+		if iq.Error.Text != "" {
+			reason += " (" + iq.Error.Text + ")"
+		}
+	}
+	return errors.New("registration failed: " + reason)
+}
+
+// Register connects to the server, creates an account with in-band registration, and
+// disconnects. The handler fills the registration fields requested by the server, like the
+// username and password. The client can then Connect with the new account.
+func (c *Client) Register(handler RegistrationHandler) error {
+	if _, err := c.transport.Connect(); err != nil {
+		return err
+	}
+	_, err := NewRegistrationSession(c, handler)
+	go readUntilStreamClose(c.transport)
+	c.transport.Close()
+	return err
+}
+
+// ChangePassword changes the password of the connected account. When the client authenticates
+// with a password, the new password is used for the next connections.
+func (c *Client) ChangePassword(ctx context.Context, password string) error {
+	iq, err := stanza.NewIQ(stanza.Attrs{Type: stanza.IQTypeSet, To: c.config.parsedJid.Domain})
+	if err != nil {
+		return err
+	}
+	iq.Register().
+		SetField(stanza.RegisterUsername, c.config.parsedJid.Node).
+		SetField(stanza.RegisterPassword, password)
+	if err = c.sendRegisterIQ(ctx, iq); err != nil {
+		return err
+	}
+	c.credentialMu.Lock()
+	if c.config.CredentialProvider == nil && c.config.Credential.isPassword() {
+		c.config.Credential = c.config.Credential.withSecret(password)
+	}
+	c.credentialMu.Unlock()
+	return nil
+}
+
+// CancelRegistration removes the connected account from the server. The server usually
+// closes the stream afterwards.
+func (c *Client) CancelRegistration(ctx context.Context) error {
+	iq, err := stanza.NewIQ(stanza.Attrs{Type: stanza.IQTypeSet, To: c.config.parsedJid.Domain})
+	if err != nil {
+		return err
+	}
+	iq.Register().SetRemove()
+	return c.sendRegisterIQ(ctx, iq)
+}
+
+// sendRegisterIQ sends a registration IQ on the session, and waits for the result.
+func (c *Client) sendRegisterIQ(ctx context.Context, iq *stanza.IQ) error {
+	res, err := c.SendIQ(ctx, iq)
+	if err != nil {
+		return err
+	}
+	select {
+	case result := <-res:
+		if result.Type == stanza.IQTypeError {
+			return registrationError(result)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
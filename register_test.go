@@ -0,0 +1,156 @@
+package xmpp
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+// readRegisterIQ reads a registration IQ sent by the client.
+func readRegisterIQ(t *testing.T, sc *ServerConn) (stanza.IQ, *stanza.Register) {
+	var iq stanza.IQ
+	se, err := stanza.NextStart(sc.decoder)
+	if err != nil {
+		t.Errorf("cannot read register iq: %s", err)
+		return iq, nil
+	}
+	if err = sc.decoder.DecodeElement(&iq, &se); err != nil {
+		t.Errorf("cannot decode register iq: %s", err)
+		return iq, nil
+	}
+	r, ok := iq.Payload.(*stanza.Register)
+	if !ok {
+		t.Errorf("expected register payload, got %T", iq.Payload)
+	}
+	return iq, r
+}
+
+func newRegisterTestClient(t *testing.T, handler func(*testing.T, *ServerConn)) (*Client, *ServerMock) {
+	mock := &ServerMock{}
+	address := fmt.Sprintf("%s:%d", testClientDomain, testClientRegister)
+	mock.Start(t, address, handler)
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Address: address,
+		},
+		Jid:        "juliet@localhost",
+		Credential: Password("old-password"),
+		Insecure:   true}
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("connect create XMPP client: %s", err)
+	}
+	return client, mock
+}
+
+func TestClient_Register(t *testing.T) {
+	client, mock := newRegisterTestClient(t, func(t *testing.T, sc *ServerConn) {
+		checkClientOpenStream(t, sc)
+		fmt.Fprintln(sc.connection, `<stream:features><register xmlns='http://jabber.org/features/iq-register'/></stream:features>`)
+
+		iq, r := readRegisterIQ(t, sc)
+		if iq.Type != stanza.IQTypeGet || r == nil || len(r.Fields) != 0 {
+			t.Errorf("expected registration fields request, got %+v", iq)
+		}
+		fmt.Fprintf(sc.connection, `<iq type='result' id='%s'><query xmlns='jabber:iq:register'>
+<instructions>Choose a username and password.</instructions><username/><password/></query></iq>`, iq.Id)
+
+		iq, r = readRegisterIQ(t, sc)
+		if iq.Type != stanza.IQTypeSet || r == nil {
+			t.Errorf("expected registration request, got %+v", iq)
+		} else if username, _ := r.Field(stanza.RegisterUsername); username != "juliet" {
+			t.Errorf("unexpected username: %q", username)
+		}
+		fmt.Fprintf(sc.connection, `<iq type='result' id='%s'/>`, iq.Id)
+		closeConn(t, sc)
+	})
+	defer mock.Stop()
+
+	var instructions string
+	err := client.Register(func(fields *stanza.Register) (*stanza.Register, error) {
+		instructions = fields.Instructions
+		return fields.SetField(stanza.RegisterUsername, "juliet").SetField(stanza.RegisterPassword, "secret"), nil
+	})
+	if err != nil {
+		t.Errorf("registration failed: %s", err)
+	}
+	if instructions != "Choose a username and password." {
+		t.Errorf("unexpected instructions: %q", instructions)
+	}
+}
+
+func TestClient_RegisterConflict(t *testing.T) {
+	client, mock := newRegisterTestClient(t, func(t *testing.T, sc *ServerConn) {
+		checkClientOpenStream(t, sc)
+		fmt.Fprintln(sc.connection, `<stream:features/>`)
+
+		iq, _ := readRegisterIQ(t, sc)
+		fmt.Fprintf(sc.connection, `<iq type='result' id='%s'><query xmlns='jabber:iq:register'><username/><password/></query></iq>`, iq.Id)
+		iq, _ = readRegisterIQ(t, sc)
+		fmt.Fprintf(sc.connection, `<iq type='error' id='%s'><error type='cancel'>
+<conflict xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>`, iq.Id)
+		closeConn(t, sc)
+	})
+	defer mock.Stop()
+
+	err := client.Register(func(fields *stanza.Register) (*stanza.Register, error) {
+		return fields.SetField(stanza.RegisterUsername, "juliet").SetField(stanza.RegisterPassword, "secret"), nil
+	})
+	if err == nil || err.Error() != "registration failed: conflict" {
+		t.Errorf("expected conflict error, got %v", err)
+	}
+}
+
+func TestClient_ChangePassword(t *testing.T) {
+	done := make(chan struct{})
+	client, mock := newRegisterTestClient(t, func(t *testing.T, sc *ServerConn) {
+		handlerClientConnectSuccess(t, sc)
+		discardPresence(t, sc)
+
+		iq, r := readRegisterIQ(t, sc)
+		if r != nil {
+			username, _ := r.Field(stanza.RegisterUsername)
+			password, _ := r.Field(stanza.RegisterPassword)
+			if username != "juliet" || password != "new-password" {
+				t.Errorf("unexpected password change request: %+v", r.Fields)
+			}
+		}
+		fmt.Fprintf(sc.connection, `<iq type='result' id='%s' from='localhost'/>`, iq.Id)
+
+		iq, r = readRegisterIQ(t, sc)
+		if r == nil || r.Remove == nil {
+			t.Errorf("expected account cancellation, got %+v", iq)
+		}
+		fmt.Fprintf(sc.connection, `<iq type='result' id='%s' from='localhost'/>`, iq.Id)
+		close(done)
+	})
+	defer mock.Stop()
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("XMPP connection failed: %s", err)
+	}
+	expiry := time.Now().Add(time.Hour)
+	client.config.Credential = client.config.Credential.WithAuthzid("juliet@localhost").WithExpiry(expiry)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	if err := client.ChangePassword(ctx, "new-password"); err != nil {
+		t.Errorf("password change failed: %s", err)
+	}
+	if credential := client.config.Credential; credential.secret != "new-password" {
+		t.Error("new password should be used for the next connections")
+	} else if credential.authzid != "juliet@localhost" || !credential.expiry.Equal(expiry) {
+		t.Errorf("the credential should be kept, with the new password: %+v", credential)
+	}
+	if err := client.CancelRegistration(ctx); err != nil {
+		t.Errorf("account cancellation failed: %s", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(defaultTimeout):
+		t.Error("server did not receive the registration requests")
+	}
+}
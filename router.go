@@ -42,17 +42,6 @@ func NewRouter() *Router {
 // route is called by the XMPP client to dispatch stanza received using the set up routes.
 // It is also used by test, but is not supposed to be used directly by users of the library.
 func (r *Router) route(s Sender, p stanza.Packet) {
-	a, isA := p.(stanza.SMAnswer)
-	if isA {
-		switch tt := s.(type) {
-		case *Client:
-			lastAcked := a.H
-			SendMissingStz(int(lastAcked), s, tt.Session.SMState.UnAckQueue)
-		case *Component:
-		// TODO
-		default:
-		}
-	}
 	iq, isIq := p.(*stanza.IQ)
 	if isIq {
 		r.IQResultRouteLock.RLock()
@@ -81,30 +70,30 @@ func (r *Router) route(s Sender, p stanza.Packet) {
 	}
 }
 
-// SendMissingStz sends all stanzas that did not reach the server, according to the response to an ack request (see XEP-0198, acks)
+// SendMissingStz sends the stanzas which did not reach the server again, according to the number of
+// stanzas it handled, for example when resuming a session (see XEP-0198, acks). The handled stanzas
+// are removed from the queue, and the stanzas sent again are counted from lastSent.
+//
+// Deprecated: the client sends the missing stanzas itself when it resumes the session.
 func SendMissingStz(lastSent int, s Sender, uaq *stanza.UnAckQueue) error {
 	uaq.RWMutex.Lock()
-	if len(uaq.Uslice) <= 0 {
+	if _, err := uaq.Acknowledge(uint(lastSent)); err != nil {
 		uaq.RWMutex.Unlock()
-		return nil
+		return err
 	}
-	last := uaq.Uslice[len(uaq.Uslice)-1]
-	if last.Id > lastSent {
-		// Remove sent stanzas from the queue
-		uaq.PopN(lastSent - last.Id)
-		// Re-send non acknowledged stanzas
-		for _, elt := range uaq.PopN(len(uaq.Uslice)) {
-			eltStz := elt.(*stanza.UnAckedStz)
-			err := s.SendRaw(eltStz.Stz)
-			if err != nil {
-				return err
-			}
+	// The stanzas are queued again when they are sent
+	missing := uaq.PopN(len(uaq.Uslice))
+	uaq.RWMutex.Unlock()
 
+	for _, elt := range missing {
+		eltStz := elt.(*stanza.UnAckedStz)
+		if err := s.SendRaw(eltStz.Stz); err != nil {
+			return err
 		}
-		// Ask for updates on stanzas we just sent to the entity. Not sure I should leave this. Maybe let users call ack again by themselves ?
-		s.Send(stanza.SMRequest{})
 	}
-	uaq.RWMutex.Unlock()
+	if len(missing) > 0 {
+		return s.Send(stanza.SMRequest{})
+	}
 	return nil
 }
 
@@ -301,6 +301,10 @@ func (s SenderMock) Send(packet stanza.Packet) error {
 	return nil
 }
 
+func (s SenderMock) SendContext(ctx context.Context, packet stanza.Packet) error {
+	return s.Send(packet)
+}
+
 func (s SenderMock) SendIQ(ctx context.Context, iq *stanza.IQ) (chan stanza.IQ, error) {
 	out, err := xml.Marshal(iq)
 	if err != nil {
@@ -315,6 +319,10 @@ func (s SenderMock) SendRaw(str string) error {
 	return nil
 }
 
+func (s SenderMock) SendRawContext(ctx context.Context, str string) error {
+	return s.SendRaw(str)
+}
+
 func (s SenderMock) String() string {
 	return s.buffer.String()
 }
@@ -1,11 +1,24 @@
 package xmpp
 
 import (
+	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"gosrc.io/xmpp/stanza"
-	"strconv"
+	"io"
+)
+
+// NegotiationPath tells how the session was authenticated and bound.
+type NegotiationPath string
+
+const (
+	// PathLegacy is SASL authentication, followed by a stream restart and resource binding
+	PathLegacy NegotiationPath = "legacy"
+	// PathSASL2 is SASL2 authentication (XEP-0388), followed by resource binding
+	PathSASL2 NegotiationPath = "sasl2"
+	// PathSASL2Bind2 is SASL2 authentication with inline resource binding (XEP-0386)
+	PathSASL2Bind2 NegotiationPath = "sasl2-bind2"
 )
 
 type Session struct {
@@ -15,7 +28,13 @@ type Session struct {
 	SMState      SMState
 	Features     stanza.StreamFeatures
 	TlsEnabled   bool
+	credential   Credential      // Credential used for the current authentication
+	Path         NegotiationPath // Negotiation path taken to open the session
+	Resumed      bool            // Stream management session was resumed instead of binding a new resource
+	Resumption   ResumptionPath  // How the client reconnected, when it had a stream management session to resume
 	lastPacketId int
+	// handled is the number of stanzas handled by the server, when resuming the stream management session
+	handled *uint
 
 	// read / write
 	transport Transport
@@ -25,6 +44,12 @@ type Session struct {
 }
 
 func NewSession(c *Client, state SMState) (*Session, error) {
+	return newSessionContext(context.Background(), c, state)
+}
+
+// newSessionContext is like NewSession. The credential provider is cancelled when the context is
+// done.
+func newSessionContext(ctx context.Context, c *Client, state SMState) (*Session, error) {
 	var s *Session
 	if c.Session == nil {
 		s = new(Session)
@@ -33,6 +58,8 @@ func NewSession(c *Client, state SMState) (*Session, error) {
 		s.init()
 	} else {
 		s = c.Session
+		// The transport may have changed, after a redirect or with another connection method
+		s.transport = c.transport
 		// We keep information about the previously set session, like the session ID, but we read server provided
 		// info again in case it changed between session break and resume, such as features.
 		s.init()
@@ -43,6 +70,9 @@ func NewSession(c *Client, state SMState) (*Session, error) {
 	}
 
 	if !c.transport.IsSecure() {
+		if _, ok := s.Features.DoesStartTLS(); ok {
+			c.updateState(StateTLSNegotiating)
+		}
 		s.startTlsIfSupported(c.config)
 	}
 
@@ -56,36 +86,20 @@ func NewSession(c *Client, state SMState) (*Session, error) {
 	}
 
 	// auth
-	s.auth(c.config)
-	if s.err != nil {
-		return s, s.err
-	}
-	s.reset()
-	if s.err != nil {
-		return s, s.err
-	}
-
-	// attempt resumption
-	if s.resume(c.config) {
-		return s, s.err
-	}
-
-	// otherwise, bind resource and 'start' XMPP session
-	s.bind(c.config)
-	if s.err != nil {
-		return s, s.err
-	}
-	s.rfc3921Session()
+	s.Resumed = false
+	s.handled = nil
+	c.updateState(StateAuthenticating)
+	s.authenticate(ctx, c)
 	if s.err != nil {
 		return s, s.err
 	}
-
-	// Enable stream management if supported
-	s.EnableStreamManagement(c.config)
-	if s.err != nil {
+	if s.Resumed || s.Path == PathSASL2Bind2 {
 		return s, s.err
 	}
 
+	// attempt resumption, otherwise bind resource, 'start' XMPP session and enable stream
+	// management if supported
+	s.negotiateStreamManagement(c)
 	return s, s.err
 }
 
@@ -108,8 +122,31 @@ func (s *Session) reset() {
 }
 
 func (s *Session) extractStreamFeatures() (f stanza.StreamFeatures) {
+	decoder := s.transport.GetDecoder()
+	se, err := stanza.NextStart(decoder)
+	if err != nil {
+		s.err = errors.New("stream open decode features: " + err.Error())
+		return
+	}
+	// The server may reject or redirect the stream instead of sending its features
+	if se.Name.Space == stanza.NSStream && se.Name.Local == "error" {
+		var streamErr stanza.StreamError
+		if s.err = decoder.DecodeElement(&streamErr, &se); s.err != nil {
+			return
+		}
+		if streamErr.Error.Local == "see-other-host" && streamErr.SeeOtherHost != "" {
+			s.err = &RedirectError{Address: streamErr.SeeOtherHost}
+			return
+		}
+		s.err = errors.New("stream error: " + streamErr.Error.Local)
+		if streamErr.Text != "" {
+			s.err = errors.New("stream error: " + streamErr.Error.Local + ": " + streamErr.Text)
+		}
+		return
+	}
+
 	// extract stream features
-	if s.err = s.transport.GetDecoder().Decode(&f); s.err != nil {
+	if s.err = decoder.DecodeElement(&f, &se); s.err != nil {
 		s.err = errors.New("stream open decode features: " + s.err.Error())
 	}
 	return
@@ -150,51 +187,341 @@ func (s *Session) startTlsIfSupported(o *Config) {
 	}
 }
 
+// authenticate gets the credential from the client and authenticates with SASL2 when supported,
+// or with legacy SASL. If the server rejects the credential as expired, it is refreshed and
+// authentication is attempted once more on the same stream.
+func (s *Session) authenticate(ctx context.Context, c *Client) {
+	if s.err != nil {
+		return
+	}
+	if s.credential, s.err = c.credential(ctx, false); s.err != nil {
+		return
+	}
+	s.authenticateWithCredential(c)
+	if s.err == nil || c.config.CredentialProvider == nil || !s.credential.rejectedAsExpired(s.err) {
+		return
+	}
+
+	if s.credential, s.err = c.credential(ctx, true); s.err != nil {
+		return
+	}
+	s.authenticateWithCredential(c)
+}
+
+func (s *Session) authenticateWithCredential(c *Client) {
+	s.err = nil
+	if s.Features.DoesSASL2() && !c.config.DisableSASL2 {
+		// SASL2 does not restart the stream, and can bind the resource or resume the session inline
+		s.Path = PathSASL2
+		s.authSASL2(c.config, &c.EventManager)
+		return
+	}
+
+	s.Path = PathLegacy
+	s.auth(c.config)
+	if s.err != nil {
+		return
+	}
+	s.reset()
+}
+
 func (s *Session) auth(o *Config) {
 	if s.err != nil {
 		return
 	}
 
-	s.err = authSASL(s.transport, s.transport.GetDecoder(), s.Features, o.parsedJid.Node, o.Credential)
+	s.err = authSASL(s.transport, s.transport.GetDecoder(), s.Features, o.parsedJid.Node, s.credential)
+}
+
+// saslExchange drives a SASL authentication exchange with the server, for any mechanism:
+// it sends the initial response, answers challenges until the server reports success or
+// failure, then lets the mechanism verify the success additional data.
+func saslExchange(socket io.ReadWriter, decoder *xml.Decoder, mech SASLMechanism, session *SASLSession) error {
+	initial, err := mech.Start(session)
+	if err != nil {
+		return NewConnError(err, true)
+	}
+	a := stanza.SASLAuth{Mechanism: mech.Name()}
+	if initial != nil {
+		a.Value = saslEncode(initial)
+	}
+	if err = sendSASLNonza(socket, a); err != nil {
+		return err
+	}
+
+	for {
+		val, err := stanza.NextPacket(decoder)
+		if err != nil {
+			return err
+		}
+
+		switch v := val.(type) {
+		case stanza.SASLChallenge:
+			challenge, err := saslDecode(v.Value)
+			if err != nil {
+				return NewConnError(errors.New("invalid SASL challenge encoding: "+err.Error()), true)
+			}
+			resp, err := mech.Next(challenge)
+			if err != nil {
+				return NewConnError(err, true)
+			}
+			if err = sendSASLNonza(socket, stanza.SASLResponse{Value: saslEncode(resp)}); err != nil {
+				return err
+			}
+		case stanza.SASLSuccess:
+			data, err := saslDecode(v.Value)
+			if err != nil {
+				return NewConnError(errors.New("invalid SASL success encoding: "+err.Error()), true)
+			}
+			if err = mech.Verify(data); err != nil {
+				return NewConnError(err, true)
+			}
+			return nil
+		case stanza.SASLFailure:
+			return saslFailureError(v)
+		default:
+			return errors.New("expected SASL challenge, success or failure, got " + v.Name())
+		}
+	}
+}
+
+// authSASL2 authenticates with SASL2 (XEP-0388). When the server supports it, the previous
+// stream management session is resumed inline, and the resource is bound with Bind2 (XEP-0386),
+// enabling stream management at the same time.
+// When a token store is configured and the server supports FAST (XEP-0484), the stored token is
+// tried first, falling back to the credential if the server rejects it.
+func (s *Session) authSASL2(o *Config, em *EventManager) {
+	if s.err != nil {
+		return
+	}
+
+	binder, _ := s.transport.(ChannelBinder)
+	var a stanza.SASL2Authenticate
+	var success stanza.SASL2Success
+	var tokenMech string
+
+	if token := s.loadFastToken(o, binder, em); token != nil {
+		tokenMech = token.Mechanism
+		a, success, s.err = s.authFastToken(o, binder, *token)
+		if s.err != nil {
+			var failure saslFailure
+			if !errors.As(s.err, &failure) {
+				return
+			}
+			// The token has been rejected: forget it and authenticate with the credential
+			s.err = nil
+			tokenMech = ""
+			em.tokenChanged(TokenEvent{Type: TokenInvalidated, Token: *token, Err: o.TokenStore.DeleteToken(o.parsedJid.Bare())})
+		}
+	}
+
+	if tokenMech == "" {
+		mech, session, err := selectSASLMechanism(s.transport, s.Features, s.Features.Authentication.Mechanisms,
+			o.parsedJid.Node, s.credential)
+		if err != nil {
+			s.err = err
+			return
+		}
+		initial, err := mech.Start(session)
+		if err != nil {
+			s.err = NewConnError(err, true)
+			return
+		}
+		a = s.sasl2Request(o, mech.Name(), initial)
+		if o.TokenStore != nil && s.Features.DoesFast() {
+			if tokenMech, _ = selectFastMechanism(binder, s.Features.Authentication.Inline.Fast.Mechanisms); tokenMech != "" {
+				a.Extensions = append(a.Extensions, stanza.FastRequestToken{Mechanism: tokenMech})
+			}
+		}
+		if success, s.err = sasl2Exchange(s.transport, s.transport.GetDecoder(), a, mech); s.err != nil {
+			return
+		}
+	}
+
+	// The server sends a token when we requested one, or when it rotates the token we used
+	if success.Token != nil && tokenMech != "" {
+		token := fastToken(tokenMech, *success.Token)
+		em.tokenChanged(TokenEvent{Type: TokenStored, Token: token, Err: o.TokenStore.StoreToken(o.parsedJid.Bare(), token)})
+	}
+
+	if a.Resume != nil {
+		if success.Resumed != nil && success.Resumed.PrevId == s.SMState.Id {
+			s.Resumed = true
+			s.handled = success.Resumed.H
+		} else {
+			// Resumption failed: the server binds a new resource if we asked for it
+			s.SMState = SMState{}
+		}
+	}
+	if success.Bound != nil {
+		s.BindJid = success.AuthorizationIdentifier
+		s.Path = PathSASL2Bind2
+		var n smNegotiation
+		switch {
+		case success.Bound.Enabled != nil:
+			s.err = n.enabled(*success.Bound.Enabled)
+		case success.Bound.Failed != nil:
+			s.err = n.enabled(*success.Bound.Failed)
+		}
+		s.smNegotiated(o, n)
+	}
+
+	// The stream is not restarted: the server sends the post-authentication features right away.
+	s.Features = s.extractStreamFeatures()
+	if s.err != nil || s.Resumed {
+		return
+	}
+	if s.Path == PathSASL2Bind2 && (a.Bind == nil || a.Bind.Enable == nil) {
+		s.EnableStreamManagement(o)
+	}
 }
 
-// Attempt to resume session using stream management
-func (s *Session) resume(o *Config) bool {
-	if !s.Features.DoesStreamManagement() {
-		return false
+// sasl2Request prepares the SASL2 authenticate nonza, with the requests for inline features.
+func (s *Session) sasl2Request(o *Config, mechanism string, initial []byte) stanza.SASL2Authenticate {
+	a := stanza.SASL2Authenticate{Mechanism: mechanism, UserAgent: o.UserAgent}
+	if initial != nil {
+		a.InitialResponse = saslEncode(initial)
+	}
+	if s.SMState.Id != "" && s.Features.DoesInlineStreamManagement() {
+		a.Resume = &stanza.SMResume{PrevId: s.SMState.Id, H: &s.SMState.Inbound}
 	}
-	if s.SMState.Id == "" {
-		return false
+	if s.Features.DoesBind2() {
+		a.Bind = &stanza.Bind2Request{Tag: o.parsedJid.Resource}
+		if o.StreamManagementEnable && s.Features.Authentication.Inline.Bind.SupportsInline(stanza.NSStreamManagement) {
+			a.Bind.Enable = &stanza.SMEnable{Resume: &o.streamManagementResume}
+		}
 	}
+	return a
+}
 
-	rsm := stanza.SMResume{
-		PrevId: s.SMState.Id,
-		H:      &s.SMState.Inbound,
+// loadFastToken returns the stored FAST token, if the server supports it and it can be used on
+// this transport. Expired tokens are removed from the store.
+func (s *Session) loadFastToken(o *Config, binder ChannelBinder, em *EventManager) *FastToken {
+	if o.TokenStore == nil || !s.Features.DoesFast() {
+		return nil
+	}
+	// A failing store must not prevent authenticating with the credential.
+	token, err := o.TokenStore.LoadToken(o.parsedJid.Bare())
+	if err != nil || token == nil {
+		return nil
 	}
-	data, err := xml.Marshal(rsm)
+	if token.Expired() {
+		em.tokenChanged(TokenEvent{Type: TokenInvalidated, Token: *token, Err: o.TokenStore.DeleteToken(o.parsedJid.Bare())})
+		return nil
+	}
+	mech := newHTMechanism(token.Mechanism, token.Token)
+	if mech == nil || !isSupportedMech(token.Mechanism, s.Features.Authentication.Inline.Fast.Mechanisms) {
+		return nil
+	}
+	if mech.cbType != "" && (binder == nil || !isSupportedMech(mech.cbType, binder.ChannelBindingTypes())) {
+		return nil
+	}
+	return token
+}
 
-	_, err = s.transport.Write(data)
+// authFastToken authenticates with a FAST token. The token use count is saved before
+// sending it to the server.
+func (s *Session) authFastToken(o *Config, binder ChannelBinder, token FastToken) (stanza.SASL2Authenticate, stanza.SASL2Success, error) {
+	mech := newHTMechanism(token.Mechanism, token.Token)
+	session := &SASLSession{
+		Username:   o.parsedJid.Node,
+		Mechanisms: s.Features.Authentication.Inline.Fast.Mechanisms,
+	}
+	if mech.cbType != "" {
+		data, err := binder.ChannelBinding(mech.cbType)
+		if err != nil {
+			return stanza.SASL2Authenticate{}, stanza.SASL2Success{}, NewConnError(err, true)
+		}
+		session.ChannelBindingType = mech.cbType
+		session.ChannelBinding = data
+	}
+	initial, err := mech.Start(session)
 	if err != nil {
-		return false
+		return stanza.SASL2Authenticate{}, stanza.SASL2Success{}, NewConnError(err, true)
 	}
-	var packet stanza.Packet
-	packet, s.err = stanza.NextPacket(s.transport.GetDecoder())
-	if s.err == nil {
-		switch p := packet.(type) {
-		case stanza.SMResumed:
-			if p.PrevId != s.SMState.Id {
-				s.err = errors.New("session resumption: mismatched id")
-				s.SMState = SMState{}
-				return false
+
+	token.Count++
+	if err = o.TokenStore.StoreToken(o.parsedJid.Bare(), token); err != nil {
+		return stanza.SASL2Authenticate{}, stanza.SASL2Success{}, err
+	}
+	a := s.sasl2Request(o, mech.Name(), initial)
+	a.Extensions = append(a.Extensions, stanza.FastAuth{Count: token.Count})
+	success, err := sasl2Exchange(s.transport, s.transport.GetDecoder(), a, mech)
+	return a, success, err
+}
+
+// sasl2Exchange sends the SASL2 authenticate nonza, and answers the challenges sent by the server
+// until it reports success or failure, then lets the mechanism verify the success additional data.
+func sasl2Exchange(socket io.ReadWriter, decoder *xml.Decoder, a stanza.SASL2Authenticate, mech SASLMechanism) (stanza.SASL2Success, error) {
+	if err := sendSASLNonza(socket, a); err != nil {
+		return stanza.SASL2Success{}, err
+	}
+	for {
+		val, err := stanza.NextPacket(decoder)
+		if err != nil {
+			return stanza.SASL2Success{}, err
+		}
+
+		switch v := val.(type) {
+		case stanza.SASL2Challenge:
+			challenge, err := saslDecode(v.Value)
+			if err != nil {
+				return stanza.SASL2Success{}, NewConnError(errors.New("invalid SASL2 challenge encoding: "+err.Error()), true)
+			}
+			resp, err := mech.Next(challenge)
+			if err != nil {
+				return stanza.SASL2Success{}, NewConnError(err, true)
+			}
+			if err = sendSASLNonza(socket, stanza.SASL2Response{Value: saslEncode(resp)}); err != nil {
+				return stanza.SASL2Success{}, err
+			}
+		case stanza.SASL2Success:
+			data, err := saslDecode(v.AdditionalData)
+			if err != nil {
+				return v, NewConnError(errors.New("invalid SASL2 additional data encoding: "+err.Error()), true)
 			}
-			return true
-		case stanza.SMFailed:
+			if err = mech.Verify(data); err != nil {
+				return v, NewConnError(err, true)
+			}
+			return v, nil
+		case stanza.SASL2Failure:
+			return stanza.SASL2Success{}, NewConnError(saslFailure{condition: v.Condition.Local, text: v.Text}, true)
+		case stanza.SASL2Continue:
+			return stanza.SASL2Success{}, NewConnError(fmt.Errorf("unsupported SASL2 tasks requested by server: %v", v.Tasks), true)
 		default:
-			s.err = errors.New("unexpected reply to SM resume")
+			return stanza.SASL2Success{}, errors.New("expected SASL2 challenge, success or failure, got " + v.Name())
 		}
 	}
-	s.SMState = SMState{}
-	return false
+}
+
+// negotiateStreamManagement attempts to resume the session using stream management. Otherwise, it
+// binds the resource, then enables stream management if supported.
+func (s *Session) negotiateStreamManagement(c *Client) {
+	o := c.config
+	var state SMState
+	supported := s.Features.DoesStreamManagement()
+	if supported {
+		state = s.SMState
+	}
+	n, err := negotiateSM(s.transport, state, supported && o.StreamManagementEnable, o.streamManagementResume, func() error {
+		c.updateState(StateBinding)
+		s.bind(o)
+		s.rfc3921Session()
+		return s.err
+	})
+	s.handled = n.handled
+	if n.resumed {
+		s.Resumed = true
+		return
+	}
+	if state.Id != "" {
+		// The resumption failed
+		s.SMState = SMState{}
+	}
+	s.smNegotiated(o, n)
+	if s.err == nil {
+		s.err = err
+	}
 }
 
 func (s *Session) bind(o *Config) {
@@ -303,40 +630,22 @@ func (s *Session) EnableStreamManagement(o *Config) {
 	if !s.Features.DoesStreamManagement() || !o.StreamManagementEnable {
 		return
 	}
-	q := stanza.NewUnAckQueue()
-	ebleNonza := stanza.SMEnable{Resume: &o.streamManagementResume}
-	pktStr, err := xml.Marshal(ebleNonza)
-	if err != nil {
-		s.err = err
-		return
-	}
-	_, err = s.transport.Write(pktStr)
-	if err != nil {
-		s.err = err
+	n, err := negotiateSM(s.transport, SMState{}, true, o.streamManagementResume, nil)
+	s.smNegotiated(o, n)
+	s.err = err
+}
+
+// smNegotiated updates the session state when the server accepted or refused to enable stream
+// management.
+func (s *Session) smNegotiated(o *Config, n smNegotiation) {
+	if n.state.UnAckQueue == nil {
+		// Stream management was not enabled
 		return
 	}
-
-	var packet stanza.Packet
-	packet, s.err = stanza.NextPacket(s.transport.GetDecoder())
-	if s.err == nil {
-		switch p := packet.(type) {
-		case stanza.SMEnabled:
-			// Server allows resumption or not using SMEnabled attribute "resume". We must read the server response
-			// and update config accordingly
-			b, err := strconv.ParseBool(p.Resume)
-			if err != nil || !b {
-				o.StreamManagementEnable = false
-			}
-			s.SMState = SMState{Id: p.Id, preferredReconAddr: p.Location}
-			s.SMState.UnAckQueue = q
-		case stanza.SMFailed:
-			// TODO: Store error in SMState, for later inspection
-			s.SMState = SMState{StreamErrorGroup: p.StreamErrorGroup}
-			s.SMState.UnAckQueue = q
-			s.err = errors.New("failed to establish session : " + s.SMState.StreamErrorGroup.GroupErrorName())
-		default:
-			s.err = errors.New("unexpected reply to SM enable")
-		}
+	// Server allows resumption or not using SMEnabled attribute "resume". We must read the server response
+	// and update config accordingly
+	if !n.failed && !n.resumable {
+		o.StreamManagementEnable = false
 	}
-	return
+	s.SMState = n.state
 }
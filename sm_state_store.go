@@ -0,0 +1,129 @@
+package xmpp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+// ============================================================================
+// Stream management state persistence
+
+// SMStateStore persists the stream management state (XEP-0198), so that the session and its
+// unacknowledged stanzas can be resumed after the process restarts. States are stored per full JID.
+type SMStateStore interface {
+	// LoadSMState returns the state for the JID, or nil if there is none.
+	LoadSMState(jid string) (*SMState, error)
+	// StoreSMState saves the state for the JID, replacing the previous one.
+	StoreSMState(jid string, state SMState) error
+	// DeleteSMState removes the state for the JID, when the session cannot be resumed anymore.
+	DeleteSMState(jid string) error
+}
+
+// FileSMStateStore is a SMStateStore saving the states as JSON files in a directory, one file per
+// JID. The files contain the unacknowledged stanzas, and are only readable by their owner.
+type FileSMStateStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileSMStateStore returns a store saving the states in the directory. The directory is created
+// when the first state is saved.
+func NewFileSMStateStore(dir string) *FileSMStateStore {
+	return &FileSMStateStore{dir: dir}
+}
+
+// smStateFile is the content of a state file.
+type smStateFile struct {
+	Id        string    `json:"id"`
+	Inbound   uint      `json:"inbound"`
+	Location  string    `json:"location,omitempty"`
+	Max       uint      `json:"max,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Lost      time.Time `json:"lost,omitzero"`
+	// Handled is the number of stanzas handled by the server, before the unacknowledged ones
+	Handled uint     `json:"handled"`
+	Unacked []string `json:"unacked,omitempty"`
+}
+
+func (s *FileSMStateStore) path(jid string) string {
+	return filepath.Join(s.dir, url.PathEscape(jid)+".json")
+}
+
+func (s *FileSMStateStore) LoadSMState(jid string) (*SMState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path(jid))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f smStateFile
+	if err = json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+
+	state := SMState{Id: f.Id, Inbound: f.Inbound, Location: f.Location, Max: f.Max, Timestamp: f.Timestamp,
+		Lost: f.Lost}
+	state.UnAckQueue = stanza.NewUnAckQueue()
+	state.UnAckQueue.Handled = f.Handled
+	for _, stz := range f.Unacked {
+		_ = state.UnAckQueue.Push(&stanza.UnAckedStz{Stz: stz})
+	}
+	return &state, nil
+}
+
+func (s *FileSMStateStore) StoreSMState(jid string, state SMState) error {
+	f := smStateFile{Id: state.Id, Inbound: state.Inbound, Location: state.Location, Max: state.Max,
+		Timestamp: state.Timestamp, Lost: state.Lost}
+	if state.UnAckQueue != nil {
+		state.UnAckQueue.RLock()
+		f.Handled = state.UnAckQueue.Handled
+		for _, stz := range state.UnAckQueue.Uslice {
+			f.Unacked = append(f.Unacked, stz.Stz)
+		}
+		state.UnAckQueue.RUnlock()
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	// The file is replaced atomically, so that a crash does not leave a partial state
+	tmp, err := os.CreateTemp(s.dir, ".smstate-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(jid))
+}
+
+func (s *FileSMStateStore) DeleteSMState(jid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path(jid)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package xmpp
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+func TestFileSMStateStore(t *testing.T) {
+	store := NewFileSMStateStore(t.TempDir())
+	jid := "test@localhost/bot"
+
+	if state, err := store.LoadSMState(jid); err != nil || state != nil {
+		t.Fatalf("expected no state, got %v, %v", state, err)
+	}
+
+	queue := stanza.NewUnAckQueue()
+	queue.Handled = 41
+	_ = queue.Push(&stanza.UnAckedStz{Stz: "<message id='m1'/>"})
+	state := SMState{Id: "sm-id", Inbound: 12, Location: "[2001:db8::1]:5222", Max: 300,
+		Timestamp: time.Now(), Lost: time.Now().Add(-time.Minute), UnAckQueue: queue}
+	if err := store.StoreSMState(jid, state); err != nil {
+		t.Fatalf("cannot store state: %s", err)
+	}
+
+	loaded, err := store.LoadSMState(jid)
+	if err != nil || loaded == nil {
+		t.Fatalf("cannot load state: %v", err)
+	}
+	if loaded.Id != state.Id || loaded.Inbound != state.Inbound || loaded.Location != state.Location ||
+		loaded.Max != state.Max || !loaded.Timestamp.Equal(state.Timestamp) || !loaded.Lost.Equal(state.Lost) {
+		t.Errorf("unexpected state: %+v", loaded)
+	}
+	if len(loaded.Uslice) != 1 || loaded.Uslice[0].Id != 42 || loaded.Uslice[0].Stz != "<message id='m1'/>" {
+		t.Errorf("unexpected unacknowledged stanzas: %v", loaded.Uslice)
+	}
+
+	if err = store.DeleteSMState(jid); err != nil {
+		t.Fatalf("cannot delete state: %s", err)
+	}
+	if loaded, err = store.LoadSMState(jid); err != nil || loaded != nil {
+		t.Errorf("state should be deleted, got %v, %v", loaded, err)
+	}
+}
+
+func TestClient_SMStateStoreExpired(t *testing.T) {
+	store := NewFileSMStateStore(t.TempDir())
+	config := &Config{
+		Jid:                    "test@localhost/bot",
+		Credential:             Password("test"),
+		StreamManagementEnable: true,
+		SMStateStore:           store,
+	}
+	state := SMState{Id: "sm-id", Max: 60, Timestamp: time.Now().Add(-time.Hour)}
+	if err := store.StoreSMState(config.Jid, state); err != nil {
+		t.Fatalf("cannot store state: %s", err)
+	}
+
+	client, err := NewClient(config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	if client.Session != nil {
+		t.Error("expired state should not be resumed")
+	}
+	if loaded, _ := store.LoadSMState(config.Jid); loaded != nil {
+		t.Error("expired state should be deleted")
+	}
+}
+
+// The client resumes the session from the saved state, and sends the stanzas not handled by the
+// server again.
+func TestClient_SMStateStoreResume(t *testing.T) {
+	serverDone := make(chan struct{})
+	mock := ServerMock{}
+	address := fmt.Sprintf("%s:%d", testClientDomain, testClientSMStateStore)
+	mock.Start(t, address, func(t *testing.T, sc *ServerConn) {
+		defer close(serverDone)
+		checkClientOpenStream(t, sc)
+		sendStreamFeatures(t, sc)
+		readAuth(t, sc.decoder)
+		fmt.Fprintln(sc.connection, "<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>")
+		checkClientOpenStream(t, sc)
+		sendFeaturesStreamManagment(t, sc)
+
+		p, err := stanza.NextPacket(sc.decoder)
+		if err != nil {
+			t.Errorf("cannot read resume request: %s", err)
+			return
+		}
+		resume, ok := p.(stanza.SMResume)
+		if !ok || resume.PrevId != streamManagementID || resume.H == nil || *resume.H != 5 {
+			t.Errorf("unexpected resume request: %#v", p)
+			return
+		}
+		fmt.Fprintf(sc.connection, "<resumed xmlns='urn:xmpp:sm:3' previd='%s' h='1'/>", streamManagementID)
+
+		// The first stanza was handled: only the second one is sent again, without initial presence
+		p, err = stanza.NextPacket(sc.decoder)
+		if err != nil {
+			t.Errorf("cannot read resent stanza: %s", err)
+			return
+		}
+		if msg, ok := p.(stanza.Message); !ok || msg.Id != "m2" {
+			t.Errorf("expected second message to be sent again, got %#v", p)
+		}
+	})
+	defer mock.Stop()
+
+	store := NewFileSMStateStore(t.TempDir())
+	config := &Config{
+		TransportConfiguration: TransportConfiguration{Address: address},
+		Jid:                    "test@localhost/bot",
+		Credential:             Password("test"),
+		Insecure:               true,
+		StreamManagementEnable: true,
+		SMStateStore:           store,
+	}
+	queue := stanza.NewUnAckQueue()
+	_ = queue.Push(&stanza.UnAckedStz{Stz: "<message id='m1'/>"})
+	_ = queue.Push(&stanza.UnAckedStz{Stz: "<message id='m2'/>"})
+	state := SMState{Id: streamManagementID, Inbound: 5, Max: 300, Timestamp: time.Now(), UnAckQueue: queue}
+	if err := store.StoreSMState(config.Jid, state); err != nil {
+		t.Fatalf("cannot store state: %s", err)
+	}
+
+	client, err := NewClient(config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	sub := client.Subscribe(16)
+	if err = client.Connect(); err != nil {
+		sub.Close()
+		t.Fatalf("cannot resume session: %s", err)
+	}
+	// The receiving goroutine saves the state until it stops: it must be done before the temporary
+	// directory is removed
+	t.Cleanup(func() {
+		defer sub.Close()
+		// The mock server does not close the stream
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_ = client.DisconnectContext(ctx)
+		for {
+			select {
+			case e := <-sub.C:
+				if e.State.getState() == StateDisconnected && e.Err != nil {
+					return
+				}
+			case <-time.After(defaultTimeout):
+				t.Error("client did not stop receiving")
+				return
+			}
+		}
+	})
+	waitForEntity(t, serverDone)
+
+	if !client.Session.Resumed {
+		t.Error("session should be resumed")
+	}
+	saved, err := store.LoadSMState(config.Jid)
+	if err != nil || saved == nil {
+		t.Fatalf("state should be saved after resumption: %v", err)
+	}
+	if saved.Uslice[0].Id != 2 || saved.Handled != 1 {
+		t.Errorf("unexpected saved state: handled %d, stanzas %v", saved.Handled, saved.Uslice)
+	}
+}
@@ -0,0 +1,46 @@
+package stanza
+
+import (
+	"encoding/xml"
+)
+
+// ============================================================================
+// Fast Authentication Streamlining Tokens (FAST)
+// Reference: XEP-0484 - https://xmpp.org/extensions/xep-0484.html
+
+const NSFast = "urn:xmpp:fast:0"
+
+// FastFeature is advertised inline in SASL2 authentication feature, with the token mechanisms
+// supported by the server.
+type FastFeature struct {
+	XMLName    xml.Name `xml:"urn:xmpp:fast:0 fast"`
+	Mechanisms []string `xml:"mechanism"`
+}
+
+// FastRequestToken is sent inline in SASL2 authenticate to request a new token for the mechanism.
+type FastRequestToken struct {
+	XMLName   xml.Name `xml:"urn:xmpp:fast:0 request-token"`
+	Mechanism string   `xml:"mechanism,attr"`
+}
+
+// FastAuth is sent inline in SASL2 authenticate when authenticating with a token.
+// Count is incremented by the client on each use of the token, to prevent replays.
+// Invalidate asks the server to revoke the token after authentication.
+type FastAuth struct {
+	XMLName    xml.Name `xml:"urn:xmpp:fast:0 fast"`
+	Count      uint     `xml:"count,attr"`
+	Invalidate bool     `xml:"invalidate,attr,omitempty"`
+}
+
+// FastToken is sent by the server in SASL2 success, when a token was requested, or when the
+// token used to authenticate was rotated.
+type FastToken struct {
+	XMLName xml.Name `xml:"urn:xmpp:fast:0 token"`
+	Token   string   `xml:"token,attr"`
+	Expiry  string   `xml:"expiry,attr"` // XEP-0082 date time
+}
+
+// DoesFast returns true if the server supports FAST token authentication inline with SASL2.
+func (sf *StreamFeatures) DoesFast() bool {
+	return sf.DoesSASL2() && sf.Authentication.Inline != nil && sf.Authentication.Inline.Fast != nil
+}
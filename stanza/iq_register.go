@@ -0,0 +1,127 @@
+package stanza
+
+import (
+	"encoding/xml"
+)
+
+// ============================================================================
+// In-Band Registration (XEP-0077)
+// Reference: https://xmpp.org/extensions/xep-0077.html
+
+const (
+	NSRegister        = "jabber:iq:register"
+	NSRegisterFeature = "http://jabber.org/features/iq-register"
+)
+
+// Registration fields defined by XEP-0077
+const (
+	RegisterUsername = "username"
+	RegisterPassword = "password"
+	RegisterEmail    = "email"
+	RegisterNick     = "nick"
+	RegisterName     = "name"
+	RegisterKey      = "key"
+)
+
+// Register is the in-band registration query. When requesting the registration fields, the
+// server replies with the fields it expects, empty, in the legacy form, or as a data form
+// (XEP-0004). The client then submits the same query type, with the values filled.
+type Register struct {
+	XMLName      xml.Name  `xml:"jabber:iq:register query"`
+	Instructions string    `xml:"instructions,omitempty"`
+	Registered   *struct{} `xml:"registered"`
+	Remove       *struct{} `xml:"remove"`
+	// Form is the extensible registration form, used instead of Fields when present.
+	Form *Form `xml:"jabber:x:data x,omitempty"`
+	// Fields are the legacy registration fields, like username or password.
+	Fields []RegisterField `xml:",any"`
+	// Result sets
+	ResultSet *ResultSet `xml:"set,omitempty"`
+}
+
+// RegisterField is a legacy registration field, like <username/>.
+type RegisterField struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+func (r *Register) Namespace() string {
+	return r.XMLName.Space
+}
+
+func (r *Register) GetSet() *ResultSet {
+	return r.ResultSet
+}
+
+// IsRegistered returns true if the server reports that the entity is already registered.
+func (r *Register) IsRegistered() bool {
+	return r.Registered != nil
+}
+
+// Field returns the value of a legacy registration field, and whether the field is present.
+func (r *Register) Field(name string) (string, bool) {
+	for _, f := range r.Fields {
+		if f.XMLName.Local == name {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// FieldNames returns the names of the legacy registration fields, in the order sent by the server.
+func (r *Register) FieldNames() []string {
+	var names []string
+	for _, f := range r.Fields {
+		names = append(names, f.XMLName.Local)
+	}
+	return names
+}
+
+// SetField sets the value of a legacy registration field, adding it if needed.
+func (r *Register) SetField(name, value string) *Register {
+	for i := range r.Fields {
+		if r.Fields[i].XMLName.Local == name {
+			r.Fields[i].Value = value
+			return r
+		}
+	}
+	r.Fields = append(r.Fields, RegisterField{XMLName: xml.Name{Local: name}, Value: value})
+	return r
+}
+
+// ---------------
+// Builder helpers
+
+// Register builds a default registration query payload
+func (iq *IQ) Register() *Register {
+	r := Register{
+		XMLName: xml.Name{Space: NSRegister, Local: "query"},
+	}
+	iq.Payload = &r
+	return &r
+}
+
+// SetRemove turns the query into an account cancellation request
+func (r *Register) SetRemove() *Register {
+	r.Remove = &struct{}{}
+	return r
+}
+
+// ============================================================================
+// Stream feature
+
+type registerFeature struct {
+	XMLName xml.Name `xml:"http://jabber.org/features/iq-register register"`
+}
+
+// DoesRegister returns true if the server advertises in-band registration.
+func (sf *StreamFeatures) DoesRegister() bool {
+	return sf.Register.XMLName.Space == NSRegisterFeature
+}
+
+// ============================================================================
+// Registry init
+
+func init() {
+	TypeRegistry.MapExtension(PKTIQ, xml.Name{Space: NSRegister, Local: "query"}, Register{})
+}
@@ -0,0 +1,134 @@
+package stanza_test
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+// Registration fields returned by the server
+// https://xmpp.org/extensions/xep-0077.html#example-2
+func TestRegister_Fields(t *testing.T) {
+	response := `<iq type='result' id='reg1'>
+  <query xmlns='jabber:iq:register'>
+    <instructions>
+      Choose a username and password for use with this service.
+    </instructions>
+    <username/>
+    <password/>
+    <email/>
+  </query>
+</iq>`
+
+	var iq stanza.IQ
+	if err := xml.Unmarshal([]byte(response), &iq); err != nil {
+		t.Fatalf("cannot unmarshal registration fields: %s", err)
+	}
+	r, ok := iq.Payload.(*stanza.Register)
+	if !ok {
+		t.Fatalf("expected register payload, got %T", iq.Payload)
+	}
+	if !strings.Contains(r.Instructions, "Choose a username") {
+		t.Errorf("unexpected instructions: %q", r.Instructions)
+	}
+	if got := strings.Join(r.FieldNames(), ","); got != "username,password,email" {
+		t.Errorf("unexpected fields: %s", got)
+	}
+	if _, ok := r.Field(stanza.RegisterNick); ok {
+		t.Error("nick field should not be requested")
+	}
+	if r.IsRegistered() || r.Form != nil {
+		t.Errorf("unexpected registration state: %+v", r)
+	}
+}
+
+// Registration with a data form
+// https://xmpp.org/extensions/xep-0077.html#example-6
+func TestRegister_Form(t *testing.T) {
+	response := `<iq type='result' id='reg3'>
+  <query xmlns='jabber:iq:register'>
+    <instructions>Use the enclosed form to register.</instructions>
+    <x xmlns='jabber:x:data' type='form'>
+      <title>Contest Registration</title>
+      <field type='hidden' var='FORM_TYPE'><value>jabber:iq:register</value></field>
+      <field type='text-single' label='Given Name' var='first'><required/></field>
+    </x>
+  </query>
+</iq>`
+
+	var iq stanza.IQ
+	if err := xml.Unmarshal([]byte(response), &iq); err != nil {
+		t.Fatalf("cannot unmarshal registration form: %s", err)
+	}
+	r, ok := iq.Payload.(*stanza.Register)
+	if !ok {
+		t.Fatalf("expected register payload, got %T", iq.Payload)
+	}
+	if r.Form == nil || len(r.Form.Fields) != 2 || r.Form.Fields[1].Var != "first" {
+		t.Fatalf("unexpected registration form: %+v", r.Form)
+	}
+	if len(r.Fields) != 0 {
+		t.Errorf("form should not be parsed as legacy fields: %+v", r.Fields)
+	}
+}
+
+func TestRegister_Builder(t *testing.T) {
+	iq, err := stanza.NewIQ(stanza.Attrs{Type: stanza.IQTypeSet, Id: "reg2"})
+	if err != nil {
+		t.Fatalf("failed to create IQ: %v", err)
+	}
+	iq.Register().
+		SetField(stanza.RegisterUsername, "bill").
+		SetField(stanza.RegisterPassword, "Calliope").
+		SetField(stanza.RegisterUsername, "juliet")
+
+	parsedIQ, err := checkMarshalling(t, iq)
+	if err != nil {
+		return
+	}
+	r, ok := parsedIQ.Payload.(*stanza.Register)
+	if !ok {
+		t.Fatalf("expected register payload, got %T", parsedIQ.Payload)
+	}
+	if v, _ := r.Field(stanza.RegisterUsername); v != "juliet" {
+		t.Errorf("unexpected username: %q", v)
+	}
+	if v, _ := r.Field(stanza.RegisterPassword); v != "Calliope" {
+		t.Errorf("unexpected password: %q", v)
+	}
+	if len(r.Fields) != 2 || r.Remove != nil {
+		t.Errorf("unexpected registration request: %+v", r)
+	}
+}
+
+func TestRegister_Remove(t *testing.T) {
+	iq, err := stanza.NewIQ(stanza.Attrs{Type: stanza.IQTypeSet, Id: "unreg1"})
+	if err != nil {
+		t.Fatalf("failed to create IQ: %v", err)
+	}
+	iq.Register().SetRemove()
+
+	data, err := xml.Marshal(iq)
+	if err != nil {
+		t.Fatalf("cannot marshal iq: %s", err)
+	}
+	if !strings.Contains(string(data), `<query xmlns="jabber:iq:register"><remove></remove></query>`) {
+		t.Errorf("unexpected cancellation request: %s", data)
+	}
+}
+
+func TestRegisterFeature(t *testing.T) {
+	streamFeatures := `<stream:features xmlns:stream='http://etherx.jabber.org/streams'>
+  <register xmlns='http://jabber.org/features/iq-register'/>
+</stream:features>`
+
+	var parsedSF stanza.StreamFeatures
+	if err := xml.Unmarshal([]byte(streamFeatures), &parsedSF); err != nil {
+		t.Fatalf("Unmarshal(%s) returned error: %v", streamFeatures, err)
+	}
+	if !parsedSF.DoesRegister() {
+		t.Error("in-band registration should be supported")
+	}
+}
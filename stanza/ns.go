@@ -9,4 +9,8 @@ const (
 	NSFraming   = "urn:ietf:params:xml:ns:xmpp-framing"
 	NSClient    = "jabber:client"
 	NSComponent = "jabber:component:accept"
+	// NSComponentConnect is the namespace of component streams using SASL authentication (XEP-0225)
+	NSComponentConnect = "jabber:component:connect"
+	// NSStreamErrors is the namespace of the stream error conditions
+	NSStreamErrors = "urn:ietf:params:xml:ns:xmpp-streams"
 )
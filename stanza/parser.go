@@ -72,10 +72,12 @@ func NextPacket(p *xml.Decoder) (Packet, error) {
 		return decodeSASL(p, se)
 	case NSClient:
 		return decodeClient(p, se)
-	case NSComponent:
+	case NSComponent, NSComponentConnect:
 		return decodeComponent(p, se)
 	case NSStreamManagement:
 		return sm.decode(p, se)
+	case NSSASL2:
+		return sasl2.decode(p, se)
 	default:
 		return nil, errors.New("unknown namespace " +
 			se.Name.Space + " <" + se.Name.Local + "/>")
@@ -156,6 +158,8 @@ func decodeStream(p *xml.Decoder, t xml.Token) (Packet, error) {
 // decodeSASL decodes a packet related to SASL authentication.
 func decodeSASL(p *xml.Decoder, se xml.StartElement) (Packet, error) {
 	switch se.Name.Local {
+	case "challenge":
+		return saslChallenge.decode(p, se)
 	case "success":
 		return saslSuccess.decode(p, se)
 	case "failure":
@@ -0,0 +1,211 @@
+package stanza
+
+import (
+	"encoding/xml"
+	"errors"
+)
+
+// ============================================================================
+// Extensible SASL Profile (SASL2)
+// Reference: XEP-0388 - https://xmpp.org/extensions/xep-0388.html
+// Inline resource binding (Bind2)
+// Reference: XEP-0386 - https://xmpp.org/extensions/xep-0386.html
+
+const (
+	NSSASL2 = "urn:xmpp:sasl:2"
+	NSBind2 = "urn:xmpp:bind:0"
+)
+
+// SASL2Authentication is the stream feature advertising SASL2 support, with the available
+// mechanisms and the features that can be negotiated inline during authentication.
+type SASL2Authentication struct {
+	XMLName    xml.Name     `xml:"urn:xmpp:sasl:2 authentication"`
+	Mechanisms []string     `xml:"mechanism"`
+	Inline     *SASL2Inline `xml:"inline"`
+}
+
+// SASL2Inline lists the features that can be negotiated inline during SASL2 authentication.
+type SASL2Inline struct {
+	Bind *Bind2Feature     `xml:"urn:xmpp:bind:0 bind"`
+	SM   *streamManagement `xml:"urn:xmpp:sm:3 sm"`
+	Fast *FastFeature      `xml:"urn:xmpp:fast:0 fast"`
+	Any  []xml.Name        `xml:",any"`
+}
+
+// Bind2Feature advertises Bind2 support, with the features that can be enabled inline
+// during resource binding.
+type Bind2Feature struct {
+	Inline struct {
+		Features []struct {
+			Var string `xml:"var,attr"`
+		} `xml:"feature"`
+	} `xml:"inline"`
+}
+
+// SupportsInline returns true if the feature namespace can be enabled during resource binding.
+func (b *Bind2Feature) SupportsInline(namespace string) bool {
+	if b == nil {
+		return false
+	}
+	for _, f := range b.Inline.Features {
+		if f.Var == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// DoesSASL2 returns true if the server supports SASL2.
+func (sf *StreamFeatures) DoesSASL2() bool {
+	return sf.Authentication.XMLName.Space == NSSASL2 && len(sf.Authentication.Mechanisms) > 0
+}
+
+// DoesBind2 returns true if the server supports resource binding inline with SASL2.
+func (sf *StreamFeatures) DoesBind2() bool {
+	return sf.DoesSASL2() && sf.Authentication.Inline != nil && sf.Authentication.Inline.Bind != nil
+}
+
+// DoesInlineStreamManagement returns true if the server supports stream management resumption
+// inline with SASL2.
+func (sf *StreamFeatures) DoesInlineStreamManagement() bool {
+	return sf.DoesSASL2() && sf.Authentication.Inline != nil && sf.Authentication.Inline.SM != nil
+}
+
+// ============================================================================
+
+// SASL2Authenticate starts a SASL2 authentication, with the optional initial response and
+// the requests for inline features.
+type SASL2Authenticate struct {
+	XMLName         xml.Name        `xml:"urn:xmpp:sasl:2 authenticate"`
+	Mechanism       string          `xml:"mechanism,attr"`
+	InitialResponse string          `xml:"initial-response,omitempty"`
+	UserAgent       *SASL2UserAgent `xml:"user-agent,omitempty"`
+	Resume          *SMResume       `xml:",omitempty"`
+	Bind            *Bind2Request   `xml:",omitempty"`
+	// Any other inline request
+	Extensions []interface{} `xml:",omitempty"`
+}
+
+func (SASL2Authenticate) Name() string {
+	return "sasl2:authenticate"
+}
+
+// SASL2UserAgent identifies the client software and device.
+type SASL2UserAgent struct {
+	Id       string `xml:"id,attr,omitempty"`
+	Software string `xml:"software,omitempty"`
+	Device   string `xml:"device,omitempty"`
+}
+
+// Bind2Request requests resource binding inline with SASL2. Tag is a client identifier,
+// used by the server to generate the resource.
+type Bind2Request struct {
+	XMLName xml.Name  `xml:"urn:xmpp:bind:0 bind"`
+	Tag     string    `xml:"tag,omitempty"`
+	Enable  *SMEnable `xml:",omitempty"`
+}
+
+// SASL2Challenge is sent by the server during a multi-step SASL2 exchange.
+// Value is the base64-encoded challenge.
+type SASL2Challenge struct {
+	XMLName xml.Name `xml:"urn:xmpp:sasl:2 challenge"`
+	Value   string   `xml:",chardata"`
+}
+
+func (SASL2Challenge) Name() string {
+	return "sasl2:challenge"
+}
+
+// SASL2Response is sent by the client as a reply to a SASL2 challenge.
+// Value is the base64-encoded response.
+type SASL2Response struct {
+	XMLName xml.Name `xml:"urn:xmpp:sasl:2 response"`
+	Value   string   `xml:",chardata"`
+}
+
+func (SASL2Response) Name() string {
+	return "sasl2:response"
+}
+
+// SASL2Success is sent by the server when authentication succeeds. It holds the results
+// of the inline features negotiation.
+type SASL2Success struct {
+	XMLName                 xml.Name    `xml:"urn:xmpp:sasl:2 success"`
+	AdditionalData          string      `xml:"additional-data,omitempty"`
+	AuthorizationIdentifier string      `xml:"authorization-identifier"`
+	Bound                   *Bind2Bound `xml:",omitempty"`
+	Resumed                 *SMResumed  `xml:",omitempty"`
+	Failed                  *SMFailed   `xml:",omitempty"`
+	Token                   *FastToken  `xml:",omitempty"`
+	Any                     []xml.Name  `xml:",any"`
+}
+
+func (SASL2Success) Name() string {
+	return "sasl2:success"
+}
+
+// Bind2Bound is sent inside SASL2 success when the resource has been bound inline.
+// It holds the results of the features enabled during binding.
+type Bind2Bound struct {
+	XMLName xml.Name   `xml:"urn:xmpp:bind:0 bound"`
+	Enabled *SMEnabled `xml:",omitempty"`
+	Failed  *SMFailed  `xml:",omitempty"`
+}
+
+// SASL2Failure is sent by the server when authentication fails.
+type SASL2Failure struct {
+	XMLName   xml.Name `xml:"urn:xmpp:sasl:2 failure"`
+	Condition xml.Name `xml:",any"` // SASL failure condition, in urn:ietf:params:xml:ns:xmpp-sasl namespace
+	Text      string   `xml:"text,omitempty"`
+}
+
+func (SASL2Failure) Name() string {
+	return "sasl2:failure"
+}
+
+// SASL2Continue is sent by the server when additional tasks are required after authentication.
+type SASL2Continue struct {
+	XMLName        xml.Name `xml:"urn:xmpp:sasl:2 continue"`
+	AdditionalData string   `xml:"additional-data,omitempty"`
+	Tasks          []string `xml:"tasks>task"`
+	Text           string   `xml:"text,omitempty"`
+}
+
+func (SASL2Continue) Name() string {
+	return "sasl2:continue"
+}
+
+// ============================================================================
+// SASL2 decoding
+
+type sasl2Decoder struct{}
+
+var sasl2 sasl2Decoder
+
+// decode decodes all known nonzas in the SASL2 namespace.
+func (sasl2Decoder) decode(p *xml.Decoder, se xml.StartElement) (Packet, error) {
+	var packet Packet
+	var err error
+	switch se.Name.Local {
+	case "challenge":
+		var c SASL2Challenge
+		err = p.DecodeElement(&c, &se)
+		packet = c
+	case "success":
+		var s SASL2Success
+		err = p.DecodeElement(&s, &se)
+		packet = s
+	case "failure":
+		var f SASL2Failure
+		err = p.DecodeElement(&f, &se)
+		packet = f
+	case "continue":
+		var c SASL2Continue
+		err = p.DecodeElement(&c, &se)
+		packet = c
+	default:
+		return nil, errors.New("unexpected XMPP packet " +
+			se.Name.Space + " <" + se.Name.Local + "/>")
+	}
+	return packet, err
+}
@@ -0,0 +1,161 @@
+package stanza_test
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+func TestSASL2Features(t *testing.T) {
+	streamFeatures := `<stream:features xmlns:stream='http://etherx.jabber.org/streams'>
+  <authentication xmlns='urn:xmpp:sasl:2'>
+    <mechanism>SCRAM-SHA-256</mechanism>
+    <mechanism>PLAIN</mechanism>
+    <inline>
+      <bind xmlns='urn:xmpp:bind:0'>
+        <inline>
+          <feature var='urn:xmpp:carbons:2'/>
+          <feature var='urn:xmpp:sm:3'/>
+        </inline>
+      </bind>
+      <sm xmlns='urn:xmpp:sm:3'/>
+    </inline>
+  </authentication>
+</stream:features>`
+
+	var parsedSF stanza.StreamFeatures
+	if err := xml.Unmarshal([]byte(streamFeatures), &parsedSF); err != nil {
+		t.Fatalf("Unmarshal(%s) returned error: %v", streamFeatures, err)
+	}
+
+	if !parsedSF.DoesSASL2() || !parsedSF.DoesBind2() || !parsedSF.DoesInlineStreamManagement() {
+		t.Fatal("SASL2, Bind2 and inline stream management should be supported")
+	}
+	if got := strings.Join(parsedSF.Authentication.Mechanisms, ","); got != "SCRAM-SHA-256,PLAIN" {
+		t.Errorf("unexpected SASL2 mechanisms: %s", got)
+	}
+	bind := parsedSF.Authentication.Inline.Bind
+	if !bind.SupportsInline(stanza.NSStreamManagement) || bind.SupportsInline("urn:xmpp:csi:0") {
+		t.Errorf("unexpected Bind2 inline features: %+v", bind.Inline.Features)
+	}
+}
+
+func TestNoSASL2Features(t *testing.T) {
+	streamFeatures := `<stream:features xmlns:stream='http://etherx.jabber.org/streams'>
+  <mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>
+    <mechanism>PLAIN</mechanism>
+  </mechanisms>
+</stream:features>`
+
+	var parsedSF stanza.StreamFeatures
+	if err := xml.Unmarshal([]byte(streamFeatures), &parsedSF); err != nil {
+		t.Fatalf("Unmarshal(%s) returned error: %v", streamFeatures, err)
+	}
+	if parsedSF.DoesSASL2() || parsedSF.DoesBind2() {
+		t.Error("SASL2 should not be supported")
+	}
+}
+
+func TestSASL2Authenticate(t *testing.T) {
+	resume := true
+	auth := stanza.SASL2Authenticate{
+		Mechanism:       "PLAIN",
+		InitialResponse: "AHRlc3QAdGVzdA==",
+		UserAgent:       &stanza.SASL2UserAgent{Id: "d4565fa7-4d72-4749-b3d3-740edbf87770", Software: "go-xmpp"},
+		Bind: &stanza.Bind2Request{
+			Tag:    "mobile",
+			Enable: &stanza.SMEnable{Resume: &resume},
+		},
+	}
+	data, err := xml.Marshal(auth)
+	if err != nil {
+		t.Fatalf("cannot marshal authenticate: %s", err)
+	}
+
+	var parsed stanza.SASL2Authenticate
+	if err = xml.Unmarshal(data, &parsed); err != nil {
+		t.Fatalf("cannot unmarshal %s: %s", data, err)
+	}
+	if parsed.Mechanism != "PLAIN" || parsed.InitialResponse != auth.InitialResponse {
+		t.Errorf("unexpected authenticate: %s", data)
+	}
+	if parsed.UserAgent == nil || parsed.UserAgent.Id != auth.UserAgent.Id {
+		t.Errorf("missing user agent: %s", data)
+	}
+	if parsed.Bind == nil || parsed.Bind.Tag != "mobile" || parsed.Bind.Enable == nil {
+		t.Errorf("missing bind request: %s", data)
+	}
+	if parsed.Resume != nil {
+		t.Errorf("unexpected resume request: %s", data)
+	}
+}
+
+func TestSASL2Success(t *testing.T) {
+	success := `<success xmlns='urn:xmpp:sasl:2'>
+  <additional-data>dj1wTk5ERlZFUXh1WHhDb1NFaVc4R0VaKzFSU289</additional-data>
+  <authorization-identifier>user@example.com/mobile.xyz</authorization-identifier>
+  <bound xmlns='urn:xmpp:bind:0'>
+    <enabled xmlns='urn:xmpp:sm:3' id='some-long-sm-id' resume='true'/>
+  </bound>
+</success>`
+
+	packet, err := stanza.NextPacket(xml.NewDecoder(strings.NewReader(success)))
+	if err != nil {
+		t.Fatalf("cannot parse success: %s", err)
+	}
+	s, ok := packet.(stanza.SASL2Success)
+	if !ok {
+		t.Fatalf("expected SASL2 success, got %T", packet)
+	}
+	if s.AuthorizationIdentifier != "user@example.com/mobile.xyz" || s.AdditionalData == "" {
+		t.Errorf("unexpected success: %+v", s)
+	}
+	if s.Bound == nil || s.Bound.Enabled == nil || s.Bound.Enabled.Id != "some-long-sm-id" {
+		t.Errorf("missing inline stream management: %+v", s.Bound)
+	}
+}
+
+func TestSASL2SuccessResumeFailed(t *testing.T) {
+	success := `<success xmlns='urn:xmpp:sasl:2'>
+  <authorization-identifier>user@example.com</authorization-identifier>
+  <failed xmlns='urn:xmpp:sm:3' h='3'>
+    <item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>
+  </failed>
+</success>`
+
+	packet, err := stanza.NextPacket(xml.NewDecoder(strings.NewReader(success)))
+	if err != nil {
+		t.Fatalf("cannot parse success: %s", err)
+	}
+	s, ok := packet.(stanza.SASL2Success)
+	if !ok {
+		t.Fatalf("expected SASL2 success, got %T", packet)
+	}
+	if s.Failed == nil || s.Resumed != nil || s.Bound != nil {
+		t.Fatalf("expected failed resumption: %+v", s)
+	}
+	if s.Failed.StreamErrorGroup == nil || s.Failed.StreamErrorGroup.GroupErrorName() != "undefined-condition" {
+		t.Errorf("unexpected failure condition: %v", s.Failed.StreamErrorGroup)
+	}
+}
+
+func TestSASL2Failure(t *testing.T) {
+	failure := `<failure xmlns='urn:xmpp:sasl:2'>
+  <not-authorized xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>
+  <text>Wrong password</text>
+</failure>`
+
+	packet, err := stanza.NextPacket(xml.NewDecoder(strings.NewReader(failure)))
+	if err != nil {
+		t.Fatalf("cannot parse failure: %s", err)
+	}
+	f, ok := packet.(stanza.SASL2Failure)
+	if !ok {
+		t.Fatalf("expected SASL2 failure, got %T", packet)
+	}
+	if f.Condition.Local != "not-authorized" || f.Text != "Wrong password" {
+		t.Errorf("unexpected failure: %+v", f)
+	}
+}
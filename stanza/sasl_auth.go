@@ -14,11 +14,55 @@ type SASLAuth struct {
 
 // ============================================================================
 
+// SASLChallenge implements SASL Challenge nonza, sent by server during multi-step
+// SASL negotiation (for example with SCRAM mechanisms).
+// Value is the base64-encoded challenge.
+// Reference: https://tools.ietf.org/html/rfc6120#section-6.4.3
+type SASLChallenge struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl challenge"`
+	Value   string   `xml:",chardata"`
+}
+
+func (SASLChallenge) Name() string {
+	return "sasl:challenge"
+}
+
+// SASLChallenge decoding
+type saslChallengeDecoder struct{}
+
+var saslChallenge saslChallengeDecoder
+
+func (saslChallengeDecoder) decode(p *xml.Decoder, se xml.StartElement) (SASLChallenge, error) {
+	var packet SASLChallenge
+	err := p.DecodeElement(&packet, &se)
+	return packet, err
+}
+
+// ============================================================================
+
+// SASLResponse implements SASL Response nonza, sent by client as a reply to a
+// SASL challenge.
+// Value is the base64-encoded response.
+// Reference: https://tools.ietf.org/html/rfc6120#section-6.4.3
+type SASLResponse struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl response"`
+	Value   string   `xml:",chardata"`
+}
+
+func (SASLResponse) Name() string {
+	return "sasl:response"
+}
+
+// ============================================================================
+
 // SASLSuccess implements SASL Success nonza, sent by server as a result of the
 // SASL auth negotiation.
+// Value holds the optional base64-encoded additional data with success, used
+// for example by SCRAM to carry the server signature.
 // Reference: https://tools.ietf.org/html/rfc6120#section-6.4.6
 type SASLSuccess struct {
 	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl success"`
+	Value   string   `xml:",chardata"`
 }
 
 func (SASLSuccess) Name() string {
@@ -41,7 +85,8 @@ func (saslSuccessDecoder) decode(p *xml.Decoder, se xml.StartElement) (SASLSucce
 // SASLFailure
 type SASLFailure struct {
 	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl failure"`
-	Any     xml.Name // error reason is a subelement
+	Any     xml.Name `xml:",any"` // error reason is a subelement
+	Text    string   `xml:"text,omitempty"`
 }
 
 func (SASLFailure) Name() string {
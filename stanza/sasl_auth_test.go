@@ -2,6 +2,7 @@ package stanza_test
 
 import (
 	"encoding/xml"
+	"strings"
 	"testing"
 
 	"gosrc.io/xmpp/stanza"
@@ -57,4 +58,27 @@ func TestSessionIQ(t *testing.T) {
 	}
 }
 
-// TODO Test Sasl mechanism
+// Check that SASL challenges and success additional data are decoded by the parser
+func TestSASLChallenge(t *testing.T) {
+	raw := `<challenge xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>cj1meWtvK2QybGJiRmdPTlJ2OXFreGRhd0w=</challenge>`
+	parsed, err := stanza.NextPacket(xml.NewDecoder(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("cannot parse challenge: %s", err)
+	}
+	challenge, ok := parsed.(stanza.SASLChallenge)
+	if !ok {
+		t.Fatalf("expected SASL challenge, got %T", parsed)
+	}
+	if challenge.Value != "cj1meWtvK2QybGJiRmdPTlJ2OXFreGRhd0w=" {
+		t.Errorf("incorrect challenge value: %s", challenge.Value)
+	}
+
+	raw = `<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>dj1ybUY5cHFWOFM3c3VBb1pXamE0ZEpSa0ZzS1E9</success>`
+	parsed, err = stanza.NextPacket(xml.NewDecoder(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("cannot parse success: %s", err)
+	}
+	if success, ok := parsed.(stanza.SASLSuccess); !ok || success.Value == "" {
+		t.Errorf("expected SASL success with additional data, got %#v", parsed)
+	}
+}
@@ -2,6 +2,7 @@ package stanza
 
 import (
 	"encoding/xml"
+	"strings"
 )
 
 // ============================================================================
@@ -17,8 +18,11 @@ type StreamFeatures struct {
 	// Stream features
 	StartTLS         TlsStartTLS
 	Mechanisms       saslMechanisms
+	ChannelBinding   saslChannelBinding
+	Authentication   SASL2Authentication
 	Bind             Bind
 	StreamManagement streamManagement
+	Register         registerFeature
 	// Obsolete
 	Session StreamSession
 	// ProcessOne Stream Features
@@ -112,6 +116,27 @@ type saslMechanisms struct {
 	Mechanism []string `xml:"mechanism"`
 }
 
+// Channel binding types supported by the server
+// Reference: XEP-0440 - https://xmpp.org/extensions/xep-0440.html
+type saslChannelBinding struct {
+	XMLName xml.Name             `xml:"urn:xmpp:sasl-cb:0 sasl-channel-binding"`
+	Types   []ChannelBindingType `xml:"channel-binding"`
+}
+
+// ChannelBindingType is a channel binding type advertised by the server.
+type ChannelBindingType struct {
+	Type string `xml:"type,attr"`
+}
+
+// ChannelBindingTypes returns the list of channel binding types advertised by the server.
+func (sf *StreamFeatures) ChannelBindingTypes() []string {
+	var types []string
+	for _, cb := range sf.ChannelBinding.Types {
+		types = append(types, cb.Type)
+	}
+	return types
+}
+
 // StreamManagement
 // Reference: XEP-0198 - https://xmpp.org/extensions/xep-0198.html#feature
 type streamManagement struct {
@@ -154,6 +179,41 @@ type StreamError struct {
 	XMLName xml.Name `xml:"http://etherx.jabber.org/streams error"`
 	Error   xml.Name `xml:",any"`
 	Text    string   `xml:"urn:ietf:params:xml:ns:xmpp-streams text"`
+	// SeeOtherHost is the address the server redirects the client to, with the see-other-host condition
+	SeeOtherHost string `xml:"-"`
+}
+
+// UnmarshalXML decodes the error condition, with the address of the see-other-host condition.
+// Application specific conditions do not replace the defined condition.
+func (s *StreamError) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	s.XMLName = start.Name
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch tt := t.(type) {
+		case xml.StartElement:
+			switch {
+			case tt.Name.Local == "text":
+				err = d.DecodeElement(&s.Text, &tt)
+			case tt.Name.Space == NSStreamErrors || s.Error.Local == "":
+				s.Error = tt.Name
+				var value string
+				err = d.DecodeElement(&value, &tt)
+				if tt.Name.Local == "see-other-host" {
+					s.SeeOtherHost = strings.TrimSpace(value)
+				}
+			default:
+				err = d.Skip()
+			}
+			if err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
 }
 
 func (StreamError) Name() string {
@@ -62,3 +62,48 @@ func TestStreamManagement(t *testing.T) {
 		t.Error("Stream Management feature should have been detected")
 	}
 }
+
+func TestChannelBindingTypes(t *testing.T) {
+	streamFeatures := `<stream:features xmlns:stream='http://etherx.jabber.org/streams'>
+  <mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>
+    <mechanism>SCRAM-SHA-256-PLUS</mechanism>
+    <mechanism>SCRAM-SHA-256</mechanism>
+  </mechanisms>
+  <sasl-channel-binding xmlns='urn:xmpp:sasl-cb:0'>
+    <channel-binding type='tls-server-end-point'/>
+    <channel-binding type='tls-exporter'/>
+  </sasl-channel-binding>
+</stream:features>`
+
+	var parsedSF stanza.StreamFeatures
+	if err := xml.Unmarshal([]byte(streamFeatures), &parsedSF); err != nil {
+		t.Errorf("Unmarshal(%s) returned error: %v", streamFeatures, err)
+	}
+
+	types := parsedSF.ChannelBindingTypes()
+	if len(types) != 2 || types[0] != "tls-server-end-point" || types[1] != "tls-exporter" {
+		t.Errorf("unexpected channel binding types: %v", types)
+	}
+}
+
+func TestStreamErrorSeeOtherHost(t *testing.T) {
+	streamError := `<stream:error xmlns:stream='http://etherx.jabber.org/streams'>
+  <see-other-host xmlns='urn:ietf:params:xml:ns:xmpp-streams'>[2001:db8::1]:9222</see-other-host>
+  <text xmlns='urn:ietf:params:xml:ns:xmpp-streams'>Moved</text>
+  <escape-your-data xmlns='http://example.org/ns'/>
+</stream:error>`
+
+	var parsed stanza.StreamError
+	if err := xml.Unmarshal([]byte(streamError), &parsed); err != nil {
+		t.Fatalf("Unmarshal(%s) returned error: %v", streamError, err)
+	}
+	if parsed.Error.Local != "see-other-host" || parsed.Error.Space != stanza.NSStreamErrors {
+		t.Errorf("unexpected condition: %v", parsed.Error)
+	}
+	if parsed.SeeOtherHost != "[2001:db8::1]:9222" {
+		t.Errorf("unexpected see-other-host address: %q", parsed.SeeOtherHost)
+	}
+	if parsed.Text != "Moved" {
+		t.Errorf("unexpected text: %q", parsed.Text)
+	}
+}
@@ -30,9 +30,17 @@ func (SMEnabled) Name() string {
 	return "Stream Management: enabled"
 }
 
+// ErrInvalidHandledCount is returned when the number of stanzas handled by the server does not
+// match the stanzas sent.
+var ErrInvalidHandledCount = errors.New("invalid handled stanzas count")
+
+// UnAckQueue holds the stanzas sent, until they are acknowledged by the server. The ids of the
+// stanzas are their sequence numbers in the stream, wrapping at 2^32 like the h counts.
 type UnAckQueue struct {
 	Uslice []*UnAckedStz
 	sync.RWMutex
+	// Handled is the last number of stanzas handled by the server, modulo 2^32
+	Handled uint
 }
 type UnAckedStz struct {
 	Id  int
@@ -108,10 +116,7 @@ func (uaq *UnAckQueue) Push(s Queueable) error {
 	if uaq == nil {
 		return nil
 	}
-	pushIdx := 1
-	if len(uaq.Uslice) != 0 {
-		pushIdx = uaq.Uslice[len(uaq.Uslice)-1].Id + 1
-	}
+	pushIdx := int(uaq.last() + 1)
 
 	sStz, ok := s.(*UnAckedStz)
 	if !ok {
@@ -128,6 +133,34 @@ func (uaq *UnAckQueue) Push(s Queueable) error {
 	return nil
 }
 
+// last returns the sequence number of the last stanza sent.
+func (uaq *UnAckQueue) last() uint32 {
+	if len(uaq.Uslice) == 0 {
+		return uint32(uaq.Handled)
+	}
+	return uint32(uaq.Uslice[len(uaq.Uslice)-1].Id)
+}
+
+// Acknowledge removes the stanzas handled by the server from the queue, and returns them. h is
+// the number of stanzas handled by the server since stream management was enabled, modulo 2^32.
+// See https://xmpp.org/extensions/xep-0198.html#acking
+// No guarantee regarding thread safety !
+func (uaq *UnAckQueue) Acknowledge(h uint) ([]*UnAckedStz, error) {
+	if uaq == nil {
+		return nil, nil
+	}
+	// The subtraction wraps around like the counts
+	unacked := uaq.last() - uint32(h)
+	if unacked > uint32(len(uaq.Uslice)) {
+		return nil, ErrInvalidHandledCount
+	}
+	n := len(uaq.Uslice) - int(unacked)
+	acked := uaq.Uslice[:n:n]
+	uaq.Uslice = uaq.Uslice[n:]
+	uaq.Handled = uint(uint32(h))
+	return acked, nil
+}
+
 func (uaq *UnAckQueue) Empty() bool {
 	if uaq == nil {
 		return true
@@ -318,7 +351,11 @@ func (smf *SMFailed) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error
 				err = d.DecodeElement(&xnwf, &tt)
 				smf.StreamErrorGroup = &xnwf
 			default:
-				return errors.New("error is unknown")
+				// Servers also use conditions that are not stream errors, like item-not-found
+				// when the session to resume does not exist anymore.
+				uc := UndefinedCondition{}
+				err = d.Skip()
+				smf.StreamErrorGroup = &uc
 			}
 			if err != nil {
 				return err
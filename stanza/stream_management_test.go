@@ -2,6 +2,7 @@ package stanza_test
 
 import (
 	"gosrc.io/xmpp/stanza"
+	"math"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -176,6 +177,61 @@ func TestPopUnack(t *testing.T) {
 
 }
 
+func TestAcknowledgeUnack(t *testing.T) {
+	uaq := initUnAckQueue()
+
+	acked, err := uaq.Acknowledge(2)
+	if err != nil {
+		t.Fatalf("could not acknowledge stanzas: %v", err)
+	}
+	if len(acked) != 2 || acked[0].Id != 1 || acked[1].Id != 2 {
+		t.Fatalf("unexpected acknowledged stanzas: %v", acked)
+	}
+	if len(uaq.Uslice) != 1 || uaq.Uslice[0].Id != 3 {
+		t.Fatalf("unexpected unacknowledged stanzas: %v", uaq.Uslice)
+	}
+
+	// The same count acknowledges nothing more
+	if acked, err = uaq.Acknowledge(2); err != nil || len(acked) != 0 {
+		t.Fatalf("repeated ack should not acknowledge stanzas: %v, %v", acked, err)
+	}
+	if _, err = uaq.Acknowledge(4); err != stanza.ErrInvalidHandledCount {
+		t.Fatalf("expected an invalid count error, got %v", err)
+	}
+
+	// Numbering continues after the queue is emptied
+	if _, err = uaq.Acknowledge(3); err != nil {
+		t.Fatalf("could not acknowledge stanzas: %v", err)
+	}
+	_ = uaq.Push(&stanza.UnAckedStz{Stz: "<message/>"})
+	if uaq.Uslice[0].Id != 4 {
+		t.Fatalf("expected stanza number 4, got %d", uaq.Uslice[0].Id)
+	}
+}
+
+func TestAcknowledgeUnackWraparound(t *testing.T) {
+	uaq := stanza.NewUnAckQueue()
+	// The server already handled 2^32 - 2 stanzas
+	uaq.Uslice = append(uaq.Uslice, &stanza.UnAckedStz{Id: math.MaxUint32 - 1})
+	if _, err := uaq.Acknowledge(math.MaxUint32 - 1); err != nil {
+		t.Fatalf("could not acknowledge stanzas: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		_ = uaq.Push(&stanza.UnAckedStz{Stz: "<message/>"})
+	}
+	if uaq.Uslice[0].Id != math.MaxUint32 || uaq.Uslice[1].Id != 0 || uaq.Uslice[2].Id != 1 {
+		t.Fatalf("stanza numbers should wrap around: %d, %d, %d", uaq.Uslice[0].Id, uaq.Uslice[1].Id, uaq.Uslice[2].Id)
+	}
+
+	acked, err := uaq.Acknowledge(0)
+	if err != nil {
+		t.Fatalf("could not acknowledge stanzas: %v", err)
+	}
+	if len(acked) != 2 || len(uaq.Uslice) != 1 {
+		t.Fatalf("expected 2 stanzas acknowledged after the wraparound, got %d", len(acked))
+	}
+}
+
 func initUnAckQueue() stanza.UnAckQueue {
 	q := []*stanza.UnAckedStz{
 		{
@@ -0,0 +1,239 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"time"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+// ============================================================================
+// Stream management
+
+// streamManagement runs stream management (XEP-0198) on the streams of a client or a component.
+// It tracks the sent stanzas until the server acknowledges them, requests the acks, and answers
+// the ack requests of the server. The tracking is kept when the session is resumed.
+type streamManagement struct {
+	// threshold is the number of stanzas sent before requesting an ack. Disabled when 0.
+	threshold int
+	// interval is the interval between the ack requests, sent while stanzas are not acknowledged.
+	// Disabled when 0.
+	interval time.Duration
+	// timeout is the time to wait for the answer to an ack request. Disabled when 0.
+	timeout time.Duration
+
+	acks *ackTracker
+}
+
+// established updates the tracking once the session is established on a new stream. When the
+// stream management session is resumed, the stanzas handled by the server are acknowledged, and
+// the other ones are returned to be sent again. Otherwise, the stanzas of the previous session
+// cannot be acknowledged anymore. handled is the number of stanzas handled by the server, when it
+// sent it.
+func (m *streamManagement) established(state SMState, enabled, resumed bool, handled *uint) ([]string, error) {
+	if !resumed {
+		if m.acks != nil && handled != nil {
+			// The server tells which stanzas it handled, even when the resumption fails
+			_ = m.acks.acknowledge(*handled)
+		}
+		m.acks.fail(ErrStanzaNotAcked)
+		m.acks = nil
+	}
+	if !enabled || state.UnAckQueue == nil {
+		m.acks = nil
+		return nil, nil
+	}
+	if m.acks == nil || m.acks.queue != state.UnAckQueue {
+		m.acks = newAckTracker(state.UnAckQueue, m.threshold)
+	}
+	if !resumed {
+		return nil, nil
+	}
+	var err error
+	if handled != nil {
+		err = m.acks.acknowledge(*handled)
+	}
+	return m.acks.unacked(), err
+}
+
+// tracker returns the function storing the written stanzas of the session as non-acked, for the
+// packet writer, or nil when stream management is not enabled. An ack is requested when the
+// threshold is reached. See https://xmpp.org/extensions/xep-0198.html#scenarios
+func (m *streamManagement) tracker(send func(stanza.Packet) error, errorHandler func(error)) func(data []byte, onAck AckHandler, buffered uint64) {
+	acks := m.acks
+	if acks == nil {
+		return nil
+	}
+	return func(data []byte, onAck AckHandler, buffered uint64) {
+		if acks.track(data, onAck, buffered) {
+			requestAck(acks, send, errorHandler)
+		}
+	}
+}
+
+// start requests the acks periodically until quit is closed. When the server does not answer a
+// request in time, the connection is considered dead, and the transport is closed to trigger the
+// disconnection.
+func (m *streamManagement) start(transport Transport, send func(stanza.Packet) error, errorHandler func(error), quit <-chan struct{}) {
+	acks := m.acks
+	if acks == nil {
+		return
+	}
+	go acks.run(m.interval, m.timeout,
+		func() { requestAck(acks, send, errorHandler) },
+		func() {
+			errorHandler(ErrAckTimeout)
+			_ = transport.CloseContext(canceledContext())
+		}, quit)
+}
+
+// receive handles a packet received on the stream: it answers the ack requests, processes the acks
+// of the server, and counts the received stanzas in the state. It tells if the packet is a stream
+// management nonza.
+func (m *streamManagement) receive(state *SMState, packet stanza.Packet, send func(stanza.Packet) error) (bool, error) {
+	switch p := packet.(type) {
+	case stanza.SMRequest:
+		answer := stanza.SMAnswer{XMLName: xml.Name{
+			Space: stanza.NSStreamManagement,
+			Local: "a",
+		}, H: state.Inbound}
+		return true, send(answer)
+	case stanza.SMAnswer:
+		// Acks are processed in the order of the stream
+		if m.acks == nil {
+			return true, nil
+		}
+		return true, m.acks.acknowledge(p.H)
+	default:
+		// The count wraps at 2^32, see https://xmpp.org/extensions/xep-0198.html#acking
+		state.Inbound = uint(uint32(state.Inbound) + 1)
+		return false, nil
+	}
+}
+
+// requestAck asks the server to acknowledge the stanzas it handled.
+func requestAck(acks *ackTracker, send func(stanza.Packet) error, errorHandler func(error)) {
+	acks.requesting()
+	if err := send(stanza.SMRequest{}); err != nil {
+		errorHandler(err)
+	}
+}
+
+// smEnable asks the server to enable stream management on the stream, requesting resumption if
+// resume is set. It returns the answer of the server, SMEnabled or SMFailed.
+func smEnable(transport Transport, resume bool) (stanza.Packet, error) {
+	data, err := xml.Marshal(stanza.SMEnable{Resume: &resume})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = transport.Write(data); err != nil {
+		return nil, err
+	}
+	packet, err := stanza.NextPacket(transport.GetDecoder())
+	if err != nil {
+		return nil, err
+	}
+	switch packet.(type) {
+	case stanza.SMEnabled, stanza.SMFailed:
+		return packet, nil
+	}
+	return nil, errors.New("unexpected reply to SM enable")
+}
+
+// smResume asks the server to resume the stream management session of the state. It tells if the
+// session was resumed, and returns the number of stanzas handled by the server when it sent it,
+// even if the resumption failed.
+func smResume(transport Transport, state SMState) (bool, *uint, error) {
+	data, err := xml.Marshal(stanza.SMResume{PrevId: state.Id, H: &state.Inbound})
+	if err != nil {
+		return false, nil, err
+	}
+	if _, err = transport.Write(data); err != nil {
+		return false, nil, err
+	}
+	packet, err := stanza.NextPacket(transport.GetDecoder())
+	if err != nil {
+		return false, nil, err
+	}
+	switch p := packet.(type) {
+	case stanza.SMResumed:
+		if p.PrevId != state.Id {
+			return false, nil, errors.New("session resumption: mismatched id")
+		}
+		return true, p.H, nil
+	case stanza.SMFailed:
+		return false, p.H, nil
+	}
+	return false, nil, errors.New("unexpected reply to SM resume")
+}
+
+// newSMState returns the state of the stream management session enabled by the server.
+func newSMState(p stanza.SMEnabled, q *stanza.UnAckQueue) SMState {
+	return SMState{Id: p.Id, Location: p.Location, Max: p.Max, UnAckQueue: q}
+}
+
+// smNegotiation is the result of the stream management negotiation on an authenticated stream.
+type smNegotiation struct {
+	// resumed is set when the session of the previous stream was resumed
+	resumed bool
+	// handled is the number of stanzas handled by the server when it sent it, even if the
+	// resumption failed
+	handled *uint
+	// state is the state of the resumed session, or of the session enabled on the stream
+	state SMState
+	// resumable tells if the server allows to resume the enabled session
+	resumable bool
+	// failed is set when the server refused to enable stream management
+	failed bool
+}
+
+// negotiateSM resumes the stream management session of state when it has one. Otherwise, bind is
+// called when set, then stream management is enabled if enable is set, requesting resumption if
+// resume is set.
+func negotiateSM(transport Transport, state SMState, enable, resume bool, bind func() error) (smNegotiation, error) {
+	var n smNegotiation
+	if state.Id != "" {
+		resumed, handled, err := smResume(transport, state)
+		if err != nil {
+			return n, err
+		}
+		n.handled = handled
+		if resumed {
+			n.resumed, n.state = true, state
+			return n, nil
+		}
+	}
+	if bind != nil {
+		if err := bind(); err != nil {
+			return n, err
+		}
+	}
+	if !enable {
+		return n, nil
+	}
+	packet, err := smEnable(transport, resume)
+	if err != nil {
+		return n, err
+	}
+	return n, n.enabled(packet)
+}
+
+// enabled updates the negotiation with the answer of the server to the enable request, SMEnabled
+// or SMFailed, sent on the stream or inline with Bind2.
+func (n *smNegotiation) enabled(packet stanza.Packet) error {
+	switch p := packet.(type) {
+	case stanza.SMEnabled:
+		n.state = newSMState(p, stanza.NewUnAckQueue())
+		n.resumable, _ = strconv.ParseBool(p.Resume)
+	case stanza.SMFailed:
+		n.state = SMState{StreamErrorGroup: p.StreamErrorGroup, UnAckQueue: stanza.NewUnAckQueue()}
+		n.failed = true
+		if p.StreamErrorGroup != nil {
+			return errors.New("failed to enable stream management: " + p.StreamErrorGroup.GroupErrorName())
+		}
+		return errors.New("failed to enable stream management")
+	}
+	return nil
+}
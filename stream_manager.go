@@ -15,42 +15,65 @@ import (
 // stream events and doing the right operations.
 //
 // It can handle:
-//     - Client
+//     - Client, Component or any StreamClient implementation
 //     - Stream establishment workflow
 //     - Reconnection strategies, with exponential backoff. It also takes into account
 //       permanent errors to avoid useless reconnection loops.
 //     - Metrics processing
 
 // StreamClient is an interface used by StreamManager to control Client lifecycle,
-// set callback and trigger reconnection.
+// set callback and trigger reconnection. It is implemented by Client and Component.
 type StreamClient interface {
 	Connect() error
+	ConnectContext(ctx context.Context) error
 	Resume() error
+	ResumeContext(ctx context.Context) error
 	Send(packet stanza.Packet) error
+	SendContext(ctx context.Context, packet stanza.Packet) error
 	SendIQ(ctx context.Context, iq *stanza.IQ) (chan stanza.IQ, error)
 	SendRaw(packet string) error
+	SendRawContext(ctx context.Context, packet string) error
 	Disconnect() error
+	DisconnectContext(ctx context.Context) error
 	SetHandler(handler EventHandler)
+	// State returns the current connection state
+	State() ConnState
 }
 
 // Sender is an interface provided by Stream clients to allow sending XMPP data.
 // It is mostly use in callback to pass a limited subset of the stream client interface
 type Sender interface {
 	Send(packet stanza.Packet) error
+	SendContext(ctx context.Context, packet stanza.Packet) error
 	SendIQ(ctx context.Context, iq *stanza.IQ) (chan stanza.IQ, error)
 	SendRaw(packet string) error
+	SendRawContext(ctx context.Context, packet string) error
 }
 
-// StreamManager supervises an XMPP client connection. Its role is to handle connection events and
-// apply reconnection strategy.
+// StreamManager supervises an XMPP client or component connection. Its role is to handle connection
+// events and apply reconnection strategy.
 type StreamManager struct {
 	client      StreamClient
 	PostConnect PostConnect
+	// ReconnectPolicy decides whether and when to reconnect after the connection is lost.
+	// Defaults to a BackoffPolicy zero value.
+	ReconnectPolicy ReconnectPolicy
+	// Clock is used to wait between the reconnection attempts. Defaults to the system clock.
+	Clock Clock
 
 	// Store low level metrics
 	Metrics *Metrics
 
-	wg sync.WaitGroup
+	// done receives the result of Run, when the manager is stopped or gives up reconnecting
+	done chan error
+	// ctx is cancelled when the manager is stopped, to interrupt the reconnection
+	ctx  context.Context
+	stop context.CancelFunc
+	mu   sync.Mutex
+	// cause is the stream error which closed the stream, passed to the reconnect policy
+	cause error
+	// online is set while the session is established, to only reconnect when it is lost
+	online bool
 }
 
 type PostConnect func(c Sender)
@@ -75,81 +98,137 @@ func (sm *StreamManager) Run() error {
 	}
 
 	handler := func(e Event) error {
+		if e.Token != nil {
+			// Token changes do not change the connection state
+			return nil
+		}
 		switch e.State.state {
-		case StateSessionEstablished:
+		case StateSessionEstablished, StateSessionResumed:
 			sm.Metrics.setLoginTime()
+			sm.mu.Lock()
+			sm.online = true
+			sm.mu.Unlock()
 		case StateDisconnected:
-			// Reconnect on disconnection
-			return sm.resume()
+			// Reconnect when the session is lost. When a connection attempt fails, the error is
+			// returned to the caller instead.
+			sm.mu.Lock()
+			online, cause := sm.online, sm.cause
+			sm.online, sm.cause = false, nil
+			sm.mu.Unlock()
+			if !online {
+				return nil
+			}
+			return sm.resume(cause)
 		case StateStreamError:
-			sm.client.Disconnect()
-			// Only try reconnecting if we have not been kicked by another session to avoid connection loop.
-			// TODO: Make this conflict exception a permanent error
-			if e.StreamError != "conflict" {
-				return sm.resume()
+			// The reconnect policy decides from the stream error whether to reconnect, once
+			// disconnected. By default, the client does not reconnect when it has been kicked by
+			// another session, to avoid connection loop.
+			sm.mu.Lock()
+			sm.cause = e.Err
+			if sm.cause == nil {
+				sm.cause = &StreamError{Condition: e.StreamError, Text: e.Description}
 			}
+			sm.mu.Unlock()
+			sm.client.Disconnect()
 		case StatePermanentError:
 			// Do not attempt to reconnect
 		}
 		return nil
 	}
+	sm.done = make(chan error, 1)
+	sm.mu.Lock()
+	sm.online = false
+	sm.ctx, sm.stop = context.WithCancel(context.Background())
+	sm.mu.Unlock()
 	sm.client.SetHandler(handler)
 
-	sm.wg.Add(1)
 	if err := sm.connect(); err != nil {
-		sm.wg.Done()
 		return err
 	}
-	sm.wg.Wait()
-	return nil
+	return <-sm.done
 }
 
 // Stop cancels pending operations and terminates existing XMPP client.
 func (sm *StreamManager) Stop() {
+	// Interrupt the reconnection, if any
+	sm.mu.Lock()
+	if sm.stop != nil {
+		sm.stop()
+	}
+	sm.mu.Unlock()
 	// Remove on disconnect handler to avoid triggering reconnect
 	sm.client.SetHandler(nil)
 	sm.client.Disconnect()
-	sm.wg.Done()
+	sm.finish(nil)
+}
+
+// finish makes Run return err. Only the first result is kept.
+func (sm *StreamManager) finish(err error) {
+	select {
+	case sm.done <- err:
+	default:
+	}
 }
 
 func (sm *StreamManager) connect() error {
-	if sm.client != nil {
-		if c, ok := sm.client.(*Client); ok {
-			if c.CurrentState.getState() == StateDisconnected {
-				sm.Metrics = initMetrics()
-				err := c.Connect()
-				if err != nil {
-					return err
-				}
-				if sm.PostConnect != nil {
-					sm.PostConnect(sm.client)
-				}
-				return nil
-			}
-		}
+	if state := sm.client.State(); state != StateDisconnected && state != StatePermanentError {
+		return errors.New("client is not disconnected")
 	}
-	return errors.New("client is not disconnected")
+	sm.Metrics = initMetrics()
+	if err := sm.client.Connect(); err != nil {
+		return err
+	}
+	if sm.PostConnect != nil {
+		sm.PostConnect(sm.client)
+	}
+	return nil
 }
 
-// resume manages the reconnection loop and apply the define backoff to avoid overloading the server.
-func (sm *StreamManager) resume() error {
-	var backoff backoff // TODO: Group backoff calculation features with connection manager?
+// resume manages the reconnection loop, waiting between the attempts as defined by the reconnect
+// policy to avoid overloading the server. cause is the stream error which closed the stream, if any.
+// When the policy gives up, Run returns the last error. The reconnection stops when the manager is
+// stopped.
+func (sm *StreamManager) resume(cause error) error {
+	sm.mu.Lock()
+	ctx := sm.ctx
+	sm.mu.Unlock()
+	policy := sm.ReconnectPolicy
+	if policy == nil {
+		policy = &BackoffPolicy{}
+	}
+	clock := sm.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
 
-	for {
-		var err error
+	start := clock.Now()
+	err := cause
+	for attempt := 0; ; attempt++ {
+		delay, ok := policy.NextDelay(attempt, clock.Now().Sub(start), err)
+		if !ok {
+			if err == nil {
+				err = errors.New("reconnection stopped by policy")
+			}
+			err = xerrors.Errorf("giving up reconnecting after %d attempts: %w", attempt, err)
+			sm.finish(err)
+			return err
+		}
+		if clock.Sleep(ctx, delay) != nil || ctx.Err() != nil {
+			return nil
+		}
 		// TODO: Make it possible to define logger to log disconnect and reconnection attempts
 		sm.Metrics = initMetrics()
-		if err = sm.client.Resume(); err != nil {
-			var actualErr ConnError
-			if xerrors.As(err, &actualErr) {
-				if actualErr.Permanent {
-					return xerrors.Errorf("unrecoverable connect error %#v", actualErr)
-				}
-			}
-			backoff.wait()
-		} else { // We are connected, we can leave the retry loop
+		if err = sm.client.ResumeContext(ctx); err == nil {
+			// We are connected, we can leave the retry loop
 			break
 		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+	if ctx.Err() != nil {
+		// The manager was stopped while the client was reconnecting
+		return sm.client.Disconnect()
 	}
 
 	if sm.PostConnect != nil {
@@ -0,0 +1,229 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeStreamClient is a custom StreamClient, failing the resumptions with the given errors.
+type fakeStreamClient struct {
+	StreamClient
+	EventManager
+	resumeErrors []error
+	resumes      int
+}
+
+func (c *fakeStreamClient) Connect() error {
+	c.updateState(StateSessionEstablished)
+	return nil
+}
+
+func (c *fakeStreamClient) Resume() error {
+	return c.ResumeContext(context.Background())
+}
+
+func (c *fakeStreamClient) ResumeContext(ctx context.Context) error {
+	c.resumes++
+	c.updateState(StateConnecting)
+	if c.resumes <= len(c.resumeErrors) {
+		// As with the clients of the library, the failed attempts are not reconnected
+		return c.connectionFailed(SMState{}, c.resumeErrors[c.resumes-1])
+	}
+	c.updateState(StateSessionEstablished)
+	return nil
+}
+
+func (c *fakeStreamClient) Disconnect() error {
+	c.updateState(StateDisconnected)
+	return nil
+}
+
+func (c *fakeStreamClient) SetHandler(handler EventHandler) {
+	c.Handler = handler
+}
+
+func (c *fakeStreamClient) State() ConnState {
+	return c.EventManager.State()
+}
+
+func TestStreamManager_CustomClient(t *testing.T) {
+	client := &fakeStreamClient{resumeErrors: []error{NewConnError(errors.New("connection refused"), false)}}
+	connected := make(chan Sender, 2)
+	sm := NewStreamManager(client, func(c Sender) { connected <- c })
+	errChan := make(chan error)
+	go func() {
+		errChan <- sm.Run()
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-connected:
+			if c != client {
+				t.Errorf("post connect hook called with %v", c)
+			}
+		case <-time.After(defaultChannelTimeout):
+			t.Fatalf("post connect hook not called on connection %d", i+1)
+		}
+		if i == 0 {
+			// Losing the connection triggers the reconnection, retried after the temporary error
+			go client.updateState(StateDisconnected)
+		}
+	}
+	if client.resumes != 2 {
+		t.Errorf("expected 2 resumption attempts, got %d", client.resumes)
+	}
+
+	sm.Stop()
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	case <-time.After(defaultChannelTimeout):
+		t.Fatal("stream manager did not stop")
+	}
+}
+
+// fakeClock advances its time when sleeping, and records the delays.
+type fakeClock struct {
+	now    time.Time
+	delays []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.delays = append(c.delays, d)
+	c.now = c.now.Add(d)
+	return ctx.Err()
+}
+
+func TestStreamManager_ReconnectPolicy(t *testing.T) {
+	temporary := NewConnError(errors.New("connection refused"), false)
+	client := &fakeStreamClient{resumeErrors: []error{temporary, temporary, temporary}}
+	clock := &fakeClock{now: time.Now()}
+	connected := make(chan struct{}, 2)
+	sm := NewStreamManager(client, func(c Sender) { connected <- struct{}{} })
+	sm.ReconnectPolicy = &BackoffPolicy{Base: time.Second, NoJitter: true, MaxElapsed: 5 * time.Second}
+	sm.Clock = clock
+	errChan := make(chan error)
+	go func() {
+		errChan <- sm.Run()
+	}()
+	<-connected
+
+	// The delays double after each failed attempt
+	go client.updateState(StateDisconnected)
+	select {
+	case <-connected:
+	case <-time.After(defaultChannelTimeout):
+		t.Fatal("client was not reconnected")
+	}
+	expected := []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second}
+	if len(clock.delays) != len(expected) {
+		t.Fatalf("unexpected delays: %v", clock.delays)
+	}
+	for i := range expected {
+		if clock.delays[i] != expected[i] {
+			t.Errorf("unexpected delays: %v", clock.delays)
+			break
+		}
+	}
+
+	// The policy gives up after the maximum elapsed time
+	client.resumeErrors = append(client.resumeErrors, temporary)
+	client.resumes = 0
+	clock.delays = nil
+	go client.updateState(StateDisconnected)
+	select {
+	case err := <-errChan:
+		var connErr ConnError
+		if !errors.As(err, &connErr) {
+			t.Errorf("expected the last connection error, got %v", err)
+		}
+	case <-time.After(defaultChannelTimeout):
+		t.Fatal("stream manager should give up reconnecting")
+	}
+	if client.resumes != 4 {
+		t.Errorf("expected 4 attempts before giving up, got %d", client.resumes)
+	}
+}
+
+// The client does not reconnect when its session was replaced by another one.
+func TestStreamManager_Conflict(t *testing.T) {
+	client := &fakeStreamClient{}
+	connected := make(chan struct{}, 1)
+	sm := NewStreamManager(client, func(c Sender) { connected <- struct{}{} })
+	errChan := make(chan error)
+	go func() {
+		errChan <- sm.Run()
+	}()
+	<-connected
+
+	go client.streamError("conflict", "replaced by new connection")
+	select {
+	case err := <-errChan:
+		var streamErr *StreamError
+		if !errors.As(err, &streamErr) || streamErr.Condition != "conflict" {
+			t.Errorf("expected conflict stream error, got %v", err)
+		}
+	case <-time.After(defaultChannelTimeout):
+		t.Fatal("stream manager should not reconnect after a conflict")
+	}
+	if client.resumes != 0 {
+		t.Errorf("client should not reconnect, got %d attempts", client.resumes)
+	}
+}
+
+// sleepingClock waits until the context is done.
+type sleepingClock struct {
+	fakeClock
+	sleeping chan struct{}
+}
+
+func (c *sleepingClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.sleeping <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// Stopping the manager interrupts the wait before reconnecting.
+func TestStreamManager_StopWhileWaiting(t *testing.T) {
+	client := &fakeStreamClient{}
+	clock := &sleepingClock{sleeping: make(chan struct{}, 1)}
+	connected := make(chan struct{}, 1)
+	sm := NewStreamManager(client, func(c Sender) { connected <- struct{}{} })
+	sm.Clock = clock
+	errChan := make(chan error)
+	go func() {
+		errChan <- sm.Run()
+	}()
+	<-connected
+
+	reconnection := make(chan struct{})
+	go func() {
+		client.updateState(StateDisconnected)
+		close(reconnection)
+	}()
+	select {
+	case <-clock.sleeping:
+	case <-time.After(defaultChannelTimeout):
+		t.Fatal("stream manager did not wait before reconnecting")
+	}
+	sm.Stop()
+	select {
+	case <-reconnection:
+	case <-time.After(defaultChannelTimeout):
+		t.Fatal("reconnection was not interrupted")
+	}
+	if err := <-errChan; err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if client.resumes != 0 {
+		t.Errorf("client should not reconnect once stopped, got %d attempts", client.resumes)
+	}
+}
@@ -1,6 +1,7 @@
 package xmpp
 
 import (
+	"crypto/tls"
 	"encoding/xml"
 	"fmt"
 	"gosrc.io/xmpp/stanza"
@@ -30,6 +31,9 @@ const (
 	testSendRawPort
 	testDisconnectPort
 	testSManDisconnectPort
+	testComponentStreamManagement
+	testSManComponentPort
+	testSManDialFailures
 
 	// Client tests
 	testClientBasePort
@@ -40,6 +44,25 @@ const (
 
 	// Client internal tests
 	testClientStreamManagement
+	testClientSASL2
+	testClientFast
+	testClientRegister
+	testClientDirectTLS
+	testClientSRVFailover
+	testClientSOCKS5
+	testClientHTTPConnect
+	testClientRedirect
+	testClientRedirectTarget
+	testClientRedirectLoop
+	testClientConnectContext
+	testClientOpenContext
+	testClientSMStateStore
+	testClientSMLocation
+	testClientSMExpired
+	testClientConnectStates
+	testClientConnectFailure
+	testClientSendDuringConnect
+	testClientCredentialContext
 )
 
 // ClientHandler is passed by the test client to provide custom behaviour to
@@ -55,6 +78,8 @@ type ServerMock struct {
 	listener          net.Listener
 	serverConnections []*ServerConn
 	done              chan struct{}
+	// tlsConfig is set to accept direct TLS connections
+	tlsConfig *tls.Config
 }
 
 type ServerConn struct {
@@ -72,6 +97,12 @@ func (mock *ServerMock) Start(t *testing.T, addr string, handler ClientHandler)
 	go mock.loop()
 }
 
+// StartDirectTLS launches the mock TCP server, accepting direct TLS connections (XEP-0368).
+func (mock *ServerMock) StartDirectTLS(t *testing.T, addr string, config *tls.Config, handler ClientHandler) {
+	mock.tlsConfig = config
+	mock.Start(t, addr, handler)
+}
+
 func (mock *ServerMock) Stop() {
 	close(mock.done)
 	if mock.listener != nil {
@@ -95,6 +126,9 @@ func (mock *ServerMock) init(addr string) error {
 		mock.t.Errorf("TCPServerMock cannot listen on address: %q", addr)
 		return err
 	}
+	if mock.tlsConfig != nil {
+		l = tls.NewListener(l, mock.tlsConfig)
+	}
 	mock.listener = l
 	return nil
 }
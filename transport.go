@@ -1,21 +1,37 @@
 package xmpp
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"strings"
 )
 
 var ErrTransportProtocolNotSupported = errors.New("transport protocol not supported")
 var ErrTLSNotSupported = errors.New("transport does not support StartTLS")
 
+// RedirectError is returned when the server redirects the client to another server, with a
+// see-other-host stream error, or a see-other-uri WebSocket close (RFC 7395). The client
+// follows the redirects during Connect.
+type RedirectError struct {
+	// Address is the new address: host and port, or a WebSocket URL
+	Address string
+}
+
+func (e *RedirectError) Error() string {
+	return "redirected to " + e.Address
+}
+
 // TODO: rename to transport config?
 type TransportConfiguration struct {
 	// Address is the XMPP Host and port to connect to. Host is of
 	// the form 'serverhost:port' i.e "localhost:8888"
+	// For clients, when it is empty, the address is resolved from the SRV records of the
+	// domain on each connection, and each server is tried in turn.
 	Address        string
 	Domain         string
 	ConnectTimeout int // Client timeout in seconds. Default to 15
@@ -23,10 +39,67 @@ type TransportConfiguration struct {
 	// changes made after connecting are ignored.
 	TLSConfig     *tls.Config
 	CharsetReader func(charset string, input io.Reader) (io.Reader, error) // passed to xml decoder
+	// TLSMode selects how TLS is negotiated on XMPP TCP connections. It defaults to STARTTLS,
+	// or direct TLS when the address is resolved from a _xmpps-client._tcp SRV record.
+	TLSMode TLSMode
+	// Resolver is used to look up the SRV records of the domain when Address is empty.
+	// Default to net.DefaultResolver.
+	Resolver Resolver
+	// HTTPClient is used by the HTTP based transports, and for connection methods discovery.
+	// Optional.
+	HTTPClient *http.Client
+	// Dialer opens the network connections, for example through a SOCKS5 or HTTP proxy.
+	// It is used by all transports, unless HTTPClient is set. Default to a net.Dialer.
+	// SRV records are still resolved with Resolver: set Address to avoid DNS queries.
+	Dialer Dialer
+	// WebsocketMaxMessageSize is the maximum size of a received WebSocket message, in bytes.
+	// Default to 1 MiB.
+	WebsocketMaxMessageSize int64
+	// WebsocketCompression enables the permessage-deflate WebSocket extension, when supported
+	// by the server.
+	WebsocketCompression bool
+	// SendQueueSize is the maximum number of packets waiting to be written on the connection.
+	// Sending fails with ErrSendQueueFull when it is reached. Default to 100.
+	SendQueueSize int
+	// PrioritizeResponses writes IQ results and errors, and stream management acks, before
+	// the other queued packets.
+	PrioritizeResponses bool
 }
 
+// httpClient returns the HTTP client to use for the configuration.
+func (c TransportConfiguration) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if c.TLSConfig != nil {
+		transport.TLSClientConfig = c.TLSConfig.Clone()
+	}
+	if c.Dialer != nil {
+		// The configured dialer replaces the proxy from the environment
+		transport.Proxy = nil
+		transport.DialContext = c.Dialer.DialContext
+	}
+	return &http.Client{Transport: transport}
+}
+
+// TLSMode defines how TLS is negotiated on XMPP TCP connections.
+type TLSMode uint8
+
+const (
+	// TLSModeAny allows both STARTTLS and direct TLS, depending on the resolved SRV records.
+	TLSModeAny TLSMode = iota
+	// TLSModeStartTLS forces STARTTLS: the connection is upgraded to TLS after opening the stream.
+	TLSModeStartTLS
+	// TLSModeDirectTLS forces direct TLS (XEP-0368): TLS is negotiated from the first byte.
+	TLSModeDirectTLS
+)
+
 type Transport interface {
 	Connect() (string, error)
+	// ConnectContext connects to the server and opens the stream. Cancelling the context aborts the
+	// name resolution, the connection, the TLS handshake and the opening of the stream.
+	ConnectContext(ctx context.Context) (string, error)
 	DoesStartTLS() bool
 	StartTLS() error
 
@@ -40,22 +113,64 @@ type Transport interface {
 	Read(p []byte) (n int, err error)
 	Write(p []byte) (n int, err error)
 	Close() error
+	// CloseContext closes the stream, and waits for the server to close it until the context is done.
+	// The connection is closed immediately with a context which is already done.
+	CloseContext(ctx context.Context) error
 	// ReceivedStreamClose signals to the transport that a </stream:stream> has been received and that the tcp connection
 	// should be closed.
 	ReceivedStreamClose()
 }
 
+// writeContext writes the data to the transport. When the context is done before the write
+// completes, the transport is closed, as a partially written packet would corrupt the stream.
+func writeContext(ctx context.Context, transport Transport, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = transport.CloseContext(ctx)
+	})
+	_, err := transport.Write(data)
+	if !stop() {
+		return ctx.Err()
+	}
+	return err
+}
+
+// ChannelBinder is implemented by transports that can provide TLS channel binding data.
+// It is used to negotiate SCRAM -PLUS SASL mechanisms, binding the authentication
+// to the TLS session.
+type ChannelBinder interface {
+	// ChannelBindingTypes returns the channel binding types available on the current
+	// connection, by order of preference. It is empty if the connection is not encrypted.
+	ChannelBindingTypes() []string
+	// ChannelBinding returns the channel binding data of the given type.
+	ChannelBinding(cbType string) ([]byte, error)
+}
+
 // NewClientTransport creates a new Transport instance for clients.
 // The type of transport is determined by the address in the configuration:
 // - if the address is a URL with the `ws` or `wss` scheme WebsocketTransport is used
+// - if the address is a URL with the `http` or `https` scheme BOSHTransport is used
 // - in all other cases a XMPPTransport is used
-// For XMPPTransport it is mandatory for the address to have a port specified.
+// For XMPPTransport, the default port is added to the address if needed. If the address is empty,
+// the servers are resolved from the domain SRV records on each connection.
 func NewClientTransport(config TransportConfiguration) Transport {
 	if strings.HasPrefix(config.Address, "ws:") || strings.HasPrefix(config.Address, "wss:") {
 		return &WebsocketTransport{Config: config}
 	}
+	if strings.HasPrefix(config.Address, "http:") || strings.HasPrefix(config.Address, "https:") {
+		return &BOSHTransport{Config: config}
+	}
 
-	config.Address = ensurePort(config.Address, 5222)
+	switch {
+	case config.Address == "":
+		// Resolved on connection
+	case config.TLSMode == TLSModeDirectTLS:
+		config.Address = ensurePort(config.Address, 5223)
+	default:
+		config.Address = ensurePort(config.Address, 5222)
+	}
 	return &XMPPTransport{
 		Config:        config,
 		openStatement: clientStreamOpen,
@@ -66,7 +181,8 @@ func NewClientTransport(config TransportConfiguration) Transport {
 // Only XMPP transports are allowed. If you try to use any other protocol an error
 // will be returned.
 func NewComponentTransport(config TransportConfiguration) (Transport, error) {
-	if strings.HasPrefix(config.Address, "ws:") || strings.HasPrefix(config.Address, "wss:") {
+	if strings.HasPrefix(config.Address, "ws:") || strings.HasPrefix(config.Address, "wss:") ||
+		strings.HasPrefix(config.Address, "http:") || strings.HasPrefix(config.Address, "https:") {
 		return nil, fmt.Errorf("components only support XMPP transport: %w", ErrTransportProtocolNotSupported)
 	}
 
@@ -76,3 +192,14 @@ func NewComponentTransport(config TransportConfiguration) (Transport, error) {
 		openStatement: componentStreamOpen,
 	}, nil
 }
+
+// newComponentConnectTransport creates a new Transport instance for components
+// authenticating with SASL over a version 1.0 stream, as defined in XEP-0225.
+func newComponentConnectTransport(config TransportConfiguration) (Transport, error) {
+	t, err := NewComponentTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	t.(*XMPPTransport).openStatement = componentConnectStreamOpen
+	return t, nil
+}
@@ -16,6 +16,9 @@ import (
 
 const maxPacketSize = 32768
 
+// defaultMaxMessageSize is the default maximum size of a received WebSocket message
+const defaultMaxMessageSize = 1 << 20
+
 const pingTimeout = time.Duration(5) * time.Second
 
 var ServerDoesNotSupportXmppOverWebsocket = errors.New("the websocket server does not support the xmpp subprotocol")
@@ -25,7 +28,11 @@ type WebsocketTransport struct {
 	Config  TransportConfiguration
 	decoder *xml.Decoder
 	wsConn  *websocket.Conn
-	queue   chan []byte
+	// queue passes the received messages from the reader to Read. It is not buffered, so that
+	// the reader waits for the messages to be consumed before reading the next one.
+	queue chan []byte
+	// buffer holds the part of the current message not read yet
+	buffer  []byte
 	logFile io.Writer
 
 	closeCtx  context.Context
@@ -33,75 +40,118 @@ type WebsocketTransport struct {
 }
 
 func (t *WebsocketTransport) Connect() (string, error) {
-	t.queue = make(chan []byte, 256)
+	return t.ConnectContext(context.Background())
+}
+
+func (t *WebsocketTransport) ConnectContext(ctx context.Context) (string, error) {
+	t.queue = make(chan []byte)
+	t.buffer = nil
 	t.closeCtx, t.closeFunc = context.WithCancel(context.Background())
 
-	var ctx context.Context
-	ctx = context.Background()
 	if t.Config.ConnectTimeout > 0 {
 		var cancelConnect context.CancelFunc
-		ctx, cancelConnect = context.WithTimeout(t.closeCtx, time.Duration(t.Config.ConnectTimeout)*time.Second)
+		ctx, cancelConnect = context.WithTimeout(ctx, time.Duration(t.Config.ConnectTimeout)*time.Second)
 		defer cancelConnect()
 	}
 
+	compression := websocket.CompressionDisabled
+	if t.Config.WebsocketCompression {
+		compression = websocket.CompressionContextTakeover
+	}
 	wsConn, response, err := websocket.Dial(ctx, t.Config.Address, &websocket.DialOptions{
-		Subprotocols: []string{"xmpp"},
+		Subprotocols:    []string{"xmpp"},
+		HTTPClient:      t.Config.httpClient(),
+		CompressionMode: compression,
 	})
 
 	if err != nil {
-		return "", NewConnError(err, true)
+		// The server may be temporarily unreachable: the connection can be retried
+		t.closeFunc()
+		return "", NewConnError(err, false)
 	}
 	if response.Header.Get("Sec-WebSocket-Protocol") != "xmpp" {
 		t.cleanup(websocket.StatusBadGateway)
 		return "", NewConnError(ServerDoesNotSupportXmppOverWebsocket, true)
 	}
 
-	wsConn.SetReadLimit(maxPacketSize)
+	maxMessageSize := t.Config.WebsocketMaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = defaultMaxMessageSize
+	}
+	wsConn.SetReadLimit(maxMessageSize)
 	t.wsConn = wsConn
 	t.startReader()
 
 	t.decoder = xml.NewDecoder(bufio.NewReaderSize(t, maxPacketSize))
 	t.decoder.CharsetReader = t.Config.CharsetReader
 
-	return t.StartStream()
+	// Abort the opening of the stream when the context is done
+	stop := context.AfterFunc(ctx, func() {
+		_ = wsConn.CloseNow()
+	})
+	sessionID, err := t.StartStream()
+	if !stop() {
+		t.cleanup(websocket.StatusGoingAway)
+		return "", NewConnError(ctx.Err(), false)
+	}
+	return sessionID, err
 }
 
 func (t WebsocketTransport) StartStream() (string, error) {
 	if _, err := fmt.Fprintf(t, `<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" to="%s" version="1.0" />`, t.Config.Domain); err != nil {
 		t.cleanup(websocket.StatusBadGateway)
-		return "", NewConnError(err, true)
+		return "", NewConnError(err, false)
 	}
 
-	sessionID, err := stanza.InitStream(t.GetDecoder())
+	se, err := stanza.NextStart(t.GetDecoder())
 	if err != nil {
 		t.Close()
 		return "", NewConnError(err, false)
 	}
+	// The server may redirect the client to another endpoint instead of opening the stream
+	// Reference: RFC 7395 - https://tools.ietf.org/html/rfc7395#section-3.6.1
+	if se.Name.Space == stanza.NSFraming && se.Name.Local == "close" {
+		t.cleanup(websocket.StatusNormalClosure)
+		for _, attr := range se.Attr {
+			if attr.Name.Local == "see-other-uri" && attr.Value != "" {
+				return "", NewConnError(&RedirectError{Address: attr.Value}, false)
+			}
+		}
+		return "", NewConnError(errors.New("stream closed by the server"), false)
+	}
+	if se.Name.Space != stanza.NSFraming || se.Name.Local != "open" {
+		t.Close()
+		return "", NewConnError(errors.New("xmpp: expected <open> but got <"+se.Name.Local+"> in "+se.Name.Space), false)
+	}
+
+	var sessionID string
+	for _, attr := range se.Attr {
+		if attr.Name.Local == "id" {
+			sessionID = attr.Value
+		}
+	}
 	return sessionID, nil
 }
 
 // startReader runs a go function that keeps reading from the websocket. This
 // is required to allow Ping() to work: Ping requires a Reader to be running
 // to process incoming control frames.
+// Each message is read whole, whatever the number of frames it is made of, up to the
+// maximum message size. The reader closes the queue when the connection ends.
 func (t WebsocketTransport) startReader() {
+	wsConn, queue, ctx := t.wsConn, t.queue, t.closeCtx
 	go func() {
-		buffer := make([]byte, maxPacketSize)
+		defer close(queue)
 		for {
-			_, reader, err := t.wsConn.Reader(t.closeCtx)
+			_, data, err := wsConn.Read(ctx)
 			if err != nil {
 				return
 			}
-			n, err := reader.Read(buffer)
-			if err != nil && err != io.EOF {
+			select {
+			case queue <- data:
+			case <-ctx.Done():
 				return
 			}
-			if n > 0 {
-				// We need to make a copy, otherwise we will overwrite the slice content
-				// on the next iteration of the for loop.
-				tmp := make([]byte, n)
-				copy(tmp, buffer)
-				t.queue <- tmp
-			}
 		}
 	}()
 }
@@ -132,17 +182,25 @@ func (t WebsocketTransport) Ping() error {
 	return t.wsConn.Ping(ctx)
 }
 
+// Read returns the content of the received messages. A message larger than p is returned
+// in several calls.
 func (t *WebsocketTransport) Read(p []byte) (int, error) {
-	select {
-	case <-t.closeCtx.Done():
-		return 0, t.closeCtx.Err()
-	case data := <-t.queue:
+	if len(t.buffer) == 0 {
+		if t.queue == nil {
+			return 0, errors.New("cannot read: not connected")
+		}
+		data, ok := <-t.queue
+		if !ok {
+			return 0, io.EOF
+		}
 		if t.logFile != nil && len(data) > 0 {
 			_, _ = fmt.Fprintf(t.logFile, "RECV:\n%s\n\n", data)
 		}
-		copy(p, data)
-		return len(data), nil
+		t.buffer = data
 	}
+	n := copy(p, t.buffer)
+	t.buffer = t.buffer[n:]
+	return n, nil
 }
 
 func (t WebsocketTransport) Write(p []byte) (int, error) {
@@ -153,7 +211,23 @@ func (t WebsocketTransport) Write(p []byte) (int, error) {
 }
 
 func (t WebsocketTransport) Close() error {
-	t.Write([]byte("<close xmlns=\"urn:ietf:params:xml:ns:xmpp-framing\" />"))
+	return t.CloseContext(context.Background())
+}
+
+func (t WebsocketTransport) CloseContext(ctx context.Context) error {
+	if t.wsConn != nil {
+		wsConn := t.wsConn
+		if ctx.Err() != nil {
+			_ = wsConn.CloseNow()
+		} else {
+			// The closing handshake is interrupted when the context is done
+			stop := context.AfterFunc(ctx, func() {
+				_ = wsConn.CloseNow()
+			})
+			defer stop()
+			t.Write([]byte("<close xmlns=\"urn:ietf:params:xml:ns:xmpp-framing\" />"))
+		}
+	}
 	return t.cleanup(websocket.StatusGoingAway)
 }
 
@@ -163,10 +237,6 @@ func (t *WebsocketTransport) LogTraffic(logFile io.Writer) {
 
 func (t *WebsocketTransport) cleanup(code websocket.StatusCode) error {
 	var err error
-	if t.queue != nil {
-		close(t.queue)
-		t.queue = nil
-	}
 	if t.wsConn != nil {
 		err = t.wsConn.Close(websocket.StatusGoingAway, "Done")
 		t.wsConn = nil
@@ -174,7 +244,6 @@ func (t *WebsocketTransport) cleanup(code websocket.StatusCode) error {
 	if t.closeFunc != nil {
 		t.closeFunc()
 		t.closeFunc = nil
-		t.closeCtx = nil
 	}
 	return err
 }
@@ -0,0 +1,244 @@
+package xmpp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gosrc.io/xmpp/stanza"
+	"nhooyr.io/websocket"
+)
+
+// startWebsocketServer starts a WebSocket server, opening the XMPP framing stream before
+// running the handler.
+func startWebsocketServer(t *testing.T, compression websocket.CompressionMode, handler func(ctx context.Context, c *websocket.Conn)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols:    []string{"xmpp"},
+			CompressionMode: compression,
+		})
+		if err != nil {
+			t.Errorf("cannot accept websocket: %s", err)
+			return
+		}
+		defer c.Close(websocket.StatusNormalClosure, "")
+		ctx := r.Context()
+		if _, _, err = c.Read(ctx); err != nil {
+			t.Errorf("cannot read open: %s", err)
+			return
+		}
+		open := fmt.Sprintf("<open xmlns='%s' id='stream-1' version='1.0'/>", stanza.NSFraming)
+		if err = c.Write(ctx, websocket.MessageText, []byte(open)); err != nil {
+			t.Errorf("cannot write open: %s", err)
+			return
+		}
+		handler(ctx, c)
+	}))
+}
+
+func websocketAddress(server *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// largeMessage returns a message stanza with a body of the given size.
+func largeMessage(size int) string {
+	return fmt.Sprintf("<message xmlns='jabber:client' id='large'><body>%s</body></message>", strings.Repeat("a", size))
+}
+
+// Check that messages larger than the decoder buffer, and sent in several frames, are read whole.
+func TestWebsocketTransport_LargeFragmentedMessage(t *testing.T) {
+	const bodySize = 200000
+	server := startWebsocketServer(t, websocket.CompressionDisabled, func(ctx context.Context, c *websocket.Conn) {
+		w, err := c.Writer(ctx, websocket.MessageText)
+		if err != nil {
+			t.Errorf("cannot get writer: %s", err)
+			return
+		}
+		msg := largeMessage(bodySize)
+		for i := 0; i < len(msg); i += 10000 {
+			end := i + 10000
+			if end > len(msg) {
+				end = len(msg)
+			}
+			if _, err = w.Write([]byte(msg[i:end])); err != nil {
+				t.Errorf("cannot write fragment: %s", err)
+				return
+			}
+		}
+		w.Close()
+		c.Read(ctx) // Wait for the client to close the connection
+	})
+	defer server.Close()
+
+	transport := NewClientTransport(TransportConfiguration{Address: websocketAddress(server), Domain: "localhost"})
+	if _, err := transport.Connect(); err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	defer transport.Close()
+
+	packet, err := stanza.NextPacket(transport.GetDecoder())
+	if err != nil {
+		t.Fatalf("cannot read large message: %s", err)
+	}
+	msg, ok := packet.(stanza.Message)
+	if !ok || len(msg.Body) != bodySize {
+		t.Errorf("large message was not read whole: %T, %d bytes", packet, len(msg.Body))
+	}
+}
+
+// Check that messages over the maximum size end the connection.
+func TestWebsocketTransport_MaxMessageSize(t *testing.T) {
+	server := startWebsocketServer(t, websocket.CompressionDisabled, func(ctx context.Context, c *websocket.Conn) {
+		c.Write(ctx, websocket.MessageText, []byte(largeMessage(4096)))
+		c.Read(ctx)
+	})
+	defer server.Close()
+
+	transport := NewClientTransport(TransportConfiguration{
+		Address:                 websocketAddress(server),
+		Domain:                  "localhost",
+		WebsocketMaxMessageSize: 1024,
+	})
+	if _, err := transport.Connect(); err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	defer transport.Close()
+
+	var msg stanza.Message
+	if err := transport.GetDecoder().Decode(&msg); err == nil {
+		t.Error("message over the maximum size should not be read")
+	}
+}
+
+// Check that the permessage-deflate extension is negotiated when enabled.
+func TestWebsocketTransport_Compression(t *testing.T) {
+	extensions := make(chan string, 1)
+	server := startWebsocketServer(t, websocket.CompressionContextTakeover, func(ctx context.Context, c *websocket.Conn) {
+		c.Write(ctx, websocket.MessageText, []byte(largeMessage(10000)))
+		c.Read(ctx)
+	})
+	defer server.Close()
+	handler := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		extensions <- r.Header.Get("Sec-WebSocket-Extensions")
+		handler.ServeHTTP(w, r)
+	})
+
+	transport := NewClientTransport(TransportConfiguration{
+		Address:              websocketAddress(server),
+		Domain:               "localhost",
+		WebsocketCompression: true,
+	})
+	if _, err := transport.Connect(); err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	defer transport.Close()
+	if ext := <-extensions; !strings.Contains(ext, "permessage-deflate") {
+		t.Errorf("permessage-deflate should be requested, got %q", ext)
+	}
+
+	var msg stanza.Message
+	if err := transport.GetDecoder().Decode(&msg); err != nil || len(msg.Body) != 10000 {
+		t.Errorf("cannot read compressed message: %v", err)
+	}
+}
+
+// Check that the client follows a see-other-uri redirect to another WebSocket endpoint.
+func TestClient_WebsocketSeeOtherURI(t *testing.T) {
+	target := startWebsocketServer(t, websocket.CompressionDisabled, func(ctx context.Context, c *websocket.Conn) {
+		exchange := func(expected string, replies ...string) {
+			_, data, err := c.Read(ctx)
+			if err != nil || !strings.Contains(string(data), expected) {
+				t.Errorf("expected <%s>, got %q (%v)", expected, data, err)
+				return
+			}
+			for _, reply := range replies {
+				if err = c.Write(ctx, websocket.MessageText, []byte(reply)); err != nil {
+					t.Errorf("cannot write: %s", err)
+				}
+			}
+		}
+		features := "<stream:features xmlns:stream='http://etherx.jabber.org/streams'>%s</stream:features>"
+		_ = c.Write(ctx, websocket.MessageText, []byte(fmt.Sprintf(features,
+			"<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms>")))
+		exchange("auth", "<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>")
+		exchange("open", fmt.Sprintf("<open xmlns='%s' id='stream-2' version='1.0'/>", stanza.NSFraming),
+			fmt.Sprintf(features, "<bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>"))
+
+		_, data, err := c.Read(ctx)
+		if err != nil {
+			t.Errorf("cannot read bind request: %s", err)
+			return
+		}
+		var iq stanza.IQ
+		if err = xml.Unmarshal(data, &iq); err != nil {
+			t.Errorf("cannot decode bind request: %s", err)
+			return
+		}
+		result := "<iq type='result' id='%s' xmlns='jabber:client'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>test@localhost/ws</jid></bind></iq>"
+		_ = c.Write(ctx, websocket.MessageText, []byte(fmt.Sprintf(result, iq.Id)))
+		for {
+			if _, _, err = c.Read(ctx); err != nil {
+				return
+			}
+		}
+	})
+	defer target.Close()
+	targetAddress := strings.Replace(websocketAddress(target), "127.0.0.1", "localhost", 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{"xmpp"}})
+		if err != nil {
+			t.Errorf("cannot accept websocket: %s", err)
+			return
+		}
+		defer c.Close(websocket.StatusNormalClosure, "")
+		if _, _, err = c.Read(r.Context()); err != nil {
+			t.Errorf("cannot read open: %s", err)
+			return
+		}
+		redirect := fmt.Sprintf("<close xmlns='%s' see-other-uri='%s'/>", stanza.NSFraming, targetAddress)
+		_ = c.Write(r.Context(), websocket.MessageText, []byte(redirect))
+		c.Read(r.Context()) // Wait for the client to close the connection
+	}))
+	defer server.Close()
+
+	config := Config{
+		TransportConfiguration: TransportConfiguration{
+			Address: websocketAddress(server),
+		},
+		Jid:        "test@localhost",
+		Credential: Password("test"),
+		Insecure:   true,
+	}
+	client, err := NewClient(&config, NewRouter(), clientDefaultErrorHandler)
+	if err != nil {
+		t.Fatalf("cannot create XMPP client: %s", err)
+	}
+	if err = client.Connect(); err != nil {
+		t.Fatalf("XMPP connection should follow the redirect: %s", err)
+	}
+	defer client.Disconnect()
+	if client.Session.BindJid != "test@localhost/ws" {
+		t.Errorf("session should be established on the redirect target, bound jid: %q", client.Session.BindJid)
+	}
+}
+
+// A server which cannot be reached can be retried.
+func TestWebsocketTransport_Unreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	address := websocketAddress(server)
+	server.Close()
+
+	transport := NewClientTransport(TransportConfiguration{Address: address, Domain: "localhost", ConnectTimeout: 1})
+	_, err := transport.Connect()
+	var connErr ConnError
+	if !errors.As(err, &connErr) || connErr.Permanent {
+		t.Errorf("expected a temporary connection error, got %v", err)
+	}
+}
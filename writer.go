@@ -0,0 +1,305 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"gosrc.io/xmpp/stanza"
+)
+
+// ============================================================================
+// Outbound queue
+
+var (
+	// ErrSendQueueFull is returned when a packet cannot be queued, as SendQueueSize packets are
+	// already waiting to be written.
+	ErrSendQueueFull = errors.New("send queue is full")
+	// ErrNotConnected is returned when sending while the connection is not established, or
+	// after it was lost.
+	ErrNotConnected = errors.New("not connected")
+)
+
+const defaultSendQueueSize = 100
+
+type sendRequest struct {
+	ctx  context.Context
+	data []byte
+	// track is set for the stanzas counted by stream management
+	track bool
+	// onAck is called when the server acknowledges the stanza
+	onAck AckHandler
+	// buffered is the sequence number of the stanza in the offline buffer, 0 when it was not buffered
+	buffered uint64
+	// result receives the result of the write, when the sender waits for it
+	result chan error
+}
+
+// packetWriter writes the packets of a connection from a single goroutine, so that concurrent
+// sends are not interleaved, and a slow connection does not block the senders.
+type packetWriter struct {
+	transport Transport
+	queue     chan sendRequest
+	// priority holds the responses written before the queued packets, when enabled
+	priority   chan sendRequest
+	prioritize bool
+	// track is called with the tracked stanzas when they are written, in the order of the stream
+	track func(data []byte, onAck AckHandler, buffered uint64)
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+	mu        sync.Mutex
+	err       error
+	// closed is set before the queue is flushed or rejected, so that no request is queued after
+	closed bool
+}
+
+func newPacketWriter(transport Transport, config TransportConfiguration, track func(data []byte, onAck AckHandler, buffered uint64)) *packetWriter {
+	size := config.SendQueueSize
+	if size <= 0 {
+		size = defaultSendQueueSize
+	}
+	w := &packetWriter{
+		transport:  transport,
+		queue:      make(chan sendRequest, size),
+		priority:   make(chan sendRequest, size),
+		prioritize: config.PrioritizeResponses,
+		track:      track,
+		closing:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// send queues the data. Without waiting, it returns ErrSendQueueFull when the queue is full.
+// Otherwise, it waits for room in the queue, then for the data to be written, until the
+// context is done. The data is dropped if the context is done before it is written.
+func (w *packetWriter) send(ctx context.Context, data []byte, priority, track, wait bool) error {
+	return w.enqueue(sendRequest{ctx: ctx, data: data, track: track}, priority, wait)
+}
+
+// enqueue is like send, for a request with an ack handler.
+func (w *packetWriter) enqueue(req sendRequest, priority, wait bool) error {
+	ctx := req.ctx
+	if w == nil {
+		return ErrNotConnected
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-w.closing:
+		return w.failure()
+	case <-w.done:
+		return w.failure()
+	default:
+	}
+
+	queue := w.queue
+	if priority && w.prioritize {
+		queue = w.priority
+	}
+	if !wait {
+		// Queuing under the lock ensures that the request is written, flushed or rejected
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.closed {
+			return w.failureLocked()
+		}
+		select {
+		case queue <- req:
+			return nil
+		default:
+			return ErrSendQueueFull
+		}
+	}
+
+	req.result = make(chan error, 1)
+	select {
+	case queue <- req:
+	case <-w.done:
+		return w.failure()
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", ErrSendQueueFull, ctx.Err())
+	}
+	select {
+	case err := <-req.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-w.done:
+		select {
+		case err := <-req.result:
+			return err
+		default:
+			return w.failure()
+		}
+	}
+}
+
+// sendDirect writes the data to the transport, when it was connected directly instead of with
+// Connect. Once managed by Connect, the packets are only written by the writer of the connection,
+// so that they are not mixed with the negotiation of the stream: they cannot be sent without it.
+func sendDirect(ctx context.Context, transport Transport, managed bool, data []byte) error {
+	if managed || transport == nil {
+		return ErrNotConnected
+	}
+	return writeContext(ctx, transport, data)
+}
+
+func (w *packetWriter) run() {
+	defer close(w.done)
+	for {
+		var req sendRequest
+		select {
+		case req = <-w.priority:
+		default:
+			select {
+			case req = <-w.priority:
+			case req = <-w.queue:
+			case <-w.closing:
+				w.flush()
+				return
+			}
+		}
+		if err := w.write(req); err != nil {
+			w.fail(err)
+			return
+		}
+	}
+}
+
+// write writes a request. Requests whose context is done are dropped.
+func (w *packetWriter) write(req sendRequest) error {
+	if err := req.ctx.Err(); err != nil {
+		if req.result != nil {
+			req.result <- err
+		}
+		return nil
+	}
+	w.tracked(req)
+	err := writeContext(req.ctx, w.transport, req.data)
+	if req.result != nil {
+		req.result <- err
+	}
+	return err
+}
+
+// flush writes the queued packets before the writer stops.
+func (w *packetWriter) flush() {
+	for {
+		var req sendRequest
+		select {
+		case req = <-w.priority:
+		case req = <-w.queue:
+		default:
+			return
+		}
+		if err := w.write(req); err != nil {
+			w.fail(err)
+			return
+		}
+	}
+}
+
+// fail stops the writer after a write error. The connection is closed, and the queued packets are
+// rejected. Stanzas tracked by stream management are kept in the unacknowledged queue, to be sent
+// again when the session is resumed.
+func (w *packetWriter) fail(err error) {
+	w.mu.Lock()
+	w.err = err
+	w.closed = true
+	w.mu.Unlock()
+
+	_ = w.transport.CloseContext(canceledContext())
+
+	for {
+		var req sendRequest
+		select {
+		case req = <-w.priority:
+		case req = <-w.queue:
+		default:
+			return
+		}
+		if req.result != nil {
+			req.result <- w.failure()
+		} else {
+			w.tracked(req)
+		}
+	}
+}
+
+// tracked passes a written stanza to stream management.
+func (w *packetWriter) tracked(req sendRequest) {
+	switch {
+	case !req.track:
+	case w.track != nil:
+		w.track(req.data, req.onAck, req.buffered)
+	case req.onAck != nil:
+		req.onAck(ErrStreamManagementDisabled)
+	}
+}
+
+// failure returns the error for the packets which cannot be sent.
+func (w *packetWriter) failure() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.failureLocked()
+}
+
+// failureLocked is failure, with the lock held.
+func (w *packetWriter) failureLocked() error {
+	if w.err != nil {
+		return fmt.Errorf("%w: %w", ErrNotConnected, w.err)
+	}
+	return ErrNotConnected
+}
+
+// close writes the queued packets, and stops the writer. It waits for the packets to be written
+// until the context is done.
+func (w *packetWriter) close(ctx context.Context) {
+	if w == nil {
+		return
+	}
+	w.closeOnce.Do(func() {
+		w.mu.Lock()
+		w.closed = true
+		w.mu.Unlock()
+		close(w.closing)
+	})
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+	}
+}
+
+// isResponse tells if the packet answers the server: IQ results and errors, and stream
+// management acks. They can be written before the queued packets.
+func isResponse(packet stanza.Packet) bool {
+	switch p := packet.(type) {
+	case *stanza.IQ:
+		return p.Type == stanza.IQTypeResult || p.Type == stanza.IQTypeError
+	case stanza.SMAnswer, *stanza.SMAnswer:
+		return true
+	}
+	return false
+}
+
+// isStanza tells if the packet is counted by stream management, unlike its nonzas.
+func isStanza(packet stanza.Packet) bool {
+	switch packet.(type) {
+	case stanza.SMRequest, *stanza.SMRequest, stanza.SMAnswer, *stanza.SMAnswer:
+		return false
+	}
+	return true
+}
+
+// canceledContext returns a context which is already done, to close a connection immediately.
+func canceledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
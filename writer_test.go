@@ -0,0 +1,199 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingTransport records the written packets. Writes block while the gate is closed.
+type blockingTransport struct {
+	Transport
+	gate    chan struct{}
+	started chan struct{}
+	err     error
+
+	mu      sync.Mutex
+	written []string
+	closed  bool
+}
+
+func newBlockingTransport() *blockingTransport {
+	return &blockingTransport{gate: make(chan struct{}), started: make(chan struct{}, 10)}
+}
+
+func (t *blockingTransport) Write(p []byte) (int, error) {
+	t.started <- struct{}{}
+	<-t.gate
+	if t.err != nil {
+		return 0, t.err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.written = append(t.written, string(p))
+	return len(p), nil
+}
+
+func (t *blockingTransport) CloseContext(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	return nil
+}
+
+func (t *blockingTransport) packets() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.written...)
+}
+
+func TestPacketWriter_QueueFull(t *testing.T) {
+	transport := newBlockingTransport()
+	w := newPacketWriter(transport, TransportConfiguration{SendQueueSize: 1}, nil)
+	defer close(transport.gate)
+
+	ctx := context.Background()
+	if err := w.send(ctx, []byte("<a/>"), false, false, false); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	<-transport.started // The writer is blocked on the first packet
+	if err := w.send(ctx, []byte("<b/>"), false, false, false); err != nil {
+		t.Fatalf("send failed: %s", err)
+	}
+	if err := w.send(ctx, []byte("<c/>"), false, false, false); !errors.Is(err, ErrSendQueueFull) {
+		t.Errorf("expected ErrSendQueueFull, got %v", err)
+	}
+
+	// Waiting for room in the queue is bounded by the context
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	err := w.send(ctx, []byte("<c/>"), false, false, true)
+	if !errors.Is(err, ErrSendQueueFull) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected ErrSendQueueFull after the deadline, got %v", err)
+	}
+}
+
+func TestPacketWriter_Priority(t *testing.T) {
+	transport := newBlockingTransport()
+	w := newPacketWriter(transport, TransportConfiguration{PrioritizeResponses: true}, nil)
+
+	ctx := context.Background()
+	_ = w.send(ctx, []byte("<first/>"), false, false, false)
+	<-transport.started
+	_ = w.send(ctx, []byte("<message/>"), false, false, false)
+	_ = w.send(ctx, []byte("<a/>"), true, false, false)
+	close(transport.gate)
+	w.close(ctx)
+
+	packets := transport.packets()
+	expected := []string{"<first/>", "<a/>", "<message/>"}
+	if len(packets) != len(expected) {
+		t.Fatalf("unexpected packets: %v", packets)
+	}
+	for i := range expected {
+		if packets[i] != expected[i] {
+			t.Errorf("responses should be written first: %v", packets)
+			break
+		}
+	}
+}
+
+func TestPacketWriter_SendDeadline(t *testing.T) {
+	transport := newBlockingTransport()
+	w := newPacketWriter(transport, TransportConfiguration{}, nil)
+
+	ctx := context.Background()
+	_ = w.send(ctx, []byte("<first/>"), false, false, false)
+	<-transport.started
+
+	deadlineCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := w.send(deadlineCtx, []byte("<late/>"), false, false, true); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the send deadline to be exceeded, got %v", err)
+	}
+	close(transport.gate)
+	w.close(ctx)
+
+	packets := transport.packets()
+	if len(packets) != 1 || packets[0] != "<first/>" {
+		t.Errorf("expired packet should be dropped: %v", packets)
+	}
+}
+
+func TestPacketWriter_ConnectionLost(t *testing.T) {
+	transport := newBlockingTransport()
+	transport.err = errors.New("broken pipe")
+	close(transport.gate)
+	var tracked []string
+	w := newPacketWriter(transport, TransportConfiguration{}, func(data []byte, onAck AckHandler, buffered uint64) {
+		tracked = append(tracked, string(data))
+	})
+
+	err := w.send(context.Background(), []byte("<message/>"), false, true, true)
+	if err == nil || err.Error() != "broken pipe" {
+		t.Errorf("expected write error, got %v", err)
+	}
+	<-w.done
+	if err = w.send(context.Background(), []byte("<message/>"), false, true, false); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected after the connection is lost, got %v", err)
+	}
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	if !transport.closed {
+		t.Error("connection should be closed after a write error")
+	}
+	if len(tracked) != 1 {
+		t.Errorf("written stanza should be tracked: %v", tracked)
+	}
+}
+
+// discardTransport accepts all the writes.
+type discardTransport struct {
+	Transport
+}
+
+func (discardTransport) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discardTransport) CloseContext(ctx context.Context) error {
+	return nil
+}
+
+// The stanzas queued without waiting are written or rejected when the writer is closed.
+func TestPacketWriter_SendWhileClosing(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		var mu sync.Mutex
+		var tracked, sent int
+		w := newPacketWriter(discardTransport{}, TransportConfiguration{}, func(data []byte, onAck AckHandler, buffered uint64) {
+			mu.Lock()
+			tracked++
+			mu.Unlock()
+		})
+		var wg sync.WaitGroup
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					err := w.send(context.Background(), []byte("<message/>"), false, true, false)
+					if errors.Is(err, ErrNotConnected) {
+						return
+					}
+					if err == nil {
+						mu.Lock()
+						sent++
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+		w.close(context.Background())
+		wg.Wait()
+		if sent != tracked {
+			t.Fatalf("%d stanzas sent, but %d tracked", sent, tracked)
+		}
+	}
+}
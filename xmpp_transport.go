@@ -2,10 +2,15 @@ package xmpp
 
 import (
 	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net"
 	"time"
@@ -24,41 +29,121 @@ type XMPPTransport struct {
 	readWriter    io.ReadWriter
 	logFile       io.Writer
 	isSecure      bool
+	// directTLS is set when the server was resolved from a direct TLS SRV record
+	directTLS bool
 	// Used to close TCP connection when a stream close message is received from the server
 	closeChan chan stanza.StreamClosePacket
 }
 
 var componentStreamOpen = fmt.Sprintf("<?xml version='1.0'?><stream:stream to='%%s' xmlns='%s' xmlns:stream='%s'>", stanza.NSComponent, stanza.NSStream)
 
+var componentConnectStreamOpen = fmt.Sprintf("<?xml version='1.0'?><stream:stream to='%%s' xmlns='%s' xmlns:stream='%s' version='1.0'>", stanza.NSComponentConnect, stanza.NSStream)
+
 var clientStreamOpen = fmt.Sprintf("<?xml version='1.0'?><stream:stream to='%%s' xmlns='%s' xmlns:stream='%s' version='1.0'>", stanza.NSClient, stanza.NSStream)
 
 func (t *XMPPTransport) Connect() (string, error) {
+	return t.ConnectContext(context.Background())
+}
+
+func (t *XMPPTransport) ConnectContext(ctx context.Context) (string, error) {
 	var err error
 
 	// Since we're starting a new connection, reset the encryption status
 	t.isSecure = false
 
-	t.conn, err = net.DialTimeout("tcp", t.Config.Address, time.Duration(t.Config.ConnectTimeout)*time.Second)
+	// Try each server in turn, until one accepts the connection
+	dialer := defaultDialer(t.Config.Dialer)
+	for _, target := range t.targets(ctx) {
+		if t.conn, err = t.dial(ctx, dialer, target.address); err == nil {
+			t.directTLS = target.directTLS
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
 	if err != nil {
-		return "", NewConnError(err, true)
+		// The server may be temporarily unreachable: the connection can be retried
+		return "", NewConnError(err, false)
 	}
 
 	t.closeChan = make(chan stanza.StreamClosePacket, 1)
-	t.readWriter = newStreamLogger(t.conn, t.logFile)
-	t.decoder = xml.NewDecoder(bufio.NewReaderSize(t.readWriter, maxPacketSize))
-	t.decoder.CharsetReader = t.Config.CharsetReader
-	return t.StartStream()
+	conn := t.conn
+	var sessionID string
+	err = handshakeContext(ctx, conn, func() error {
+		if t.usesDirectTLS() {
+			// Direct TLS (XEP-0368): negotiate TLS before opening the stream
+			if err := t.handshake([]string{"xmpp-client"}); err != nil {
+				return NewConnError(err, true)
+			}
+		} else {
+			t.readWriter = newStreamLogger(t.conn, t.logFile)
+			t.decoder = xml.NewDecoder(bufio.NewReaderSize(t.readWriter, maxPacketSize))
+			t.decoder.CharsetReader = t.Config.CharsetReader
+		}
+		var err error
+		sessionID, err = t.openStream()
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		if _, ok := err.(ConnError); !ok {
+			err = NewConnError(err, false)
+		}
+		return "", err
+	}
+	return sessionID, nil
+}
+
+// usesDirectTLS returns true if TLS must be negotiated from the first byte, instead of
+// with STARTTLS. Only client streams support direct TLS.
+func (t *XMPPTransport) usesDirectTLS() bool {
+	if t.openStatement != clientStreamOpen {
+		return false
+	}
+	return t.Config.TLSMode == TLSModeDirectTLS || (t.Config.TLSMode == TLSModeAny && t.directTLS)
+}
+
+// dial connects to the address with the dialer, within the connect timeout.
+func (t *XMPPTransport) dial(ctx context.Context, dialer Dialer, address string) (net.Conn, error) {
+	if t.Config.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(t.Config.ConnectTimeout)*time.Second)
+		defer cancel()
+	}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// targets returns the addresses to connect to. Client addresses are resolved on each
+// connection when no address is configured, so that DNS changes are taken into account.
+func (t *XMPPTransport) targets(ctx context.Context) []srvTarget {
+	if t.Config.Address != "" || t.openStatement != clientStreamOpen {
+		return []srvTarget{{address: t.Config.Address}}
+	}
+	if t.Config.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(t.Config.ConnectTimeout)*time.Second)
+		defer cancel()
+	}
+	return lookupClientTargets(ctx, t.Config.Resolver, t.Config.Domain, t.Config.TLSMode)
 }
 
 func (t *XMPPTransport) StartStream() (string, error) {
-	if _, err := fmt.Fprintf(t, t.openStatement, t.Config.Domain); err != nil {
+	sessionID, err := t.openStream()
+	if err != nil {
 		t.Close()
+	}
+	return sessionID, err
+}
+
+// openStream sends the stream header, and reads the header of the server.
+func (t *XMPPTransport) openStream() (string, error) {
+	if _, err := fmt.Fprintf(t, t.openStatement, t.Config.Domain); err != nil {
 		return "", NewConnError(err, true)
 	}
 
 	sessionID, err := stanza.InitStream(t.GetDecoder())
 	if err != nil {
-		t.Close()
 		return "", NewConnError(err, false)
 	}
 	return sessionID, nil
@@ -81,6 +166,12 @@ func (t *XMPPTransport) IsSecure() bool {
 }
 
 func (t *XMPPTransport) StartTLS() error {
+	return t.handshake(nil)
+}
+
+// handshake converts the current connection to TLS. nextProtos are the ALPN protocols to
+// offer, when not set in the TLS configuration.
+func (t *XMPPTransport) handshake(nextProtos []string) error {
 	if t.Config.TLSConfig == nil {
 		t.TLSConfig = &tls.Config{}
 	} else {
@@ -90,6 +181,9 @@ func (t *XMPPTransport) StartTLS() error {
 	if t.TLSConfig.ServerName == "" {
 		t.TLSConfig.ServerName = t.Config.Domain
 	}
+	if len(t.TLSConfig.NextProtos) == 0 {
+		t.TLSConfig.NextProtos = nextProtos
+	}
 	tlsConn := tls.Client(t.conn, t.TLSConfig)
 	// We convert existing connection to TLS
 	if err := tlsConn.Handshake(); err != nil {
@@ -112,6 +206,59 @@ func (t *XMPPTransport) StartTLS() error {
 	return nil
 }
 
+// ChannelBindingTypes returns the channel binding types supported on the TLS connection.
+// tls-exporter is only offered with TLS 1.3, as it is not safe to use with older TLS
+// versions without extended master secret.
+func (t *XMPPTransport) ChannelBindingTypes() []string {
+	tlsConn, ok := t.conn.(*tls.Conn)
+	if !ok || !t.isSecure {
+		return nil
+	}
+	if tlsConn.ConnectionState().Version >= tls.VersionTLS13 {
+		return []string{"tls-exporter", "tls-server-end-point"}
+	}
+	return []string{"tls-server-end-point"}
+}
+
+// ChannelBinding returns the channel binding data for the given type.
+// Reference: RFC 9266 (tls-exporter) and RFC 5929 (tls-server-end-point)
+func (t *XMPPTransport) ChannelBinding(cbType string) ([]byte, error) {
+	tlsConn, ok := t.conn.(*tls.Conn)
+	if !ok || !t.isSecure {
+		return nil, errors.New("channel binding requires a TLS connection")
+	}
+	state := tlsConn.ConnectionState()
+
+	switch cbType {
+	case "tls-exporter":
+		if state.Version < tls.VersionTLS13 {
+			return nil, errors.New("tls-exporter channel binding requires TLS 1.3")
+		}
+		return state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	case "tls-server-end-point":
+		if len(state.PeerCertificates) == 0 {
+			return nil, errors.New("no server certificate for tls-server-end-point channel binding")
+		}
+		cert := state.PeerCertificates[0]
+		var h hash.Hash
+		switch cert.SignatureAlgorithm {
+		case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+			h = sha512.New384()
+		case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+			h = sha512.New()
+		case x509.PureEd25519:
+			return nil, errors.New("tls-server-end-point is not defined for Ed25519 certificates")
+		default:
+			// MD5 and SHA-1 are replaced by SHA-256, as defined in RFC 5929
+			h = sha256.New()
+		}
+		h.Write(cert.Raw)
+		return h.Sum(nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported channel binding type: %s", cbType)
+	}
+}
+
 func (t *XMPPTransport) Ping() error {
 	n, err := t.conn.Write([]byte("\n"))
 	if err != nil {
@@ -138,14 +285,20 @@ func (t *XMPPTransport) Write(p []byte) (n int, err error) {
 }
 
 func (t *XMPPTransport) Close() error {
-	if t.readWriter != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(t.Config.ConnectTimeout)*time.Second)
+	defer cancel()
+	return t.CloseContext(ctx)
+}
+
+func (t *XMPPTransport) CloseContext(ctx context.Context) error {
+	if t.readWriter != nil && ctx.Err() == nil {
 		_, _ = t.readWriter.Write([]byte(stanza.StreamClose))
 	}
 
-	// Try to wait for the stream close tag from the server. After a timeout, disconnect anyway.
+	// Try to wait for the stream close tag from the server. When the context is done, disconnect anyway.
 	select {
 	case <-t.closeChan:
-	case <-time.After(time.Duration(t.Config.ConnectTimeout) * time.Second):
+	case <-ctx.Done():
 	}
 
 	if t.conn != nil {